@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cio"
@@ -75,9 +76,12 @@ func startCmd(ctx context.Context, args []string) {
 
 func restartCmd(ctx context.Context, args []string) {
 	// validate arguments with the command as "restart"
-	parseCmd(ctx, "restart", args)
+	_, service, _, path, _ := parseCmd(ctx, "restart", args)
 
 	stopCmd(ctx, args)
+	// recorded between the stopped and started events
+	logger := GetServiceLog(varLogDir, service, bundleAnnotations(filepath.Join(path, service)))
+	recordEvent(logger, &lifecycleEvent{event: eventRestarted, service: service, exitCode: -1})
 	startCmd(ctx, args)
 }
 
@@ -126,14 +130,13 @@ func stop(ctx context.Context, service, sock, basePath string) (string, uint32,
 	id := ctr.ID()
 	pid := task.Pid()
 
-	err = task.Kill(ctx, 9)
-	if err != nil {
-		return "", 0, "killing task", err
+	// so that "service monitor" doesn't restart it
+	if _, err := ctr.SetLabels(ctx, map[string]string{stoppedLabel: "true"}); err != nil {
+		return "", 0, "labelling container", err
 	}
 
-	_, err = task.Wait(ctx)
-	if err != nil {
-		return "", 0, "waiting for task to exit", err
+	if err := stopTask(ctx, ctr, task, stopConfigFor(service, bundleAnnotations(path))); err != nil {
+		return "", 0, "stopping task", err
 	}
 
 	_, err = task.Delete(ctx)
@@ -146,12 +149,34 @@ func stop(ctx context.Context, service, sock, basePath string) (string, uint32,
 		return "", 0, "deleting container", err
 	}
 
+	logger := GetServiceLog(varLogDir, service, bundleAnnotations(path))
+	recordEvent(logger, &lifecycleEvent{event: eventStopped, service: service, pid: pid, exitCode: -1})
+	// the service has stopped even if its logs can't be closed
+	for _, n := range []string{service + ".out", service} {
+		if err := logger.Close(n); err != nil {
+			log.WithError(err).Errorf("closing log %s", n)
+		}
+	}
+
 	return id, pid, "", nil
 }
 
 func start(ctx context.Context, service, sock, basePath, dumpSpec string) (string, uint32, string, error) {
+	if service == initLogName {
+		return "", 0, "invalid service name", fmt.Errorf("%q is reserved for the log of init", service)
+	}
 	path := filepath.Join(basePath, service)
 
+	// instances of templates are created when they are first started
+	if _, err := os.Stat(filepath.Join(path, "config.json")); os.IsNotExist(err) && strings.Contains(service, "@") {
+		if err := instantiate(basePath, service); err != nil {
+			return "", 0, "creating instance", err
+		}
+	}
+	if isTemplate(bundleAnnotations(path)) {
+		return "", 0, "invalid service name", fmt.Errorf("%s is a template, start an instance of it such as %s@1", service, service)
+	}
+
 	runtimeConfig := getRuntimeConfig(path)
 
 	rootfs := filepath.Join(path, "rootfs")
@@ -176,6 +201,10 @@ func start(ctx context.Context, service, sock, basePath, dumpSpec string) (strin
 
 	spec.Root.Path = rootfs
 
+	if notifyEnabled(spec.Annotations) {
+		withNotify(spec, service)
+	}
+
 	if dumpSpec != "" {
 		d, err := os.Create(dumpSpec)
 		if err != nil {
@@ -198,7 +227,7 @@ func start(ctx context.Context, service, sock, basePath, dumpSpec string) (strin
 		return "", 0, "failed to create container", err
 	}
 
-	logger := GetLog(varLogDir)
+	logger := GetServiceLog(varLogDir, service, spec.Annotations)
 
 	io := func(id string) (cio.IO, error) {
 		stdoutFile := logger.Path(service + ".out")
@@ -218,6 +247,11 @@ func start(ctx context.Context, service, sock, basePath, dumpSpec string) (strin
 		return "", 0, "failed to create task", err
 	}
 
+	namespace, _ := namespaces.Namespace(ctx)
+	for _, n := range []string{service + ".out", service} {
+		setLogProcess(logger, n, int(task.Pid()), namespace)
+	}
+
 	if err := prepareProcess(int(task.Pid()), runtimeConfig); err != nil {
 		return "", 0, "preparing process", err
 	}
@@ -226,6 +260,7 @@ func start(ctx context.Context, service, sock, basePath, dumpSpec string) (strin
 		// Don't destroy the container here so it can be inspected for debugging.
 		return "", 0, "failed to start task", err
 	}
+	recordEvent(logger, &lifecycleEvent{event: eventStarted, service: service, pid: task.Pid(), exitCode: -1})
 
 	return ctr.ID(), task.Pid(), "", nil
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// dependsAnnotation on a service's OCI spec lists, separated by
+	// commas, the services or targets which must be ready before
+	// system-init starts it.
+	dependsAnnotation = "org.mobyproject.depends-on"
+
+	// targetsAnnotation lists, separated by commas, the targets a service
+	// is part of. A target is a name for a group of services, such as
+	// "network", which is ready when all of them are.
+	targetsAnnotation = "org.mobyproject.targets"
+
+	// readyTimeout is how long system-init waits for the dependencies of
+	// a service before starting it anyway.
+	readyTimeout = time.Minute
+
+	readyInterval = 100 * time.Millisecond
+)
+
+// splitList splits a comma separated annotation.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// serviceDependencies returns the services each service depends on, with
+// targets replaced by their members. Unknown dependencies are reported and
+// ignored.
+func serviceDependencies(annotations map[string]map[string]string) map[string][]string {
+	targets := map[string][]string{}
+	for service, a := range annotations {
+		for _, target := range splitList(a[targetsAnnotation]) {
+			targets[target] = append(targets[target], service)
+		}
+	}
+	deps := map[string][]string{}
+	for service, a := range annotations {
+		seen := map[string]bool{}
+		for _, dep := range splitList(a[dependsAnnotation]) {
+			members := []string{dep}
+			if _, ok := annotations[dep]; !ok {
+				if members, ok = targets[dep]; !ok {
+					log.Printf("Ignoring dependency of %s on unknown service or target %q", service, dep)
+					continue
+				}
+			}
+			for _, m := range members {
+				if m != service && !seen[m] {
+					seen[m] = true
+					deps[service] = append(deps[service], m)
+				}
+			}
+		}
+		sort.Strings(deps[service])
+	}
+	return deps
+}
+
+// startOrder sorts services so that each comes after its dependencies,
+// and otherwise by name. Services in a dependency cycle are reported and
+// put last, in name order.
+func startOrder(services []string, deps map[string][]string) []string {
+	sorted := append([]string{}, services...)
+	sort.Strings(sorted)
+	var order []string
+	started := map[string]bool{}
+	for len(order) < len(sorted) {
+		progress := false
+		for _, service := range sorted {
+			if started[service] {
+				continue
+			}
+			ready := true
+			for _, dep := range deps[service] {
+				if !started[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				order = append(order, service)
+				started[service] = true
+				progress = true
+			}
+		}
+		if !progress {
+			var cycle []string
+			for _, service := range sorted {
+				if !started[service] {
+					cycle = append(cycle, service)
+					order = append(order, service)
+				}
+			}
+			log.Printf("Dependency cycle between %s: starting them in name order", strings.Join(cycle, ", "))
+			break
+		}
+	}
+	return order
+}
+
+// ready returns true if a service is running and, if it has a notify
+// socket, has said it is ready and, if it has a health check, is healthy.
+// A oneshot service is ready once it has exited successfully.
+func ready(ctx context.Context, client *containerd.Client, basePath, service string) (bool, error) {
+	path := filepath.Join(basePath, service)
+	if ns := getRuntimeConfig(path).Namespace; ns != "" {
+		ctx = namespaces.WithNamespace(ctx, ns)
+	}
+	ctr, err := client.LoadContainer(ctx, service)
+	if err != nil {
+		return false, err
+	}
+	task, err := ctr.Task(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	status, err := task.Status(ctx)
+	if err != nil {
+		return false, err
+	}
+	annotations := bundleAnnotations(path)
+	if oneshotEnabled(annotations) {
+		if status.Status != containerd.Stopped {
+			return false, nil
+		}
+		if status.ExitStatus != 0 {
+			err := &oneshotFailedError{service: service, exitCode: status.ExitStatus}
+			// it may yet succeed if "service monitor" restarts it
+			if restartPolicyFor(service, annotations).mode != "no" {
+				return false, fmt.Errorf("%v", err)
+			}
+			return false, err
+		}
+		return true, nil
+	}
+	if status.Status != containerd.Running {
+		return false, nil
+	}
+	if notifyEnabled(annotations) && !notifiedReady(service, task) {
+		return false, nil
+	}
+	if h := healthCheckFor(service, annotations); h != nil {
+		if err := h.run(ctx, ctr, task); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// waitReady waits for services to be ready, for up to readyTimeout.
+func waitReady(ctx context.Context, client *containerd.Client, basePath string, deps []string) error {
+	deadline := time.Now().Add(readyTimeout)
+	for _, dep := range deps {
+		for {
+			ok, err := ready(ctx, client, basePath, dep)
+			if ok {
+				break
+			}
+			if _, failed := err.(*oneshotFailedError); failed {
+				return err
+			}
+			if time.Now().After(deadline) {
+				if err != nil {
+					return fmt.Errorf("%s is not ready: %v", dep, err)
+				}
+				return fmt.Errorf("%s is not ready", dep)
+			}
+			time.Sleep(readyInterval)
+		}
+	}
+	return nil
+}
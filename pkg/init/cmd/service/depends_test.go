@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitList(t *testing.T) {
+	for _, test := range []struct {
+		s        string
+		expected []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{" a , b,,c ", []string{"a", "b", "c"}},
+	} {
+		if list := splitList(test.s); !reflect.DeepEqual(list, test.expected) {
+			t.Errorf("%q: expected %q, got %q", test.s, test.expected, list)
+		}
+	}
+}
+
+func TestServiceDependencies(t *testing.T) {
+	annotations := map[string]map[string]string{
+		"dhcpcd": {targetsAnnotation: "network"},
+		"ntpd":   {targetsAnnotation: "network", dependsAnnotation: "network"},
+		"sshd":   {dependsAnnotation: "network, ntpd, unknown"},
+		"getty":  nil,
+	}
+	expected := map[string][]string{
+		"ntpd": {"dhcpcd"},
+		"sshd": {"dhcpcd", "ntpd"},
+	}
+	if deps := serviceDependencies(annotations); !reflect.DeepEqual(deps, expected) {
+		t.Errorf("Expected %v, got %v", expected, deps)
+	}
+}
+
+func TestStartOrder(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		services []string
+		deps     map[string][]string
+		expected []string
+	}{
+		{"name order", []string{"c", "b", "a"}, nil, []string{"a", "b", "c"}},
+		{"dependencies first", []string{"a", "b", "c"}, map[string][]string{"a": {"c"}, "c": {"b"}}, []string{"b", "c", "a"}},
+		{"cycle last", []string{"a", "b", "c", "d"}, map[string][]string{"a": {"b"}, "b": {"a"}, "d": {"c"}}, []string{"c", "d", "a", "b"}},
+		{"depends on a cycle", []string{"a", "b", "c"}, map[string][]string{"a": {"b"}, "b": {"a"}, "c": {"a"}}, []string{"a", "b", "c"}},
+		{"self cycle", []string{"a", "b"}, map[string][]string{"a": {"a"}}, []string{"b", "a"}},
+	} {
+		if order := startOrder(test.services, test.deps); !reflect.DeepEqual(order, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, order)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// healthAnnotation on a service's OCI spec sets how to check that it
+	// is healthy:
+	//
+	//	exec:<command>: run command in the container, healthy if it exits 0
+	//	tcp:<host:port>: healthy if a connection can be made
+	//	http://... or https://...: healthy if a GET returns 2xx or 3xx
+	//	file:<path>: healthy if path exists in the container
+	//
+	// with .interval, .timeout and .retries, the consecutive failures
+	// before the service is unhealthy, optionally set by annotations
+	// with those suffixes.
+	healthAnnotation         = "org.mobyproject.health"
+	healthIntervalAnnotation = healthAnnotation + ".interval"
+	healthTimeoutAnnotation  = healthAnnotation + ".timeout"
+	healthRetriesAnnotation  = healthAnnotation + ".retries"
+
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+	defaultHealthRetries  = 3
+
+	healthStarting  = "starting"
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+)
+
+// healthCheck is the parsed health check of a service.
+type healthCheck struct {
+	kind     string // "exec", "tcp", "http" or "file"
+	target   string
+	interval time.Duration
+	timeout  time.Duration
+	retries  int // consecutive failures before a service is unhealthy
+}
+
+// healthCheckFor returns the health check of a service, or nil if it has
+// none. Invalid health checks are reported and ignored.
+func healthCheckFor(service string, annotations map[string]string) *healthCheck {
+	h, err := parseHealthCheck(annotations)
+	if err != nil {
+		log.Printf("Ignoring health check of %s: %v", service, err)
+		return nil
+	}
+	return h
+}
+
+func parseHealthCheck(annotations map[string]string) (*healthCheck, error) {
+	check := annotations[healthAnnotation]
+	if check == "" {
+		return nil, nil
+	}
+	h := &healthCheck{
+		interval: defaultHealthInterval,
+		timeout:  defaultHealthTimeout,
+		retries:  defaultHealthRetries,
+	}
+	switch {
+	case strings.HasPrefix(check, "http://"), strings.HasPrefix(check, "https://"):
+		h.kind, h.target = "http", check
+	default:
+		bits := strings.SplitN(check, ":", 2)
+		if len(bits) != 2 || bits[1] == "" {
+			return nil, fmt.Errorf("invalid health check %q", check)
+		}
+		h.kind, h.target = bits[0], bits[1]
+		switch h.kind {
+		case "exec", "file":
+		case "tcp":
+			if _, _, err := net.SplitHostPort(h.target); err != nil {
+				return nil, fmt.Errorf("invalid health check %q: %v", check, err)
+			}
+		default:
+			return nil, fmt.Errorf("unknown kind of health check %q", check)
+		}
+	}
+	for _, d := range []struct {
+		annotation string
+		value      *time.Duration
+	}{
+		{healthIntervalAnnotation, &h.interval},
+		{healthTimeoutAnnotation, &h.timeout},
+	} {
+		if s := annotations[d.annotation]; s != "" {
+			v, err := time.ParseDuration(s)
+			if err != nil || v <= 0 {
+				return nil, fmt.Errorf("invalid %s %q", d.annotation, s)
+			}
+			*d.value = v
+		}
+	}
+	if s := annotations[healthRetriesAnnotation]; s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 1 {
+			return nil, fmt.Errorf("invalid %s %q", healthRetriesAnnotation, s)
+		}
+		h.retries = v
+	}
+	return h, nil
+}
+
+// run checks the health of a service once, returning nil if it is healthy.
+func (h *healthCheck) run(ctx context.Context, ctr containerd.Container, task containerd.Task) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	switch h.kind {
+	case "exec":
+		return execInTask(ctx, ctr, task, h.target)
+	case "tcp":
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", h.target)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "http":
+		req, err := http.NewRequest("GET", h.target, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("%s returned %s", h.target, resp.Status)
+		}
+		return nil
+	case "file":
+		// as seen from inside the container
+		_, err := os.Stat(filepath.Join(fmt.Sprintf("/proc/%d/root", task.Pid()), h.target))
+		return err
+	}
+	return fmt.Errorf("unknown kind of health check %q", h.kind)
+}
+
+// execInTask runs a shell command in a container, returning nil if it
+// exits with status 0 before ctx expires.
+func execInTask(ctx context.Context, ctr containerd.Container, task containerd.Task, command string) error {
+	spec, err := ctr.Spec(ctx)
+	if err != nil {
+		return err
+	}
+	pspec := *spec.Process
+	pspec.Args = []string{"/bin/sh", "-c", command}
+	pspec.Terminal = false
+	id := "exec-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	p, err := task.Exec(ctx, id, &pspec, cio.NullIO)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// ctx may have expired
+		ctx, cancel := context.WithTimeout(context.Background(), defaultHealthTimeout)
+		defer cancel()
+		p.Delete(ctx, containerd.WithProcessKill)
+	}()
+	statusC, err := p.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if err := p.Start(ctx); err != nil {
+		return err
+	}
+	select {
+	case status := <-statusC:
+		code, _, err := status.Result()
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("%q exited with status %d", command, code)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%q timed out", command)
+	}
+}
+
+// healthState is the health of a service.
+type healthState struct {
+	Status   string    `json:"status"`
+	Failures int       `json:"failures"`
+	Checked  time.Time `json:"checked,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// writeHealth records the health of a service for "service status".
+func writeHealth(service string, state *healthState) {
+	h := *state
+	updateState(service, func(s *monitorState) {
+		s.Health = &h
+	})
+}
+
+// watchHealth checks the health of a task until exited is closed. If the
+// service becomes unhealthy and restart is true, the task is killed so
+// that its restart policy restarts it.
+func watchHealth(ctx context.Context, ctr containerd.Container, task containerd.Task, h *healthCheck, restart bool, exited <-chan struct{}, logger Log) {
+	service := ctr.ID()
+	state := &healthState{Status: healthStarting}
+	writeHealth(service, state)
+	delay := time.Second
+	for {
+		select {
+		case <-exited:
+			return
+		case <-time.After(delay):
+		}
+		delay = h.interval
+		err := h.run(ctx, ctr, task)
+		state.Checked = time.Now().UTC()
+		if err == nil {
+			state.Status, state.Failures, state.Error = healthHealthy, 0, ""
+			writeHealth(service, state)
+			continue
+		}
+		state.Failures++
+		state.Error = err.Error()
+		if state.Failures < h.retries || state.Status == healthUnhealthy {
+			writeHealth(service, state)
+			continue
+		}
+		state.Status = healthUnhealthy
+		writeHealth(service, state)
+		recordEvent(logger, &lifecycleEvent{event: eventUnhealthy, service: service, pid: task.Pid(), exitCode: -1})
+		if restart {
+			log.Infof("Killing unhealthy service %q", service)
+			if err := task.Kill(ctx, syscall.SIGKILL); err != nil {
+				log.WithError(err).Errorf("killing %s", service)
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// captureLog returns what f logs.
+func captureLog(f func()) string {
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	defer log.SetOutput(os.Stderr)
+	f()
+	return b.String()
+}
+
+func TestParseHealthCheck(t *testing.T) {
+	defaults := func(kind, target string) *healthCheck {
+		return &healthCheck{kind: kind, target: target, interval: defaultHealthInterval, timeout: defaultHealthTimeout, retries: defaultHealthRetries}
+	}
+	for _, test := range []struct {
+		annotations map[string]string
+		expected    *healthCheck
+		valid       bool
+	}{
+		{nil, nil, true},
+		{map[string]string{healthIntervalAnnotation: "1s"}, nil, true},
+		{map[string]string{healthAnnotation: "exec:pgrep sshd"}, defaults("exec", "pgrep sshd"), true},
+		{map[string]string{healthAnnotation: "tcp:localhost:22"}, defaults("tcp", "localhost:22"), true},
+		{map[string]string{healthAnnotation: "http://localhost/health"}, defaults("http", "http://localhost/health"), true},
+		{map[string]string{healthAnnotation: "https://localhost:8443/"}, defaults("http", "https://localhost:8443/"), true},
+		{map[string]string{healthAnnotation: "file:/run/ready"}, defaults("file", "/run/ready"), true},
+		{map[string]string{
+			healthAnnotation:         "file:/run/ready",
+			healthIntervalAnnotation: "30s",
+			healthTimeoutAnnotation:  "500ms",
+			healthRetriesAnnotation:  "1",
+		}, &healthCheck{kind: "file", target: "/run/ready", interval: 30 * time.Second, timeout: 500 * time.Millisecond, retries: 1}, true},
+		{map[string]string{healthAnnotation: "exec:"}, nil, false},
+		{map[string]string{healthAnnotation: "pgrep sshd"}, nil, false},
+		{map[string]string{healthAnnotation: "udp:localhost:53"}, nil, false},
+		{map[string]string{healthAnnotation: "tcp:localhost"}, nil, false},
+		{map[string]string{healthAnnotation: "file:/run/ready", healthIntervalAnnotation: "often"}, nil, false},
+		{map[string]string{healthAnnotation: "file:/run/ready", healthIntervalAnnotation: "0s"}, nil, false},
+		{map[string]string{healthAnnotation: "file:/run/ready", healthTimeoutAnnotation: "-1s"}, nil, false},
+		{map[string]string{healthAnnotation: "file:/run/ready", healthRetriesAnnotation: "0"}, nil, false},
+		{map[string]string{healthAnnotation: "file:/run/ready", healthRetriesAnnotation: "three"}, nil, false},
+	} {
+		h, err := parseHealthCheck(test.annotations)
+		if (err == nil) != test.valid {
+			t.Errorf("%v: unexpected error %v", test.annotations, err)
+		}
+		if !reflect.DeepEqual(h, test.expected) {
+			t.Errorf("%v: expected %+v, got %+v", test.annotations, test.expected, h)
+		}
+	}
+}
+
+func TestHealthCheckFor(t *testing.T) {
+	for _, test := range []struct {
+		annotations map[string]string
+		check       bool
+		reported    bool
+	}{
+		{nil, false, false},
+		{map[string]string{healthAnnotation: "tcp:localhost:22"}, true, false},
+		// invalid values are reported and the check ignored
+		{map[string]string{healthAnnotation: "udp:localhost:53"}, false, true},
+		{map[string]string{healthAnnotation: "tcp:localhost:22", healthRetriesAnnotation: "0"}, false, true},
+	} {
+		var h *healthCheck
+		out := captureLog(func() {
+			h = healthCheckFor("sshd", test.annotations)
+		})
+		if (h != nil) != test.check {
+			t.Errorf("%v: expected check %t, got %+v", test.annotations, test.check, h)
+		}
+		if reported := strings.Contains(out, "Ignoring health check of sshd"); reported != test.reported {
+			t.Errorf("%v: expected reported %t, got %q", test.annotations, test.reported, out)
+		}
+	}
+}
+
+func TestHealthCheckRun(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		kind    string
+		target  string
+		healthy bool
+	}{
+		{"tcp", strings.TrimPrefix(server.URL, "http://"), true},
+		{"tcp", closed, false},
+		{"http", server.URL + "/health", true},
+		{"http", server.URL + "/missing", false},
+		{"http", "http://" + closed + "/health", false},
+		{"udp", "localhost:53", false},
+	} {
+		h := &healthCheck{kind: test.kind, target: test.target, timeout: time.Second}
+		err := h.run(context.Background(), nil, nil)
+		if (err == nil) != test.healthy {
+			t.Errorf("%s %s: expected healthy %t, got %v", test.kind, test.target, test.healthy, err)
+		}
+	}
+}
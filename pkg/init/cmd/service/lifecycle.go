@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	eventStarted   = "started"
+	eventExited    = "exited"
+	eventOOMKilled = "oom-killed"
+	eventStopped   = "stopped"
+	eventRestarted = "restarted"
+	eventUnhealthy = "unhealthy"
+	eventWatchdog  = "watchdog"
+	eventUpdated   = "updated"
+
+	monitorInterval = 5 * time.Second
+)
+
+// lifecycleEvent records a change in the state of a service. Events are
+// written to the service's own log so that its history can be followed
+// from the logs alone.
+type lifecycleEvent struct {
+	event    string
+	service  string
+	pid      uint32
+	exitCode int // -1 if not known
+	signal   syscall.Signal
+}
+
+// String formats the event as a single line of key=value pairs.
+func (e *lifecycleEvent) String() string {
+	fields := []string{
+		"lifecycle",
+		"event=" + e.event,
+		"service=" + e.service,
+		"time=" + time.Now().UTC().Format(time.RFC3339),
+	}
+	if e.pid != 0 {
+		fields = append(fields, fmt.Sprintf("pid=%d", e.pid))
+	}
+	if e.exitCode >= 0 {
+		fields = append(fields, fmt.Sprintf("exit_code=%d", e.exitCode))
+	}
+	if e.signal != 0 {
+		fields = append(fields, fmt.Sprintf("signal=%d", int(e.signal)), "signal_name="+strconv.Quote(e.signal.String()))
+	}
+	return strings.Join(fields, " ")
+}
+
+// exitEvent returns the event for a process which exited with the status
+// reported by containerd, where death by a signal is reported as 128+signal.
+func exitEvent(service string, pid, status uint32, oom bool) *lifecycleEvent {
+	e := &lifecycleEvent{event: eventExited, service: service, pid: pid, exitCode: int(status)}
+	if status > 128 && status < 128+64 {
+		e.signal = syscall.Signal(status - 128)
+	}
+	if oom {
+		e.event = eventOOMKilled
+	}
+	return e
+}
+
+// processExitEvent returns the event for a process which we waited for
+// directly.
+func processExitEvent(service string, pid int, state *os.ProcessState) *lifecycleEvent {
+	e := &lifecycleEvent{event: eventExited, service: service, pid: uint32(pid), exitCode: -1}
+	if state == nil {
+		return e
+	}
+	e.exitCode = state.ExitCode()
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		e.signal = ws.Signal()
+		e.exitCode = 128 + int(e.signal)
+	}
+	return e
+}
+
+// eventLogName returns the name of the log holding the lifecycle events of
+// a service. They are not written to its stderr log, as with the file
+// driver containerd writes that from its own offset without O_APPEND, and
+// would overwrite them.
+func eventLogName(service string) string {
+	return service + ".events"
+}
+
+// recordEvent writes a lifecycle event to the service's event log.
+func recordEvent(logger Log, e *lifecycleEvent) {
+	w, err := logger.Open(eventLogName(e.service))
+	if err != nil {
+		log.Printf("Failed to record %s event for %s: %v", e.event, e.service, err)
+		return
+	}
+	defer w.Close()
+	if _, err := fmt.Fprintln(w, e.String()); err != nil {
+		log.Printf("Failed to record %s event for %s: %v", e.event, e.service, err)
+	}
+}
+
+// oomKilled returns true if the memory cgroup at cgroupsPath has recorded
+// an OOM kill.
+func oomKilled(cgroupsPath string) bool {
+	if cgroupsPath == "" {
+		return false
+	}
+	for _, path := range []string{
+		filepath.Join("/sys/fs/cgroup/memory", cgroupsPath, "memory.oom_control"), // cgroup v1
+		filepath.Join("/sys/fs/cgroup", cgroupsPath, "memory.events"),             // cgroup v2
+	} {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[0] == "oom_kill" && fields[1] != "0" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// specCgroupsPath returns the cgroups path from the OCI spec in a bundle,
+// or "" if it is not set.
+func specCgroupsPath(bundle string) string {
+	b, err := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return ""
+	}
+	var spec specs.Spec
+	if err := json.Unmarshal(b, &spec); err != nil || spec.Linux == nil {
+		return ""
+	}
+	return spec.Linux.CgroupsPath
+}
+
+// startMonitor starts "service monitor" in the background, and waits for
+// it to be ready to copy the output of services.
+func startMonitor(namespace, sock, path string) {
+	_ = os.Remove(relaySocket)
+	cmd := exec.Command(installPath, "-containerd-namespace", namespace, "monitor", "-sock", sock, "-path", path)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		log.WithError(err).Error("starting service monitor")
+		return
+	}
+	_ = cmd.Process.Release()
+	for deadline := time.Now().Add(relaySocketTimeout); time.Now().Before(deadline); time.Sleep(readyInterval) {
+		if _, err := os.Stat(relaySocket); err == nil {
+			return
+		}
+	}
+	log.Error("service monitor did not create its relay socket")
+}
+
+func monitorCmd(ctx context.Context, args []string) {
+	invoked := filepath.Base(os.Args[0])
+	flags := flag.NewFlagSet("monitor", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s monitor\n\n", invoked)
+		fmt.Printf("Record exits of services in their logs, restart them according\n")
+		fmt.Printf("to their restart policies, serve their metrics and keep the\n")
+		fmt.Printf("hardware watchdog from rebooting while critical services are healthy.\n\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	sock := flags.String("sock", defaultSocket, "Path to containerd socket")
+	path := flags.String("path", defaultPath, "Path to service configs")
+	metricsAddr := flags.String("metrics", defaultMetricsAddress, "Serve Prometheus metrics of the services over HTTP on this unix domain socket path or TCP host:port, or \"\" for none")
+	watchdog := flags.String("watchdog", defaultWatchdogDevice, "Hardware watchdog to keep petting while the critical services are healthy")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	client, err := containerd.New(*sock)
+	if err != nil {
+		log.WithError(err).Fatal("creating containerd client")
+	}
+	inMonitor = true
+	listenRelay()
+	listenNotify(*path)
+	if *metricsAddr != "" {
+		if err := serveMetrics(ctx, client, *path, *metricsAddr); err != nil {
+			log.WithError(err).Error("serving metrics")
+		}
+	}
+	if *watchdog != "" {
+		go petWatchdog(ctx, client, *path, *watchdog)
+	}
+	// tasks we have waited for, and the restarts of services, by
+	// namespace/id. Only the services with bundles in path are monitored,
+	// not other containers such as those of a container engine run as a
+	// service.
+	var (
+		mu       sync.Mutex
+		tasks    = newTaskSet()
+		restarts = map[string]*restartState{}
+	)
+	for {
+		services, err := serviceNames(*path)
+		if err != nil {
+			log.WithError(err).Errorf("listing services in %s", *path)
+		}
+		tasks.begin()
+		for _, service := range services {
+			ctx := ctx
+			if ns := getRuntimeConfig(filepath.Join(*path, service)).Namespace; ns != "" {
+				ctx = namespaces.WithNamespace(ctx, ns)
+			}
+			ns, _ := namespaces.Namespace(ctx)
+			ctr, err := client.LoadContainer(ctx, service)
+			if err != nil {
+				continue
+			}
+			task, err := ctr.Task(ctx, nil)
+			if err != nil {
+				continue
+			}
+			name := ns + "/" + ctr.ID()
+			key := fmt.Sprintf("%s/%d", name, task.Pid())
+			if !tasks.add(key) {
+				continue
+			}
+			statusC, err := task.Wait(ctx)
+			if err != nil {
+				log.WithError(err).Errorf("waiting for %s", ctr.ID())
+				tasks.remove(key)
+				continue
+			}
+			mu.Lock()
+			if restarts[name] == nil {
+				restarts[name] = &restartState{}
+			}
+			restarts[name].started = time.Now()
+			mu.Unlock()
+			exited := make(chan struct{})
+			if spec, err := ctr.Spec(ctx); err == nil {
+				logger := GetServiceLog(varLogDir, ctr.ID(), spec.Annotations)
+				if h := healthCheckFor(ctr.ID(), spec.Annotations); h != nil {
+					restart := restartPolicyFor(ctr.ID(), spec.Annotations).mode != "no"
+					go watchHealth(ctx, ctr, task, h, restart, exited, logger)
+				}
+				if d := watchdogFor(ctr.ID(), spec.Annotations); d != 0 {
+					go watchWatchdog(ctx, ctr, task, d, exited, logger)
+				}
+			}
+			go func(ctr containerd.Container, pid uint32, started time.Time) {
+				status := <-statusC
+				close(exited)
+				code, exitTime, err := status.Result()
+				if err != nil {
+					log.WithError(err).Errorf("waiting for %s", ctr.ID())
+					return
+				}
+				oom := false
+				var annotations map[string]string
+				if spec, err := ctr.Spec(ctx); err == nil {
+					annotations = spec.Annotations
+					if spec.Linux != nil {
+						oom = oomKilled(spec.Linux.CgroupsPath)
+					}
+				}
+				logger := GetServiceLog(varLogDir, ctr.ID(), annotations)
+				recordEvent(logger, exitEvent(ctr.ID(), pid, code, oom))
+				if oneshotEnabled(annotations) {
+					updateState(ctr.ID(), func(s *monitorState) {
+						s.Completion = &completionState{Started: started, Finished: exitTime.UTC(), ExitCode: code}
+					})
+				}
+
+				policy := restartPolicyFor(ctr.ID(), annotations)
+				mu.Lock()
+				state := restarts[name]
+				if time.Since(state.started) >= restartResetTime {
+					state.restarts = 0
+				}
+				restart := policy.shouldRestart(code, state.restarts) && !stopping(ctx, ctr)
+				delay := restartDelay(state.restarts)
+				if restart {
+					state.restarts++
+				}
+				mu.Unlock()
+				if !restart {
+					return
+				}
+				log.Infof("Restarting service %q in %s", ctr.ID(), delay)
+				time.Sleep(delay)
+				if err := restartService(ctx, client, ctr.ID(), *sock, *path); err != nil {
+					log.WithError(err).Errorf("restarting %s", ctr.ID())
+					return
+				}
+				updateState(ctr.ID(), func(s *monitorState) {
+					s.Restarts++
+				})
+			}(ctr, task.Pid(), processStartTime(task.Pid()))
+		}
+		// if the services could not be listed, we do not know which
+		// tasks are gone
+		if err == nil {
+			tasks.end()
+		}
+		time.Sleep(monitorInterval)
+	}
+}
+
+// taskSet is the set of tasks, by namespace/id/pid, which "service
+// monitor" has waited for. A task which has exited is kept in the set
+// until it is gone from containerd, as a service which is not restarted
+// stays there stopped, and its exit must only be recorded once.
+type taskSet struct {
+	tasks   map[string]bool
+	present map[string]bool // the tasks seen in the current pass
+}
+
+func newTaskSet() *taskSet {
+	return &taskSet{tasks: map[string]bool{}}
+}
+
+// begin starts a pass over the tasks in containerd.
+func (s *taskSet) begin() {
+	s.present = map[string]bool{}
+}
+
+// add records that a task is present in this pass, and returns true if it
+// has not been waited for before.
+func (s *taskSet) add(key string) bool {
+	s.present[key] = true
+	if s.tasks[key] {
+		return false
+	}
+	s.tasks[key] = true
+	return true
+}
+
+// remove forgets a task, so that it is waited for again in the next pass.
+func (s *taskSet) remove(key string) {
+	delete(s.tasks, key)
+}
+
+// end finishes a pass, forgetting the tasks which were deleted or
+// replaced by a task with a new pid.
+func (s *taskSet) end() {
+	for key := range s.tasks {
+		if !s.present[key] {
+			delete(s.tasks, key)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// withoutTime returns the fields of a formatted event, checking and
+// removing the time as it changes from run to run.
+func withoutTime(t *testing.T, s string) string {
+	var fields []string
+	for _, field := range strings.Fields(s) {
+		if strings.HasPrefix(field, "time=") {
+			if _, err := time.Parse(time.RFC3339, strings.TrimPrefix(field, "time=")); err != nil {
+				t.Errorf("%q: invalid time: %v", s, err)
+			}
+			continue
+		}
+		fields = append(fields, field)
+	}
+	return strings.Join(fields, " ")
+}
+
+func TestLifecycleEventString(t *testing.T) {
+	for _, test := range []struct {
+		event    *lifecycleEvent
+		expected string
+	}{
+		{&lifecycleEvent{event: eventStarted, service: "sshd", pid: 42, exitCode: -1}, "lifecycle event=started service=sshd pid=42"},
+		{&lifecycleEvent{event: eventExited, service: "sshd", pid: 42, exitCode: 0}, "lifecycle event=exited service=sshd pid=42 exit_code=0"},
+		{&lifecycleEvent{event: eventExited, service: "sshd", pid: 42, exitCode: 137, signal: syscall.SIGKILL}, `lifecycle event=exited service=sshd pid=42 exit_code=137 signal=9 signal_name="killed"`},
+		{&lifecycleEvent{event: eventUnhealthy, service: "sshd", exitCode: -1}, "lifecycle event=unhealthy service=sshd"},
+	} {
+		if got := withoutTime(t, test.event.String()); got != test.expected {
+			t.Errorf("%+v: expected %q, got %q", *test.event, test.expected, got)
+		}
+	}
+}
+
+func TestExitEvent(t *testing.T) {
+	for _, test := range []struct {
+		status   uint32
+		oom      bool
+		expected lifecycleEvent
+	}{
+		{0, false, lifecycleEvent{event: eventExited, service: "sshd", pid: 42, exitCode: 0}},
+		{1, false, lifecycleEvent{event: eventExited, service: "sshd", pid: 42, exitCode: 1}},
+		// exactly 128 is an exit status, not a signal
+		{128, false, lifecycleEvent{event: eventExited, service: "sshd", pid: 42, exitCode: 128}},
+		{137, false, lifecycleEvent{event: eventExited, service: "sshd", pid: 42, exitCode: 137, signal: syscall.SIGKILL}},
+		{137, true, lifecycleEvent{event: eventOOMKilled, service: "sshd", pid: 42, exitCode: 137, signal: syscall.SIGKILL}},
+		{255, false, lifecycleEvent{event: eventExited, service: "sshd", pid: 42, exitCode: 255}},
+	} {
+		if got := exitEvent("sshd", 42, test.status, test.oom); !reflect.DeepEqual(*got, test.expected) {
+			t.Errorf("%d %t: expected %+v, got %+v", test.status, test.oom, test.expected, *got)
+		}
+	}
+}
+
+func TestProcessExitEvent(t *testing.T) {
+	for _, test := range []struct {
+		script   string
+		exitCode int
+		signal   syscall.Signal
+	}{
+		{"exit 0", 0, 0},
+		{"exit 3", 3, 0},
+		{"kill -TERM $$", 128 + int(syscall.SIGTERM), syscall.SIGTERM},
+	} {
+		cmd := exec.Command("/bin/sh", "-c", test.script)
+		_ = cmd.Run()
+		e := processExitEvent("sshd", cmd.Process.Pid, cmd.ProcessState)
+		if e.event != eventExited || e.exitCode != test.exitCode || e.signal != test.signal {
+			t.Errorf("%q: expected exit code %d and signal %d, got %+v", test.script, test.exitCode, test.signal, *e)
+		}
+	}
+	// the status of a process we failed to wait for is unknown
+	e := processExitEvent("sshd", 42, nil)
+	if got := withoutTime(t, e.String()); got != "lifecycle event=exited service=sshd pid=42" {
+		t.Errorf("expected an unknown exit code, got %q", got)
+	}
+}
+
+func TestRecordEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logger, err := newFileLog(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordEvent(logger, &lifecycleEvent{event: eventStarted, service: "sshd", pid: 42, exitCode: -1})
+	recordEvent(logger, exitEvent("sshd", 42, 1, false))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "sshd.events.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	expected := []string{
+		"lifecycle event=started service=sshd pid=42",
+		"lifecycle event=exited service=sshd pid=42 exit_code=1",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d events, got %q", len(expected), b)
+	}
+	for i, line := range lines {
+		if got := withoutTime(t, line); got != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], got)
+		}
+	}
+}
+
+func TestRecordEventFileLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logger, err := newFileLog(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// containerd writes stderr from its own offset, from the start of
+	// the file and without O_APPEND
+	stderr, err := os.OpenFile(logger.Path("sshd"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	recordEvent(logger, &lifecycleEvent{event: eventStarted, service: "sshd", pid: 42, exitCode: -1})
+	if _, err := stderr.WriteString("Server listening on :: port 22.\n"); err != nil {
+		t.Fatal(err)
+	}
+	recordEvent(logger, exitEvent("sshd", 42, 1, false))
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "sshd.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "Server listening on :: port 22.\n" {
+		t.Errorf("expected only the output of the service in its log, got %q", b)
+	}
+	b, err = ioutil.ReadFile(filepath.Join(dir, "sshd.events.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	expected := []string{
+		"lifecycle event=started service=sshd pid=42",
+		"lifecycle event=exited service=sshd pid=42 exit_code=1",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d events, got %q", len(expected), b)
+	}
+	for i, line := range lines {
+		if got := withoutTime(t, line); got != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], got)
+		}
+	}
+}
+
+func TestSpecCgroupsPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, test := range []struct {
+		config   string // empty for no config.json
+		expected string
+	}{
+		{`{"linux":{"cgroupsPath":"/services/sshd"}}`, "/services/sshd"},
+		{`{"linux":{}}`, ""},
+		{`{}`, ""},
+		{`not json`, ""},
+		{"", ""},
+	} {
+		path := filepath.Join(dir, "config.json")
+		os.Remove(path)
+		if test.config != "" {
+			if err := ioutil.WriteFile(path, []byte(test.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := specCgroupsPath(dir); got != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.config, test.expected, got)
+		}
+	}
+}
+
+func TestTaskSetStoppedTask(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logger, err := newFileLog(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a stopped task which is not deleted is found in every pass, and
+	// waiting for it returns at once, but its exit is recorded only once
+	tasks := newTaskSet()
+	for pass := 0; pass < 3; pass++ {
+		tasks.begin()
+		if tasks.add("services/sshd/42") {
+			recordEvent(logger, exitEvent("sshd", 42, 1, false))
+		}
+		tasks.end()
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "sshd.events.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"); len(lines) != 1 {
+		t.Errorf("expected one exit event, got %q", b)
+	}
+
+	// once the task is deleted it is forgotten, so a new task with the
+	// same pid is waited for
+	tasks.begin()
+	tasks.end()
+	tasks.begin()
+	if !tasks.add("services/sshd/42") {
+		t.Error("expected a new task to be waited for after the old one was deleted")
+	}
+	// a task we failed to wait for is waited for again in the next pass
+	tasks.remove("services/sshd/42")
+	tasks.end()
+	tasks.begin()
+	if !tasks.add("services/sshd/42") {
+		t.Error("expected a removed task to be waited for again")
+	}
+}
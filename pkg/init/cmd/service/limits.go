@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// cpuPeriod is the CFS period used to apply -cpus, as docker does.
+const cpuPeriod = 100000
+
+// cgroupRoot is where the cgroup filesystems are mounted.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupLimit is a limit as shown by "service limits", read from the
+// cgroup v1 controller file or the cgroup v2 file.
+type cgroupLimit struct {
+	name       string
+	controller string // cgroup v1
+	v1         string
+	v2         string
+}
+
+var cgroupLimits = []cgroupLimit{
+	{"memory", "memory", "memory.limit_in_bytes", "memory.max"},
+	{"cpu-quota", "cpu", "cpu.cfs_quota_us", "cpu.max"},
+	{"cpu-period", "cpu", "cpu.cfs_period_us", ""},
+	{"cpu-shares", "cpu", "cpu.shares", "cpu.weight"},
+	{"pids", "pids", "pids.max", "pids.max"},
+	{"io-weight", "blkio", "blkio.weight", "io.weight"},
+}
+
+// readLimit returns the value of a limit of the cgroup at cgroupsPath, or
+// "-" if it can't be read.
+func readLimit(cgroupsPath string, l cgroupLimit) string {
+	paths := []string{filepath.Join(cgroupRoot, l.controller, cgroupsPath, l.v1)}
+	if l.v2 != "" {
+		paths = append(paths, filepath.Join(cgroupRoot, cgroupsPath, l.v2))
+	}
+	for _, path := range paths {
+		if b, err := ioutil.ReadFile(path); err == nil {
+			return strings.TrimSpace(string(b))
+		}
+	}
+	return "-"
+}
+
+// parseSize parses a number of bytes with an optional K, M, G or T suffix.
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	if i := strings.IndexAny(strings.ToUpper(s), "KMGT"); i != -1 && i == len(s)-1 {
+		multiplier = map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}[strings.ToUpper(s)[i]]
+		s = s[:i]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// limitFlags are the limits which "service limits" can change.
+type limitFlags struct {
+	memory    *string
+	cpus      *float64
+	cpuShares *uint64
+	pids      *int64
+	ioWeight  *uint
+}
+
+func addLimitFlags(flags *flag.FlagSet) *limitFlags {
+	return &limitFlags{
+		memory:    flags.String("memory", "", "Memory limit in bytes, with an optional K, M, G or T suffix"),
+		cpus:      flags.Float64("cpus", 0, "Number of CPUs the service may use"),
+		cpuShares: flags.Uint64("cpu-shares", 0, "Relative CPU weight"),
+		pids:      flags.Int64("pids", 0, "Maximum number of processes, -1 for no limit"),
+		ioWeight:  flags.Uint("io-weight", 0, "Relative block IO weight, 10 to 1000"),
+	}
+}
+
+// resources returns the limits given on the command line, and whether any
+// were given.
+func (l *limitFlags) resources(flags *flag.FlagSet) (*specs.LinuxResources, bool, error) {
+	resources := &specs.LinuxResources{}
+	update := false
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		if err != nil {
+			// a later limit must not hide an invalid one
+			return
+		}
+		switch f.Name {
+		case "memory":
+			var limit int64
+			if limit, err = parseSize(*l.memory); err != nil {
+				return
+			}
+			resources.Memory = &specs.LinuxMemory{Limit: &limit}
+		case "cpus":
+			if *l.cpus <= 0 {
+				err = fmt.Errorf("invalid number of CPUs %v", *l.cpus)
+				return
+			}
+			if resources.CPU == nil {
+				resources.CPU = &specs.LinuxCPU{}
+			}
+			period, quota := uint64(cpuPeriod), int64(*l.cpus*cpuPeriod)
+			resources.CPU.Period, resources.CPU.Quota = &period, &quota
+		case "cpu-shares":
+			if resources.CPU == nil {
+				resources.CPU = &specs.LinuxCPU{}
+			}
+			resources.CPU.Shares = l.cpuShares
+		case "pids":
+			resources.Pids = &specs.LinuxPids{Limit: *l.pids}
+		case "io-weight":
+			if *l.ioWeight < 10 || *l.ioWeight > 1000 {
+				err = fmt.Errorf("invalid IO weight %d", *l.ioWeight)
+				return
+			}
+			weight := uint16(*l.ioWeight)
+			resources.BlockIO = &specs.LinuxBlockIO{Weight: &weight}
+		default:
+			return
+		}
+		update = true
+	})
+	return resources, update, err
+}
+
+func limitsCmd(ctx context.Context, args []string) {
+	invoked := filepath.Base(os.Args[0])
+	flags := flag.NewFlagSet("limits", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s limits [options] [service]\n\n", invoked)
+		fmt.Printf("Print the resource limits of a running service, or change them\n")
+		fmt.Printf("if any limits are given. Changes last until the service restarts.\n\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	sock := flags.String("sock", defaultSocket, "Path to containerd socket")
+	path := flags.String("path", defaultPath, "Path to service configs")
+	limits := addLimitFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() != 1 {
+		fmt.Println("Please specify the service")
+		flags.Usage()
+		os.Exit(1)
+	}
+	service := flags.Arg(0)
+	log := log.WithFields(log.Fields{
+		"service": service,
+	})
+
+	resources, update, err := limits.resources(flags)
+	if err != nil {
+		log.WithError(err).Fatal("invalid limit")
+	}
+
+	client, err := containerd.New(*sock)
+	if err != nil {
+		log.WithError(err).Fatal("creating containerd client")
+	}
+	if ns := getRuntimeConfig(filepath.Join(*path, service)).Namespace; ns != "" {
+		ctx = namespaces.WithNamespace(ctx, ns)
+	}
+	ctr, err := client.LoadContainer(ctx, service)
+	if err != nil {
+		log.WithError(err).Fatal("loading container")
+	}
+	task, err := ctr.Task(ctx, nil)
+	if err != nil {
+		log.WithError(err).Fatal("fetching task")
+	}
+
+	if update {
+		if err := task.Update(ctx, containerd.WithResources(resources)); err != nil {
+			log.WithError(err).Fatal("updating limits")
+		}
+		log.Infof("Updated limits of service: %q", service)
+		return
+	}
+
+	spec, err := ctr.Spec(ctx)
+	if err != nil {
+		log.WithError(err).Fatal("reading spec")
+	}
+	if spec.Linux == nil || spec.Linux.CgroupsPath == "" {
+		log.Fatal("service has no cgroup")
+	}
+	for _, l := range cgroupLimits {
+		fmt.Printf("%s: %s\n", l.name, readLimit(spec.Linux.CgroupsPath, l))
+	}
+}
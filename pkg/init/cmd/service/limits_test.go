@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, test := range []struct {
+		s        string
+		expected int64
+		valid    bool
+	}{
+		{"0", 0, true},
+		{"1024", 1024, true},
+		{"64k", 64 << 10, true},
+		{"64K", 64 << 10, true},
+		{"512M", 512 << 20, true},
+		{"2G", 2 << 30, true},
+		{"1t", 1 << 40, true},
+		{"", 0, false},
+		{"M", 0, false},
+		{"-1", 0, false},
+		{"1.5G", 0, false},
+		{"1GB", 0, false},
+		{"1K2", 0, false},
+	} {
+		n, err := parseSize(test.s)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: unexpected error %v", test.s, err)
+		}
+		if n != test.expected {
+			t.Errorf("%q: expected %d, got %d", test.s, test.expected, n)
+		}
+	}
+}
+
+func TestLimitResources(t *testing.T) {
+	limit := int64(512 << 20)
+	period, quota := uint64(cpuPeriod), int64(150000)
+	shares := uint64(512)
+	weight := uint16(100)
+	for _, test := range []struct {
+		args     string
+		expected *specs.LinuxResources
+		update   bool
+		valid    bool
+	}{
+		{"", &specs.LinuxResources{}, false, true},
+		{"-memory 512M", &specs.LinuxResources{Memory: &specs.LinuxMemory{Limit: &limit}}, true, true},
+		{"-cpus 1.5 -cpu-shares 512", &specs.LinuxResources{CPU: &specs.LinuxCPU{Period: &period, Quota: &quota, Shares: &shares}}, true, true},
+		{"-pids -1", &specs.LinuxResources{Pids: &specs.LinuxPids{Limit: -1}}, true, true},
+		{"-io-weight 100", &specs.LinuxResources{BlockIO: &specs.LinuxBlockIO{Weight: &weight}}, true, true},
+		{"-memory lots", nil, false, false},
+		{"-cpus 0", nil, false, false},
+		{"-io-weight 5", nil, false, false},
+		{"-io-weight 1001", nil, false, false},
+		// an invalid limit is not hidden by a valid one
+		{"-cpus 0 -memory 512M", nil, false, false},
+	} {
+		flags := flag.NewFlagSet("limits", flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		limits := addLimitFlags(flags)
+		if err := flags.Parse(strings.Fields(test.args)); err != nil {
+			t.Fatalf("%q: %v", test.args, err)
+		}
+		resources, update, err := limits.resources(flags)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: unexpected error %v", test.args, err)
+		}
+		if !test.valid {
+			continue
+		}
+		if update != test.update || !reflect.DeepEqual(resources, test.expected) {
+			t.Errorf("%q: expected %+v %t, got %+v %t", test.args, test.expected, test.update, resources, update)
+		}
+	}
+}
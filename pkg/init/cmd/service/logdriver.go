@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pelletier/go-toml"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	loggingConfigFile = "/etc/linuxkit/logging.toml"
+
+	// Annotations on a service's OCI spec which override the logging
+	// configuration for that service.
+	loggingAnnotationPrefix = "org.mobyproject.logging."
+	loggingDriverAnnotation = loggingAnnotationPrefix + "driver"
+	loggingLevelAnnotation  = loggingAnnotationPrefix + "level"
+	loggingOptionAnnotation = loggingAnnotationPrefix + "option."
+)
+
+// logConfig selects the log driver and its options, for example:
+//
+//	driver = "syslog"
+//	[options]
+//	address = "10.0.0.1:514"
+//	network = "udp"
+type logConfig struct {
+	Driver  string            `toml:"driver"`
+	Options map[string]string `toml:"options"`
+}
+
+// LogDriver creates a Log. logDir is the default directory for drivers
+// which write to local files.
+type LogDriver func(logDir string, options map[string]string) (Log, error)
+
+var logDrivers = map[string]LogDriver{}
+
+// RegisterLogDriver makes a log driver available by name.
+func RegisterLogDriver(name string, driver LogDriver) {
+	if _, ok := logDrivers[name]; ok {
+		log.Fatalf("Log driver %s registered twice", name)
+	}
+	logDrivers[name] = driver
+}
+
+func init() {
+	RegisterLogDriver("file", newFileLog)
+	RegisterLogDriver("memlogd", newRemoteLog)
+	RegisterLogDriver("null", newNullLog)
+	RegisterLogDriver("syslog", newSyslogLog)
+	RegisterLogDriver("containerd", newContainerdLog)
+}
+
+// logDriverNames returns the registered driver names, sorted.
+func logDriverNames() []string {
+	var names []string
+	for name := range logDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newLog creates a Log using the named driver.
+func newLog(name, logDir string, options map[string]string) (Log, error) {
+	driver, ok := logDrivers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown log driver %q, expected one of %s", name, strings.Join(logDriverNames(), ", "))
+	}
+	if options == nil {
+		options = map[string]string{}
+	}
+	return driver(logDir, options)
+}
+
+// readLogConfig reads the logging configuration file, if there is one.
+func readLogConfig(path string) (*logConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var config logConfig
+	if err := toml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("error reading toml file %s: %v", path, err)
+	}
+	return &config, nil
+}
+
+// defaultLogDriver is used when no driver is configured: memlogd if it is
+// running, otherwise files.
+func defaultLogDriver() string {
+	if _, err := os.Stat(logWriteSocket); !os.IsNotExist(err) {
+		return "memlogd"
+	}
+	return "file"
+}
+
+// GetServiceLog returns the log destination for a service, which may be
+// overridden by the annotations on its spec:
+//
+//	org.mobyproject.logging.driver: the log driver
+//	org.mobyproject.logging.option.<name>: options for the driver
+//	org.mobyproject.logging.level: "all" (the default), "stderr" to discard
+//	  stdout, or "none" to discard all output
+//	org.mobyproject.logging.persist: a directory on disk to also append
+//	  the output to
+//
+// Invalid annotations are reported and ignored.
+func GetServiceLog(logDir, service string, annotations map[string]string) Log {
+	var l Log
+	if driver := annotations[loggingDriverAnnotation]; driver != "" {
+		options := map[string]string{}
+		for k, v := range annotations {
+			if strings.HasPrefix(k, loggingOptionAnnotation) {
+				options[strings.TrimPrefix(k, loggingOptionAnnotation)] = v
+			}
+		}
+		var err error
+		if l, err = newLog(driver, logDir, options); err != nil {
+			log.Printf("Ignoring log driver for %s: %v", service, err)
+			l = nil
+		}
+	}
+	if l == nil {
+		l = GetLog(logDir)
+	}
+	if dir := annotations[loggingPersistAnnotation]; dir != "" {
+		l = newTeeLog(l, service, dir)
+	}
+	switch c := l.(type) {
+	case *syslogLog:
+		c.relay = logRelay{service: service, annotations: annotations}
+	case *teeLog:
+		c.relay = logRelay{service: service, annotations: annotations}
+	}
+	switch level := annotations[loggingLevelAnnotation]; level {
+	case "", "all":
+		return l
+	case "stderr":
+		return &discardLog{Log: l, discard: map[string]bool{service + ".out": true}}
+	case "none":
+		return &discardLog{Log: l, discard: map[string]bool{service + ".out": true, service: true}}
+	default:
+		log.Printf("Ignoring unknown log level %q for %s", level, service)
+		return l
+	}
+}
+
+// logDestination describes where GetServiceLog sends the output of a
+// service, for "service status".
+func logDestination(annotations map[string]string) string {
+	driver := annotations[loggingDriverAnnotation]
+	if driver == "" {
+		if config, err := readLogConfig(loggingConfigFile); err == nil && config != nil {
+			driver = config.Driver
+		}
+	}
+	if driver == "" {
+		driver = defaultLogDriver()
+	}
+	if level := annotations[loggingLevelAnnotation]; level != "" && level != "all" {
+		driver += " level=" + level
+	}
+	if dir := annotations[loggingPersistAnnotation]; dir != "" {
+		driver += " persist=" + dir
+	}
+	return driver
+}
+
+// bundleAnnotations returns the annotations from the OCI spec in a bundle,
+// or nil if it cannot be read.
+func bundleAnnotations(bundle string) map[string]string {
+	b, err := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return nil
+	}
+	var spec specs.Spec
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return nil
+	}
+	return spec.Annotations
+}
+
+// discardLog discards the output of some logs and passes the rest on.
+type discardLog struct {
+	Log
+	discard map[string]bool
+}
+
+// Path returns /dev/null for discarded logs.
+func (d *discardLog) Path(n string) string {
+	if d.discard[n] {
+		return "/dev/null"
+	}
+	return d.Log.Path(n)
+}
+
+// Open returns a stream which discards everything for discarded logs.
+func (d *discardLog) Open(n string) (io.WriteCloser, error) {
+	if d.discard[n] {
+		return (&nullLog{}).Open(n)
+	}
+	return d.Log.Open(n)
+}
+
+// Close does nothing for discarded logs, as no resources were created.
+func (d *discardLog) Close(n string) error {
+	if d.discard[n] {
+		return nil
+	}
+	return d.Log.Close(n)
+}
+
+// nullLog discards all output.
+type nullLog struct{}
+
+func newNullLog(logDir string, options map[string]string) (Log, error) {
+	return &nullLog{}, nil
+}
+
+// Path returns /dev/null.
+func (n *nullLog) Path(string) string {
+	return "/dev/null"
+}
+
+// Open returns a stream which discards everything written to it.
+func (n *nullLog) Open(string) (io.WriteCloser, error) {
+	return os.OpenFile("/dev/null", os.O_WRONLY, 0)
+}
+
+// Dump does nothing as nothing is stored.
+func (n *nullLog) Dump(string) {}
+
+// DumpAll does nothing as nothing is stored.
+func (n *nullLog) DumpAll(io.Writer, logsOptions) error {
+	return nil
+}
+
+// Flush does nothing as nothing is stored.
+func (n *nullLog) Flush() error {
+	return nil
+}
+
+// Close does nothing as no resources are held.
+func (n *nullLog) Close(string) error {
+	return nil
+}
+
+// Symlink does nothing as there is no log directory.
+func (n *nullLog) Symlink(string) {}
+
+// syslogLog sends each line of output to a syslog daemon, using the log
+// name as the tag.
+type syslogLog struct {
+	network  string
+	address  string
+	priority syslog.Priority
+	fifoDir  string
+	relay    logRelay
+}
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":   syslog.LOG_KERN,
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// newSyslogLog accepts the options "network" and "address" (defaulting to
+// the local syslog socket), "facility" (default "daemon") and "fifo-dir".
+func newSyslogLog(logDir string, options map[string]string) (Log, error) {
+	facility := options["facility"]
+	if facility == "" {
+		facility = "daemon"
+	}
+	priority, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	fifoDir := options["fifo-dir"]
+	if fifoDir == "" {
+		fifoDir = "/var/run"
+	}
+	return &syslogLog{
+		network:  options["network"],
+		address:  options["address"],
+		priority: priority | syslog.LOG_INFO,
+		fifoDir:  fifoDir,
+	}, nil
+}
+
+func (s *syslogLog) copy(n string, r io.ReadCloser) {
+	defer r.Close()
+	w, err := syslog.Dial(s.network, s.address, s.priority, n)
+	if err != nil {
+		log.Printf("failed to connect to syslog for %s: %v", n, err)
+		_, _ = io.Copy(ioutil.Discard, r)
+		return
+	}
+	defer w.Close()
+	if err := copyLines(w, r); err != nil {
+		log.Printf("failed to copy %s to syslog: %v", n, err)
+	}
+}
+
+// Path returns the name of a FIFO which is copied to syslog.
+func (s *syslogLog) Path(n string) string {
+	path := filepath.Join(s.fifoDir, n+".log")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		log.Printf("Discarding log %s: %v", n, err)
+		return "/dev/null"
+	}
+	relayFIFO(s, s.relay, n, path)
+	return path
+}
+
+// Open returns a stream which is copied to syslog.
+func (s *syslogLog) Open(n string) (io.WriteCloser, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go s.copy(n, r)
+	return w, nil
+}
+
+// Dump does nothing: the logs are stored by the syslog daemon.
+func (s *syslogLog) Dump(string) {}
+
+// DumpAll does nothing: the logs are stored by the syslog daemon.
+func (s *syslogLog) DumpAll(io.Writer, logsOptions) error {
+	return nil
+}
+
+// Flush does nothing as lines are sent to syslog as they are read.
+func (s *syslogLog) Flush() error {
+	return nil
+}
+
+// Close removes the FIFO created by Path.
+func (s *syslogLog) Close(n string) error {
+	return removeFifo(filepath.Join(s.fifoDir, n+".log"))
+}
+
+// Symlink does nothing as there is no log directory.
+func (s *syslogLog) Symlink(string) {}
+
+// copyLines writes each line read from r with a separate Write.
+func copyLines(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			if _, werr := io.WriteString(w, strings.TrimSuffix(line, "\n")); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// containerdLog lets containerd handle the output of services itself, by
+// passing it a log URI such as "binary:///usr/bin/shipper?name={name}" or
+// "file:///var/log/{name}.log" where {name} is replaced by the log name.
+// The shims accept such a URI wherever they accept the path of a FIFO in a
+// cio.Config, as cio.LogURI relies on. containerd only handles services, so
+// onboot and shutdown containers use the fallback driver.
+type containerdLog struct {
+	uri string
+	Log
+}
+
+// newContainerdLog accepts the options "uri" and "fallback", the driver
+// used for everything except service output (default "file").
+func newContainerdLog(logDir string, options map[string]string) (Log, error) {
+	uri := options["uri"]
+	if uri == "" {
+		return nil, fmt.Errorf("the containerd log driver requires the uri option")
+	}
+	if err := checkLogURI(uri); err != nil {
+		return nil, err
+	}
+	fallback := options["fallback"]
+	if fallback == "" {
+		fallback = "file"
+	}
+	if fallback == "containerd" {
+		return nil, fmt.Errorf("the containerd log driver cannot fall back to itself")
+	}
+	l, err := newLog(fallback, logDir, options)
+	if err != nil {
+		return nil, err
+	}
+	return &containerdLog{uri: uri, Log: l}, nil
+}
+
+// checkLogURI returns an error unless the shims would accept uri: it must
+// have the binary or file scheme and an absolute path. Any other string is
+// taken as the path of a FIFO, so the task would fail to start.
+func checkLogURI(uri string) error {
+	u, err := url.Parse(strings.Replace(uri, "{name}", "name", -1))
+	if err != nil {
+		return fmt.Errorf("invalid log uri %q: %v", uri, err)
+	}
+	if u.Scheme != "binary" && u.Scheme != "file" {
+		return fmt.Errorf("invalid log uri %q: expected a binary:// or file:// uri", uri)
+	}
+	if u.Host != "" || !path.IsAbs(u.Path) {
+		return fmt.Errorf("invalid log uri %q: expected an absolute path such as %s:///usr/bin/shipper", uri, u.Scheme)
+	}
+	return nil
+}
+
+// Path returns the log URI for containerd.
+func (c *containerdLog) Path(n string) string {
+	return strings.Replace(c.uri, "{name}", n, -1)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewLog(t *testing.T) {
+	for _, test := range []struct {
+		driver  string
+		options map[string]string
+		valid   bool
+	}{
+		{"file", nil, true},
+		{"file", map[string]string{"max-size": "1024", "max-files": "3", "max-dir-size": "4096"}, true},
+		{"file", map[string]string{"max-size": "1k"}, false},
+		{"file", map[string]string{"max-files": "x"}, false},
+		{"memlogd", map[string]string{"spool-size": "1024", "spool-timeout": "10s"}, true},
+		{"memlogd", map[string]string{"spool-size": "x"}, false},
+		{"memlogd", map[string]string{"spool-size": "-1"}, false},
+		{"memlogd", map[string]string{"spool-timeout": "10"}, false},
+		{"null", nil, true},
+		{"syslog", nil, true},
+		{"syslog", map[string]string{"facility": "local3", "network": "udp", "address": "10.0.0.1:514"}, true},
+		{"syslog", map[string]string{"facility": "mail"}, false},
+		{"containerd", map[string]string{"uri": "binary:///usr/bin/shipper?name={name}"}, true},
+		{"containerd", map[string]string{"uri": "file:///var/log/{name}.log", "fallback": "null"}, true},
+		{"containerd", nil, false},
+		{"containerd", map[string]string{"uri": "/var/log/{name}.log"}, false},
+		{"containerd", map[string]string{"uri": "fifo:///var/run/{name}"}, false},
+		{"containerd", map[string]string{"uri": "binary://usr/bin/shipper"}, false},
+		{"containerd", map[string]string{"uri": "file:var/log/{name}.log"}, false},
+		{"containerd", map[string]string{"uri": "file:///var/log/{name}.log", "fallback": "containerd"}, false},
+		{"containerd", map[string]string{"uri": "file:///var/log/{name}.log", "fallback": "journald"}, false},
+		{"journald", nil, false},
+	} {
+		_, err := newLog(test.driver, "/var/log", test.options)
+		if (err == nil) != test.valid {
+			t.Errorf("%s %v: unexpected error %v", test.driver, test.options, err)
+		}
+	}
+}
+
+func TestDriverOptions(t *testing.T) {
+	l, err := newLog("file", "/var/log", map[string]string{"dir": "/var/log/services", "max-size": "1024", "max-files": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (&fileLog{dir: "/var/log/services", maxSize: 1024, maxFiles: 3}); !reflect.DeepEqual(l, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, l)
+	}
+	l, err = newLog("syslog", "/var/log", map[string]string{"facility": "local3", "network": "udp", "address": "10.0.0.1:514"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := l.(*syslogLog); s.priority != syslog.LOG_LOCAL3|syslog.LOG_INFO || s.network != "udp" || s.address != "10.0.0.1:514" || s.fifoDir != "/var/run" {
+		t.Errorf("Unexpected syslog options %+v", s)
+	}
+	l, err = newLog("containerd", "/var/log", map[string]string{"uri": "binary:///usr/bin/shipper?name={name}", "fallback": "null"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := l.Path("sshd.out"); path != "binary:///usr/bin/shipper?name=sshd.out" {
+		t.Errorf("Unexpected containerd log uri %s", path)
+	}
+	if _, ok := l.(*containerdLog).Log.(*nullLog); !ok {
+		t.Errorf("Expected to fall back to the null driver, got %T", l.(*containerdLog).Log)
+	}
+}
+
+func TestGetServiceLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	persist := filepath.Join(dir, "persist")
+
+	for _, test := range []struct {
+		annotations map[string]string
+		driver      string // type of the driver, under any level or persist
+		discard     []string
+		persist     bool
+	}{
+		{nil, "", nil, false},
+		{map[string]string{loggingDriverAnnotation: "null"}, "*main.nullLog", nil, false},
+		{map[string]string{loggingDriverAnnotation: "syslog", loggingOptionAnnotation + "facility": "local0"}, "*main.syslogLog", nil, false},
+		// invalid drivers and options are ignored
+		{map[string]string{loggingDriverAnnotation: "journald"}, "", nil, false},
+		{map[string]string{loggingDriverAnnotation: "syslog", loggingOptionAnnotation + "facility": "mail"}, "", nil, false},
+		{map[string]string{loggingLevelAnnotation: "all"}, "", nil, false},
+		{map[string]string{loggingLevelAnnotation: "stderr"}, "", []string{"sshd.out"}, false},
+		{map[string]string{loggingLevelAnnotation: "none", loggingDriverAnnotation: "null"}, "*main.nullLog", []string{"sshd.out", "sshd"}, false},
+		{map[string]string{loggingLevelAnnotation: "some"}, "", nil, false},
+		{map[string]string{loggingPersistAnnotation: persist}, "", nil, true},
+	} {
+		l := GetServiceLog(dir, "sshd", test.annotations)
+		var discard []string
+		if d, ok := l.(*discardLog); ok {
+			for _, n := range []string{"sshd.out", "sshd"} {
+				if d.discard[n] {
+					discard = append(discard, n)
+				}
+			}
+			l = d.Log
+		}
+		if !reflect.DeepEqual(discard, test.discard) {
+			t.Errorf("%v: discarded %v, expected %v", test.annotations, discard, test.discard)
+		}
+		if tee, ok := l.(*teeLog); ok != test.persist {
+			t.Errorf("%v: persisted %v, expected %v", test.annotations, ok, test.persist)
+		} else if ok {
+			l = tee.Log
+		}
+		driver := test.driver
+		if driver == "" {
+			// the default, as memlogd isn't running
+			driver = "*main.fileLog"
+		}
+		if typ := reflect.TypeOf(l).String(); typ != driver {
+			t.Errorf("%v: got driver %s, expected %s", test.annotations, typ, driver)
+		}
+	}
+}
+
+func TestLogDestination(t *testing.T) {
+	for _, test := range []struct {
+		annotations map[string]string
+		expected    string
+	}{
+		{map[string]string{loggingDriverAnnotation: "syslog"}, "syslog"},
+		{map[string]string{loggingDriverAnnotation: "null", loggingLevelAnnotation: "stderr"}, "null level=stderr"},
+		{map[string]string{loggingDriverAnnotation: "file", loggingPersistAnnotation: "/var/persist/log"}, "file persist=/var/persist/log"},
+	} {
+		if d := logDestination(test.annotations); d != test.expected {
+			t.Errorf("%v: expected %q, got %q", test.annotations, test.expected, d)
+		}
+	}
+}
+
+func TestDiscardLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := GetServiceLog(dir, "sshd", map[string]string{
+		loggingDriverAnnotation: "file",
+		loggingLevelAnnotation:  "stderr",
+	})
+
+	for _, test := range []struct {
+		name    string
+		discard bool
+	}{
+		{"sshd.out", true},
+		{"sshd", false},
+	} {
+		path := l.Path(test.name)
+		if discarded := path == "/dev/null"; discarded != test.discard {
+			t.Errorf("%s: expected discarded %t, got path %s", test.name, test.discard, path)
+		}
+		w, err := l.Open(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, "hello\n"); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		w.Close()
+		if err := l.Close(test.name); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, test.name+".log"))
+		if test.discard && !os.IsNotExist(err) {
+			t.Errorf("%s: expected no log file, got %q, %v", test.name, b, err)
+		}
+		if !test.discard && string(b) != "hello\n" {
+			t.Errorf("%s: expected %q, got %q, %v", test.name, "hello\n", b, err)
+		}
+	}
+}
@@ -2,14 +2,20 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/syslog"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -22,39 +28,139 @@ var (
 
 const (
 	logDumpCommand byte = iota
+	logFollowCommand
+	logDumpFollowCommand
+	logFilterQueryCommand
+	logHelloCommand byte = 6
 )
 
+const (
+	// logHelloName is sent in place of the name of a log to say hello to
+	// memlogd on the log socket.
+	logHelloName = ";hello"
+
+	// helloTimeout is how long to wait for memlogd to answer a hello.
+	// memlogds which predate the handshake never answer.
+	helloTimeout = time.Second
+)
+
+// memlogdHello is exchanged with memlogd to find out what it supports. It
+// must be kept in sync with memlogd.
+type memlogdHello struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features,omitempty"`
+	Instance string   `json:"instance,omitempty"`
+}
+
+// supports returns true if memlogd said it supports the feature.
+func (h *memlogdHello) supports(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
 // Log provides access to a log by path or io.WriteCloser
 type Log interface {
-	Path(string) string                  // Path of the log file (may be a FIFO)
-	Open(string) (io.WriteCloser, error) // Opens a log stream
-	Dump(string)                         // Copies logs to the console
-	Symlink(string)                      // Symlinks to the log directory (if there is one)
+	Path(string) string                   // Path of the log file (may be a FIFO)
+	Open(string) (io.WriteCloser, error)  // Opens a log stream
+	Dump(string)                          // Copies logs to the console
+	DumpAll(io.Writer, logsOptions) error // Copies selected lines of all logs to a writer
+	Symlink(string)                       // Symlinks to the log directory (if there is one)
+	Flush() error                         // Waits for output to reach the log destination
+	Close(string) error                   // Releases resources held for a log
 }
 
-// GetLog returns the log destination we should use.
+// GetLog returns the log destination we should use. The driver is read
+// from loggingConfigFile; if there is none, or it is invalid, memlogd is
+// used if running and otherwise files in logDir.
 func GetLog(logDir string) Log {
-	// is an external logging system enabled?
-	if _, err := os.Stat(logWriteSocket); !os.IsNotExist(err) {
-		return &remoteLog{
-			fifoDir: "/var/run",
+	config, err := readLogConfig(loggingConfigFile)
+	if err != nil {
+		log.Printf("Ignoring logging configuration: %v", err)
+	}
+	if config != nil && config.Driver != "" {
+		l, err := newLog(config.Driver, logDir, config.Options)
+		if err == nil {
+			return l
 		}
+		log.Printf("Failed to create log driver %s: %v", config.Driver, err)
 	}
-	return &fileLog{
-		dir: logDir,
+	l, err := newLog(defaultLogDriver(), logDir, nil)
+	if err != nil {
+		// the default drivers don't fail
+		log.Fatalf("Failed to create default log driver: %v", err)
 	}
+	return l
 }
 
 type fileLog struct {
-	dir string
+	dir        string
+	maxSize    int64 // size above which a log is rotated when opened
+	maxFiles   int   // number of rotated files kept per log
+	maxDirSize int64 // maximum total size of dir, 0 for no limit
+}
+
+// newFileLog accepts the options "dir" to override the log directory,
+// "max-size", "max-files" and "max-dir-size".
+func newFileLog(logDir string, options map[string]string) (Log, error) {
+	f := &fileLog{
+		dir:      logDir,
+		maxSize:  defaultMaxLogSize,
+		maxFiles: defaultMaxLogFiles,
+	}
+	if dir := options["dir"]; dir != "" {
+		f.dir = dir
+	}
+	for name, value := range map[string]*int64{
+		"max-size":     &f.maxSize,
+		"max-dir-size": &f.maxDirSize,
+	} {
+		if s := options[name]; s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %v", name, s, err)
+			}
+			*value = n
+		}
+	}
+	if s := options["max-files"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max-files %q: %v", s, err)
+		}
+		f.maxFiles = n
+	}
+	return f, nil
+}
+
+// rotate rotates the named log if it is larger than limit, then applies
+// the directory size cap.
+func (f *fileLog) rotate(n string, limit int64) {
+	path := f.localPath(n)
+	if fi, err := os.Stat(path); err == nil && fi.Size() > limit {
+		if err := rotateLogFile(path, f.maxFiles); err != nil {
+			log.Printf("Error rotating log %s: %v", path, err)
+		}
+	}
+	if f.maxDirSize > 0 {
+		if err := capLogDir(f.dir, f.maxDirSize); err != nil {
+			log.Printf("Error limiting size of log directory %s: %v", f.dir, err)
+		}
+	}
 }
 
 func (f *fileLog) localPath(n string) string {
 	return filepath.Join(f.dir, n+".log")
 }
 
-// Path returns the name of a log file path for the named service.
+// Path returns the name of a log file path for the named service. As
+// containerd writes from the start of the file, any existing contents are
+// rotated out of the way first.
 func (f *fileLog) Path(n string) string {
+	f.rotate(n, 0)
 	path := f.localPath(n)
 	// We just need this to exist, otherwise containerd will say:
 	//
@@ -70,9 +176,17 @@ func (f *fileLog) Path(n string) string {
 	return path
 }
 
-// Open a log file for the named service.
+// Open a log file for the named service, appending to it, rotating it
+// first if it has grown too large. A log which another process is still
+// writing, such as one given to a running task by Path, is never rotated
+// here, as it would go on writing to the rotated file.
 func (f *fileLog) Open(n string) (io.WriteCloser, error) {
-	return os.OpenFile(f.localPath(n), os.O_WRONLY|os.O_CREATE, 0644)
+	limit := f.maxSize
+	if inUse(f.localPath(n)) {
+		limit = math.MaxInt64
+	}
+	f.rotate(n, limit)
+	return os.OpenFile(f.localPath(n), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 }
 
 // Dump copies logs to the console.
@@ -83,6 +197,25 @@ func (f *fileLog) Dump(n string) {
 	}
 }
 
+// DumpAll copies the selected lines of each log to w, merged in time order.
+func (f *fileLog) DumpAll(w io.Writer, opts logsOptions) error {
+	paths, err := filepath.Glob(filepath.Join(f.dir, "*.log"))
+	if err != nil {
+		return err
+	}
+	return mergeFiles(w, paths, opts)
+}
+
+// Flush does nothing as output is written straight to the files.
+func (f *fileLog) Flush() error {
+	return nil
+}
+
+// Close does nothing as the files are closed by their writers.
+func (f *fileLog) Close(n string) error {
+	return nil
+}
+
 // Symlinks to the log directory. This is useful if we are logging directly to tmpfs and now need to symlink from a permanent disk.
 func (f *fileLog) Symlink(path string) {
 	parent := filepath.Dir(path)
@@ -94,28 +227,77 @@ func (f *fileLog) Symlink(path string) {
 }
 
 type remoteLog struct {
-	fifoDir string
+	fifoDir      string
+	writeSocket  string
+	readSocket   string
+	spoolSize    int           // bytes kept per log while memlogd is unavailable
+	spoolTimeout time.Duration // how long to wait for memlogd
+}
+
+// newRemoteLog accepts the options "fifo-dir", "write-socket",
+// "read-socket", "spool-size" and "spool-timeout".
+func newRemoteLog(logDir string, options map[string]string) (Log, error) {
+	r := &remoteLog{
+		fifoDir:      "/var/run",
+		writeSocket:  logWriteSocket,
+		readSocket:   logReadSocket,
+		spoolSize:    defaultSpoolSize,
+		spoolTimeout: defaultSpoolTimeout,
+	}
+	if size := options["spool-size"]; size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spool-size %q: %v", size, err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("invalid spool-size %q: must not be negative", size)
+		}
+		r.spoolSize = n
+	}
+	if timeout := options["spool-timeout"]; timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spool-timeout %q: %v", timeout, err)
+		}
+		r.spoolTimeout = d
+		raisePendingTimeout(d)
+	}
+	if dir := options["fifo-dir"]; dir != "" {
+		r.fifoDir = dir
+	}
+	if sock := options["write-socket"]; sock != "" {
+		r.writeSocket = sock
+	}
+	if sock := options["read-socket"]; sock != "" {
+		r.readSocket = sock
+	}
+	return r, nil
 }
 
 // Path returns the name of a FIFO connected to the logging daemon.
 func (r *remoteLog) Path(n string) string {
 	path := filepath.Join(r.fifoDir, n+".log")
 	if err := syscall.Mkfifo(path, 0600); err != nil {
+		log.Printf("Discarding log %s: %v", n, err)
 		return "/dev/null"
 	}
+	pendingLogs.Add(1)
 	go func() {
+		defer pendingLogs.Done()
 		// In a goroutine because Open of the FIFO will block until
 		// containerd opens it when the task is started.
 		fd, err := syscall.Open(path, syscall.O_RDONLY, 0)
 		if err != nil {
 			// Should never happen: we just created the fifo
 			log.Printf("failed to open fifo %s: %s", path, err)
+			return
 		}
-		defer syscall.Close(fd)
-		if err := sendToLogger(n, fd); err != nil {
-			// Should never happen: logging is enabled
-			log.Printf("failed to send fifo %s to logger: %s", path, err)
+		if err := sendToLogger(r.writeSocket, n, fd); err != nil {
+			// memlogd may not have started yet
+			r.spool(n, fd)
+			return
 		}
+		syscall.Close(fd)
 	}()
 	return path
 }
@@ -128,38 +310,50 @@ func (r *remoteLog) Open(n string) (io.WriteCloser, error) {
 	}
 	logFile := os.NewFile(uintptr(fds[0]), "")
 
-	if err := sendToLogger(n, fds[1]); err != nil {
-		return nil, err
+	if err := sendToLogger(r.writeSocket, n, fds[1]); err != nil {
+		// memlogd may not have started yet
+		r.spool(n, fds[1])
+		return logFile, nil
 	}
+	syscall.Close(fds[1])
 	return logFile, nil
 }
 
 // Dump copies logs to the console.
 func (r *remoteLog) Dump(n string) {
+	if err := r.dump(os.Stdout, n); err != nil {
+		log.Printf("Failed to dump log %s: %s", n, err)
+	}
+}
+
+// DumpAll copies the selected lines of all the logs to w.
+func (r *remoteLog) DumpAll(w io.Writer, opts logsOptions) error {
+	return r.query(w, "", nil, opts)
+}
+
+// dump copies the named log, or all logs if n is empty, to w.
+func (r *remoteLog) dump(w io.Writer, n string) error {
 	addr := net.UnixAddr{
-		Name: logReadSocket,
+		Name: r.readSocket,
 		Net:  "unix",
 	}
 	conn, err := net.DialUnix("unix", nil, &addr)
 	if err != nil {
-		log.Printf("Failed to connect to logger: %s", err)
-		return
+		return fmt.Errorf("failed to connect to logger: %v", err)
 	}
 	defer conn.Close()
 	nWritten, err := conn.Write([]byte{logDumpCommand})
 	if err != nil || nWritten < 1 {
-		log.Printf("Failed to request logs from logger: %s", err)
-		return
+		return fmt.Errorf("failed to request logs from logger: %v", err)
 	}
 	reader := bufio.NewReader(conn)
 	for {
 		line, err := reader.ReadString('\n')
 		if err == io.EOF {
-			return
+			return nil
 		}
 		if err != nil {
-			log.Printf("Failed to read log message: %s", err)
-			return
+			return fmt.Errorf("failed to read log message: %v", err)
 		}
 		// a line is of the form
 		// <timestamp>,<log>;<body>
@@ -169,20 +363,182 @@ func (r *remoteLog) Dump(n string) {
 			log.Printf("Failed to parse log message: %s", line)
 			continue
 		}
-		if csv[1] == n {
-			fmt.Print(line)
+		if n == "" || csv[1] == n {
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
 		}
 	}
 }
 
+// Flush waits for logs spooled while memlogd was unavailable.
+func (r *remoteLog) Flush() error {
+	waitForLogs()
+	return nil
+}
+
+// Close removes the FIFO created by Path, so that it can be created again
+// when the service is restarted.
+func (r *remoteLog) Close(n string) error {
+	return removeFifo(filepath.Join(r.fifoDir, n+".log"))
+}
+
 // Symlinks to the log directory. This is a no-op because there is no log directory.
 func (r *remoteLog) Symlink(path string) {
 	return
 }
 
-func sendToLogger(name string, fd int) error {
+// removeFifo removes a FIFO, if it exists.
+func removeFifo(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		return fmt.Errorf("%s is not a FIFO", path)
+	}
+	return os.Remove(path)
+}
+
+// logMetadata describes the writer of a log to memlogd.
+type logMetadata struct {
+	Service   string `json:"service,omitempty"`
+	Stream    string `json:"stream,omitempty"`
+	Pid       int    `json:"pid,omitempty"`
+	Namespace string `json:"namespace,omitempty"` // containerd namespace
+	// Priority is the syslog priority of every line, unless LevelPrefix is
+	// set and the line starts with a kernel-style "<N>" priority.
+	Priority    *int `json:"priority,omitempty"`
+	LevelPrefix bool `json:"level_prefix,omitempty"`
+}
+
+// metadataFor returns the metadata for the named log: the stdout of a
+// service is logged as <service>.out and its stderr as <service>.
+func metadataFor(name string) *logMetadata {
+	if name == initLogName {
+		// our own messages are prefixed with their level
+		priority := int(syslog.LOG_DAEMON | syslog.LOG_INFO)
+		return &logMetadata{Service: name, Stream: "stderr", Priority: &priority, LevelPrefix: true}
+	}
+	if strings.HasSuffix(name, ".out") {
+		return &logMetadata{Service: strings.TrimSuffix(name, ".out"), Stream: "stdout"}
+	}
+	if strings.HasSuffix(name, ".events") {
+		return &logMetadata{Service: strings.TrimSuffix(name, ".events"), Stream: "events"}
+	}
+	return &logMetadata{Service: name, Stream: "stderr"}
+}
+
+// setProcess tells memlogd the pid and containerd namespace, if any, of
+// the process writing to the named log.
+func (r *remoteLog) setProcess(name string, pid int, namespace string) error {
+	meta := metadataFor(name)
+	meta.Pid = pid
+	meta.Namespace = namespace
+	return sendRegistration(r.writeSocket, name, meta, -1)
+}
+
+// setLogProcess records the process writing to the named log, if
+// supported.
+func setLogProcess(l Log, name string, pid int, namespace string) {
+	switch l := l.(type) {
+	case *discardLog:
+		if !l.discard[name] {
+			setLogProcess(l.Log, name, pid, namespace)
+		}
+	case *teeLog:
+		setLogProcess(l.Log, name, pid, namespace)
+	case *remoteLog:
+		if err := l.setProcess(name, pid, namespace); err != nil {
+			log.Debugf("Failed to send process of %s to logger: %v", name, err)
+		}
+	}
+}
+
+func sendToLogger(socket, name string, fd int) error {
+	return sendRegistration(socket, name, metadataFor(name), fd)
+}
+
+var (
+	logSocketHellosMu sync.Mutex
+	logSocketHellos   = map[string]*memlogdHello{}
+)
+
+// logSocketHello returns the hello of the memlogd listening on the log
+// socket, which is asked once per process. A memlogd which doesn't answer
+// is treated as version 0, which supports nothing.
+func logSocketHello(socket string) (*memlogdHello, error) {
+	logSocketHellosMu.Lock()
+	defer logSocketHellosMu.Unlock()
+	if h, ok := logSocketHellos[socket]; ok {
+		return h, nil
+	}
+
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	// bind to an address chosen by the kernel, so memlogd can answer
+	if err := syscall.Bind(fd, &syscall.SockaddrUnix{}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ctlUnixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		// should never happen
+		log.Fatal("Internal error, invalid cast.")
+	}
+	raddr := net.UnixAddr{Name: socket, Net: "unixgram"}
+	if _, err := ctlUnixConn.WriteToUnix([]byte(logHelloName+"\n{\"version\":1}"), &raddr); err != nil {
+		// memlogd is not running, so ask again next time
+		return nil, err
+	}
+	if err := ctlUnixConn.SetReadDeadline(time.Now().Add(helloTimeout)); err != nil {
+		return nil, err
+	}
+	h := &memlogdHello{}
+	b := make([]byte, 4096)
+	if n, err := ctlUnixConn.Read(b); err != nil {
+		log.Debugf("memlogd did not answer our hello, assuming it is an old version: %v", err)
+	} else if err := json.Unmarshal(b[:n], h); err != nil {
+		log.Printf("Ignoring invalid hello from memlogd: %v", err)
+		h = &memlogdHello{}
+	}
+	logSocketHellos[socket] = h
+	return h, nil
+}
+
+// sendRegistration sends the name of a log followed by its metadata, and
+// the fd to read it from unless fd is -1. Metadata is only sent to a
+// memlogd which supports it, as older ones take the whole datagram as the
+// name; to those a registration without an fd is not sent at all.
+func sendRegistration(socket, name string, meta *logMetadata, fd int) error {
+	h, err := logSocketHello(socket)
+	if err != nil {
+		return errLoggingNotEnabled
+	}
+	payload := name
+	if h.supports("metadata") {
+		b, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		payload += "\n" + string(b)
+	} else if fd == -1 {
+		return nil
+	}
+
 	var ctlSocket int
-	var err error
 	if ctlSocket, err = syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0); err != nil {
 		return err
 	}
@@ -199,9 +555,12 @@ func sendToLogger(name string, fd int) error {
 		log.Fatal("Internal error, invalid cast.")
 	}
 
-	raddr := net.UnixAddr{Name: logWriteSocket, Net: "unixgram"}
-	oobs := syscall.UnixRights(fd)
-	_, _, err = ctlUnixConn.WriteMsgUnix([]byte(name), oobs, &raddr)
+	raddr := net.UnixAddr{Name: socket, Net: "unixgram"}
+	var oobs []byte
+	if fd != -1 {
+		oobs = syscall.UnixRights(fd)
+	}
+	_, _, err = ctlUnixConn.WriteMsgUnix([]byte(payload), oobs, &raddr)
 	if err != nil {
 		return errLoggingNotEnabled
 	}
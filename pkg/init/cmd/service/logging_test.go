@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/linuxkit/linuxkit/pkg/memlogd/memlogdtest"
+)
+
+// newTestMemlogd starts a simulated memlogd accepting logs on socket.
+func newTestMemlogd(t *testing.T, socket string, configure func(*memlogdtest.Server)) *memlogdtest.Server {
+	s := memlogdtest.NewServer()
+	if configure != nil {
+		configure(s)
+	}
+	if err := s.ListenWrite(socket); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// waitForRegistrations returns the registrations received by s once there
+// are at least n, failing the test if they don't arrive.
+func waitForRegistrations(t *testing.T, s *memlogdtest.Server, n int) []memlogdtest.Registration {
+	var regs []memlogdtest.Registration
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if regs = s.Registrations(); len(regs) >= n {
+			return regs
+		}
+	}
+	t.Fatalf("expected %d registrations, got %+v", n, regs)
+	return nil
+}
+
+// waitForMessages returns the messages logged to s once there are at least
+// n, failing the test if they don't arrive.
+func waitForMessages(t *testing.T, s *memlogdtest.Server, n int) []string {
+	var msgs []string
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		msgs = nil
+		for _, e := range s.Entries() {
+			msgs = append(msgs, e.Source+": "+e.Msg)
+		}
+		if len(msgs) >= n {
+			return msgs
+		}
+	}
+	t.Fatalf("expected %d messages, got %q", n, msgs)
+	return nil
+}
+
+func TestSendRegistration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pid := &logMetadata{Service: "sshd", Stream: "stdout", Pid: 42}
+	current := func(*memlogdtest.Server) {}
+	noMetadata := func(s *memlogdtest.Server) { s.Features = []string{} }
+	noHello := func(s *memlogdtest.Server) { s.Version = memlogdtest.NoHello }
+
+	for i, test := range []struct {
+		memlogd  func(*memlogdtest.Server)
+		name     string
+		meta     *logMetadata
+		withFd   bool
+		expected *memlogdtest.Registration // nil if nothing should be sent
+	}{
+		{current, "sshd.out", metadataFor("sshd.out"), true, &memlogdtest.Registration{Name: "sshd.out", Meta: &memlogdtest.Metadata{Service: "sshd", Stream: "stdout"}, Fd: true}},
+		{current, "sshd.out", pid, false, &memlogdtest.Registration{Name: "sshd.out", Meta: &memlogdtest.Metadata{Service: "sshd", Stream: "stdout", Pid: 42}}},
+		// older versions take the whole datagram as the name
+		{noMetadata, "sshd.out", metadataFor("sshd.out"), true, &memlogdtest.Registration{Name: "sshd.out", Fd: true}},
+		{noMetadata, "sshd.out", pid, false, nil},
+		// no answer is treated as version 0
+		{noHello, "sshd", metadataFor("sshd"), true, &memlogdtest.Registration{Name: "sshd", Fd: true}},
+		{noHello, "sshd", pid, false, nil},
+	} {
+		socket := filepath.Join(dir, strconv.Itoa(i)+".sock")
+		l := newTestMemlogd(t, socket, test.memlogd)
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd := -1
+		if test.withFd {
+			fd = int(r.Fd())
+		}
+		if err := sendRegistration(socket, test.name, test.meta, fd); err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+		if test.expected == nil {
+			time.Sleep(200 * time.Millisecond)
+			if regs := l.Registrations(); len(regs) != 0 {
+				t.Errorf("%d: expected no registration, got %+v", i, regs)
+			}
+		} else if regs := waitForRegistrations(t, l, 1); len(regs) != 1 || !reflect.DeepEqual(regs[0], *test.expected) {
+			t.Errorf("%d: expected registration %+v, got %+v", i, *test.expected, regs)
+		}
+		r.Close()
+		w.Close()
+		l.Close()
+	}
+}
+
+func TestSendRegistrationNotRunning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "memlogd.sock")
+	if err := sendRegistration(socket, "sshd", metadataFor("sshd"), -1); err != errLoggingNotEnabled {
+		t.Fatalf("expected %v, got %v", errLoggingNotEnabled, err)
+	}
+	// once memlogd starts it is asked again
+	l := newTestMemlogd(t, socket, nil)
+	defer l.Close()
+	if err := sendRegistration(socket, "sshd", metadataFor("sshd"), -1); err != nil {
+		t.Fatal(err)
+	}
+	expected := memlogdtest.Registration{Name: "sshd", Meta: &memlogdtest.Metadata{Service: "sshd", Stream: "stderr"}}
+	if regs := waitForRegistrations(t, l, 1); !reflect.DeepEqual(regs[0], expected) {
+		t.Errorf("expected registration with metadata, got %+v", regs[0])
+	}
+}
+
+func TestRemoveFifo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fifo := filepath.Join(dir, "sshd.log")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "init.log")
+	if err := ioutil.WriteFile(file, []byte("init\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		path    string
+		removed bool
+		err     bool
+	}{
+		{fifo, true, false},
+		// removing it again is fine
+		{fifo, true, false},
+		// only FIFOs are removed
+		{file, false, true},
+	} {
+		err := removeFifo(test.path)
+		if (err != nil) != test.err {
+			t.Errorf("%q: expected error %t, got %v", test.path, test.err, err)
+		}
+		if _, err := os.Lstat(test.path); os.IsNotExist(err) != test.removed {
+			t.Errorf("%q: expected removed %t, got %v", test.path, test.removed, err)
+		}
+	}
+}
+
+func TestRemoteLogPathClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "memlogd.sock")
+	l := newTestMemlogd(t, socket, nil)
+	defer l.Close()
+	r := &remoteLog{fifoDir: dir, writeSocket: socket}
+
+	// a service which is restarted gets a new FIFO each time
+	for i, msg := range []string{"first run", "second run"} {
+		path := r.Path("sshd")
+		if path != filepath.Join(dir, "sshd.log") {
+			t.Fatalf("expected a FIFO in %s, got %s", dir, path)
+		}
+		w, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.WriteString(msg + "\n")
+		w.Close()
+		if regs := waitForRegistrations(t, l, i+1); !regs[i].Fd {
+			t.Fatalf("expected the FIFO to be sent to memlogd, got %+v", regs[i])
+		}
+		if msgs := waitForMessages(t, l, i+1); msgs[i] != "sshd: "+msg {
+			t.Errorf("expected %q, got %q", msg, msgs[i])
+		}
+		if err := r.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close("sshd"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("expected FIFO to be removed, got %v", err)
+		}
+	}
+}
+
+func TestRemoteLogDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "memlogdq.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	lines := "2018-07-08T09:16:53Z,sshd;first\n" +
+		"2018-07-08T09:16:54Z,sshd.out;second\n" +
+		"not a log line\n" +
+		"2018-07-08T09:16:55Z,sshd;third\n"
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b := make([]byte, 1)
+			if _, err := conn.Read(b); err == nil && b[0] == logDumpCommand {
+				conn.Write([]byte(lines))
+			}
+			conn.Close()
+		}
+	}()
+	r := &remoteLog{readSocket: socket}
+
+	for _, test := range []struct {
+		name     string
+		expected string
+	}{
+		{"sshd", "2018-07-08T09:16:53Z,sshd;first\n2018-07-08T09:16:55Z,sshd;third\n"},
+		{"sshd.out", "2018-07-08T09:16:54Z,sshd.out;second\n"},
+		{"", "2018-07-08T09:16:53Z,sshd;first\n2018-07-08T09:16:54Z,sshd.out;second\n2018-07-08T09:16:55Z,sshd;third\n"},
+		{"dhcpcd", ""},
+	} {
+		var b bytes.Buffer
+		if err := r.dump(&b, test.name); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.name, test.expected, b.String())
+		}
+	}
+	r.readSocket = filepath.Join(dir, "missing.sock")
+	if err := r.dump(ioutil.Discard, ""); err == nil {
+		t.Errorf("expected an error when memlogd is not running")
+	}
+}
+
+func TestFileLogDumpAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeLogDir(t, dir, [][2]string{
+		{"sshd.log.0", "2018-07-08T09:16:52Z rotated\n"},
+		{"sshd.log", "2018-07-08T09:16:53Z first\n2018-07-08T09:16:55Z third\n"},
+		{"init.log", "2018-07-08T09:16:54Z second\n"},
+	})
+	l, err := newFileLog(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := l.DumpAll(&b, logsOptions{tail: -1}); err != nil {
+		t.Fatal(err)
+	}
+	// rotated logs are not included
+	expected := "sshd: 2018-07-08T09:16:53Z first\ninit: 2018-07-08T09:16:54Z second\nsshd: 2018-07-08T09:16:55Z third\n"
+	if b.String() != expected {
+		t.Errorf("expected %q, got %q", expected, b.String())
+	}
+	if err := l.Flush(); err != nil {
+		t.Error(err)
+	}
+	if err := l.Close("sshd"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// These defaults match logwrite.
+const (
+	defaultMaxLogSize  = 1024 * 1024
+	defaultMaxLogFiles = 10
+)
+
+// rotateLogFile renames path to path.0, path.0 to path.1 and so on, keeping
+// at most maxLogFiles rotated files. The naming matches logwrite.
+func rotateLogFile(path string, maxLogFiles int) error {
+	for i := maxLogFiles - 1; i >= 0; i-- {
+		newerFile := fmt.Sprintf("%s.%d", path, i-1)
+		if i == 0 {
+			newerFile = path
+		}
+		olderFile := fmt.Sprintf("%s.%d", path, i)
+		err := os.Rename(newerFile, olderFile)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if maxLogFiles < 1 {
+		// nothing is kept
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// capLogDir deletes the oldest rotated log files in dir until the total
+// size of the directory is at most maxSize. Active log files are never
+// deleted.
+func capLogDir(dir string, maxSize int64) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var (
+		total   int64
+		rotated []os.FileInfo
+	)
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		total += fi.Size()
+		if strings.Contains(fi.Name(), ".log.") {
+			rotated = append(rotated, fi)
+		}
+	}
+	sort.Slice(rotated, func(i, j int) bool {
+		return rotated[i].ModTime().Before(rotated[j].ModTime())
+	})
+	for _, fi := range rotated {
+		if total <= maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+		total -= fi.Size()
+	}
+	return nil
+}
+
+// inUse returns true if another process has the file at path open, such
+// as the containerd shim of a running task writing its output there. It
+// tries to take a write lease, which is only granted if there is no other
+// open file descriptor for the file. If leases are not supported the file
+// is assumed to be in use.
+func inUse(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETLEASE, syscall.F_WRLCK); errno != 0 {
+		return true
+	}
+	_, _, _ = syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETLEASE, syscall.F_UNLCK)
+	return false
+}
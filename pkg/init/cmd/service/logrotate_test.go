@@ -0,0 +1,202 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// writeLogDir replaces the contents of dir with files, each modified a
+// second after the one before in the order given.
+func writeLogDir(t *testing.T, dir string, files [][2]string) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2018, 7, 8, 9, 16, 53, 0, time.UTC)
+	for i, f := range files {
+		path := filepath.Join(dir, f[0])
+		if err := ioutil.WriteFile(path, []byte(f[1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := start.Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readLogDir returns the contents of each file in dir.
+func readLogDir(t *testing.T, dir string) map[string]string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]string{}
+	for _, fi := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[fi.Name()] = string(b)
+	}
+	return contents
+}
+
+func TestRotateLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		files       [][2]string
+		maxLogFiles int
+		expected    map[string]string
+	}{
+		{[][2]string{{"sshd.log", "new"}}, 2, map[string]string{"sshd.log.0": "new"}},
+		{[][2]string{{"sshd.log.0", "old"}, {"sshd.log", "new"}}, 2, map[string]string{"sshd.log.0": "new", "sshd.log.1": "old"}},
+		// the oldest file is replaced
+		{[][2]string{{"sshd.log.1", "oldest"}, {"sshd.log.0", "old"}, {"sshd.log", "new"}}, 2, map[string]string{"sshd.log.0": "new", "sshd.log.1": "old"}},
+		{[][2]string{{"sshd.log.0", "old"}, {"sshd.log", "new"}}, 1, map[string]string{"sshd.log.0": "new"}},
+		{[][2]string{{"sshd.log", "new"}}, 0, map[string]string{}},
+		// other logs are left alone
+		{[][2]string{{"init.log", "init"}, {"sshd.log", "new"}}, 2, map[string]string{"init.log": "init", "sshd.log.0": "new"}},
+		{nil, 2, map[string]string{}},
+	} {
+		writeLogDir(t, dir, test.files)
+		if err := rotateLogFile(filepath.Join(dir, "sshd.log"), test.maxLogFiles); err != nil {
+			t.Errorf("%v: %v", test.files, err)
+		}
+		if got := readLogDir(t, dir); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.files, test.expected, got)
+		}
+	}
+}
+
+func TestCapLogDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := [][2]string{
+		{"sshd.log.1", "oldest"},
+		{"init.log.0", "older"},
+		{"sshd.log.0", "old"},
+		{"init.log", "init"},
+		{"sshd.log", "sshd"},
+	}
+
+	for _, test := range []struct {
+		maxSize  int64
+		expected []string
+	}{
+		{100, []string{"init.log", "init.log.0", "sshd.log", "sshd.log.0", "sshd.log.1"}},
+		{22, []string{"init.log", "init.log.0", "sshd.log", "sshd.log.0", "sshd.log.1"}},
+		// the oldest rotated files go first
+		{21, []string{"init.log", "init.log.0", "sshd.log", "sshd.log.0"}},
+		{16, []string{"init.log", "init.log.0", "sshd.log", "sshd.log.0"}},
+		{15, []string{"init.log", "sshd.log", "sshd.log.0"}},
+		// active logs are never deleted
+		{0, []string{"init.log", "sshd.log"}},
+	} {
+		writeLogDir(t, dir, files)
+		if err := capLogDir(dir, test.maxSize); err != nil {
+			t.Errorf("%d: %v", test.maxSize, err)
+		}
+		var got []string
+		for name := range readLogDir(t, dir) {
+			got = append(got, name)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%d: expected %v, got %v", test.maxSize, test.expected, got)
+		}
+	}
+}
+
+func TestFileLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		options  map[string]string
+		files    [][2]string
+		path     bool // use Path rather than Open
+		expected map[string]string
+	}{
+		// logs are only rotated once they are over max-size
+		{map[string]string{"max-size": "8"}, [][2]string{{"sshd.log", "12345678"}}, false, map[string]string{"sshd.log": "12345678"}},
+		{map[string]string{"max-size": "8"}, [][2]string{{"sshd.log", "123456789"}}, false, map[string]string{"sshd.log": "", "sshd.log.0": "123456789"}},
+		{map[string]string{"max-size": "8", "max-files": "1"}, [][2]string{{"sshd.log.0", "old"}, {"sshd.log", "123456789"}}, false, map[string]string{"sshd.log": "", "sshd.log.0": "123456789"}},
+		// containerd writes from the start, so anything there is rotated
+		{nil, [][2]string{{"sshd.log", "old"}}, true, map[string]string{"sshd.log": "", "sshd.log.0": "old"}},
+		{nil, nil, true, map[string]string{"sshd.log": ""}},
+		// the directory is capped after rotating
+		{map[string]string{"max-dir-size": "10"}, [][2]string{{"init.log.0", "older"}, {"init.log", "init"}, {"sshd.log", "old"}}, true, map[string]string{"init.log": "init", "sshd.log": "", "sshd.log.0": "old"}},
+	} {
+		writeLogDir(t, dir, test.files)
+		options := map[string]string{"dir": dir}
+		for k, v := range test.options {
+			options[k] = v
+		}
+		l, err := newFileLog("/var/log", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.path {
+			l.Path("sshd")
+		} else {
+			w, err := l.Open("sshd")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Close()
+		}
+		if got := readLogDir(t, dir); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%v %v: expected %v, got %v", test.options, test.files, test.expected, got)
+		}
+	}
+
+	// a log which a running task is still writing is not rotated by Open
+	writeLogDir(t, dir, [][2]string{{"sshd.log", "123456789"}})
+	task, err := os.OpenFile(filepath.Join(dir, "sshd.log"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer task.Close()
+	l, err := newFileLog("/var/log", map[string]string{"dir": dir, "max-size": "8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := l.Open("sshd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	expected := map[string]string{"sshd.log": "123456789"}
+	if got := readLogDir(t, dir); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected a log in use to be left alone, got %v", got)
+	}
+	// once the task has gone it is rotated
+	task.Close()
+	if w, err = l.Open("sshd"); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	expected = map[string]string{"sshd.log": "", "sshd.log.0": "123456789"}
+	if got := readLogDir(t, dir); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the log to be rotated once it is no longer in use, got %v", got)
+	}
+}
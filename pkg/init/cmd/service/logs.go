@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	followInterval = 500 * time.Millisecond
+)
+
+// logFilter must be kept in sync with memlogd
+type logFilter struct {
+	Mode     byte      `json:"mode"`
+	Source   string    `json:"source,omitempty"`
+	Since    time.Time `json:"since,omitempty"`
+	FromSeq  uint64    `json:"from_seq,omitempty"`
+	Instance string    `json:"instance,omitempty"`
+}
+
+// logsOptions selects which lines of the logs are printed.
+type logsOptions struct {
+	follow bool
+	since  time.Time // zero for all
+	tail   int       // number of lines, -1 for all
+}
+
+func logsCmd(ctx context.Context, args []string) {
+	invoked := filepath.Base(os.Args[0])
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s logs [service]\n\n", invoked)
+		fmt.Printf("Print the logs of a service.\n\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	follow := flags.Bool("follow", false, "Follow the log output")
+	since := flags.String("since", "", "Only show logs newer than a duration (eg 10m) or RFC3339 time")
+	tail := flags.Int("tail", -1, "Only show this many of the most recent lines, -1 for all")
+	path := flags.String("path", defaultPath, "Path to service configs")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	args = flags.Args()
+
+	if len(args) != 1 {
+		fmt.Println("Please specify the service")
+		flags.Usage()
+		os.Exit(1)
+	}
+	service := args[0]
+
+	opts := logsOptions{follow: *follow, tail: *tail}
+	if *since != "" {
+		t, err := parseSince(*since, time.Now())
+		if err != nil {
+			log.Fatalf("Invalid -since %q: %v", *since, err)
+		}
+		opts.since = t
+	}
+
+	l := GetServiceLog(varLogDir, service, bundleAnnotations(filepath.Join(*path, service)))
+	if d, ok := l.(*discardLog); ok {
+		l = d.Log
+	}
+	if t, ok := l.(*teeLog); ok {
+		l = t.Log
+	}
+	var err error
+	switch l := l.(type) {
+	case *remoteLog:
+		err = l.logs(os.Stdout, service, opts)
+	case *fileLog:
+		err = l.logs(os.Stdout, service, opts)
+	default:
+		err = fmt.Errorf("the configured log driver does not store logs")
+	}
+	if err != nil {
+		log.Fatalf("Failed to read logs of %s: %v", service, err)
+	}
+}
+
+func dumpCmd(ctx context.Context, args []string) {
+	invoked := filepath.Base(os.Args[0])
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s dump\n\n", invoked)
+		fmt.Printf("Print the logs of all services, for diagnostics on the console.\n\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	follow := flags.Bool("follow", false, "Follow the log output")
+	tail := flags.Int("tail", -1, "Only show this many of the most recent lines of each log (or in total from memlogd), -1 for all")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if len(flags.Args()) != 0 {
+		fmt.Println("Unexpected argument")
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	opts := logsOptions{follow: *follow, tail: *tail}
+	if err := GetLog(varLogDir).DumpAll(os.Stdout, opts); err != nil {
+		log.Fatalf("Failed to dump logs: %v", err)
+	}
+}
+
+// parseSince parses either a duration before now or an RFC3339 time.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// tailLines returns the last n lines read from r, or all of them if n < 0.
+func tailLines(r io.Reader, n int, keep func(string) bool) ([]string, error) {
+	var lines []string
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 && keep(line) {
+			lines = append(lines, line)
+			if n >= 0 && len(lines) > n {
+				lines = lines[1:]
+			}
+		}
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+	}
+}
+
+// serviceLogNames returns the logs of a service: its stdout, stderr and
+// lifecycle events.
+func serviceLogNames(service string) []string {
+	return []string{service + ".out", service, eventLogName(service)}
+}
+
+// logs writes the output of a service to w. As the lines in files are
+// not timestamped, since selects whole files by modification time.
+func (f *fileLog) logs(w io.Writer, service string, opts logsOptions) error {
+	var paths []string
+	for _, n := range serviceLogNames(service) {
+		paths = append(paths, f.localPath(n))
+	}
+	return dumpFiles(w, paths, opts)
+}
+
+// openLogFiles opens the files which exist and, if since is set, were
+// modified after it.
+func openLogFiles(paths []string, since time.Time) ([]*os.File, error) {
+	var files []*os.File
+	for _, path := range paths {
+		if !since.IsZero() {
+			if fi, err := os.Stat(path); err == nil && fi.ModTime().Before(since) {
+				continue
+			}
+		}
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// dumpFiles writes the lines selected by opts from each file to w. When
+// following, new lines are written until all the followers fail.
+func dumpFiles(w io.Writer, paths []string, opts logsOptions) error {
+	files, err := openLogFiles(paths, opts.since)
+	if err != nil {
+		return err
+	}
+	for i, file := range files {
+		lines, err := tailLines(file, opts.tail, func(string) bool { return true })
+		if err == nil {
+			_, err = io.WriteString(w, strings.Join(lines, ""))
+		}
+		if err != nil {
+			closeFiles(files[i:])
+			return err
+		}
+	}
+	if !opts.follow {
+		closeFiles(files)
+		return nil
+	}
+	return followFiles(w, files, false)
+}
+
+// followFiles follows each file until all the followers fail, prefixing
+// each line with the name of its log if prefixed is set. It takes
+// ownership of the files.
+func followFiles(w io.Writer, files []*os.File, prefixed bool) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(files))
+	// followers write concurrently
+	w = &lockedWriter{w: w}
+	for _, file := range files {
+		out := w
+		if prefixed {
+			out = &prefixWriter{w: w, prefix: logFileName(file.Name()) + ": ", start: true}
+		}
+		wg.Add(1)
+		go func(file *os.File) {
+			defer wg.Done()
+			errs <- followFile(out, file)
+		}(file)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockedWriter serialises writes from several goroutines.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// followFile copies lines appended to file to w, reopening it when it is
+// rotated. It takes ownership of file.
+func followFile(w io.Writer, file *os.File) error {
+	defer func() { file.Close() }()
+	path := file.Name()
+	reader := bufio.NewReader(file)
+	partial := ""
+	for {
+		line, err := reader.ReadString('\n')
+		partial += line
+		if err == nil {
+			if _, err := io.WriteString(w, partial); err != nil {
+				return err
+			}
+			partial = ""
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		// partial lines are kept until the rest is written
+		time.Sleep(followInterval)
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		cur, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if os.SameFile(cur, fi) {
+			continue
+		}
+		// rotated: copy the rest of the old file then switch
+		if _, err := io.WriteString(w, partial); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, reader); err != nil {
+			return err
+		}
+		partial = ""
+		file.Close()
+		if file, err = os.Open(path); err != nil {
+			return err
+		}
+		reader = bufio.NewReader(file)
+	}
+}
+
+// logs writes the output of a service to w, using a filter query so that
+// memlogd only sends messages from the service if it supports them.
+func (r *remoteLog) logs(w io.Writer, service string, opts logsOptions) error {
+	// the glob matches both names, and others which are discarded
+	return r.query(w, escapeGlob(service)+"*", serviceLogNames(service), opts)
+}
+
+// query writes the lines selected by opts from the named logs, or all
+// logs if names is empty, to w. source is a glob matching all the names.
+func (r *remoteLog) query(w io.Writer, source string, names []string, opts logsOptions) error {
+	keepName := map[string]bool{}
+	for _, n := range names {
+		keepName[n] = true
+	}
+	filter := logFilter{
+		Mode:   logDumpCommand,
+		Source: source,
+		Since:  opts.since,
+	}
+	var lastSeq uint64
+	conn, filtered, err := r.send(&filter)
+	if err != nil {
+		return err
+	}
+	keep := func(line string) bool {
+		name, seq, ok := parseLogPrefix(line)
+		if seq > lastSeq {
+			lastSeq = seq
+		}
+		return ok && (len(names) == 0 || keepName[name]) && (filtered || lineSince(line, opts.since))
+	}
+	lines, err := tailLines(conn, opts.tail, keep)
+	conn.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read log message: %v", err)
+	}
+	if _, err := io.WriteString(w, strings.Join(lines, "")); err != nil {
+		return err
+	}
+	if !opts.follow {
+		return nil
+	}
+	// Resume after the dump, so nothing is printed twice or missed. A
+	// memlogd without sequence numbers can only be followed from now on,
+	// which misses anything logged since the dump.
+	filter.Mode = logDumpFollowCommand
+	filter.FromSeq = lastSeq + 1
+	if !filtered {
+		filter.Mode = logFollowCommand
+	}
+	if conn, _, err = r.send(&filter); err != nil {
+		return err
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read log message: %v", err)
+		}
+		if name, _, ok := parseLogPrefix(line); ok && (len(names) == 0 || keepName[name]) {
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// send sends a filter query to memlogd. A memlogd which doesn't support
+// them, according to its hello, is sent the plain command instead, so the
+// caller must select the messages itself unless the result is true. The
+// instance of the first memlogd the filter is sent to is kept in it, so
+// that FromSeq is ignored if memlogd has restarted since.
+func (r *remoteLog) send(filter *logFilter) (*net.UnixConn, bool, error) {
+	conn, h, err := r.dialQuery()
+	if err != nil {
+		return nil, false, err
+	}
+	request := []byte{filter.Mode}
+	filtered := h.supports("filter") && h.supports("seq")
+	if filter.Instance == "" {
+		filter.Instance = h.Instance
+	}
+	if filtered {
+		b, err := json.Marshal(filter)
+		if err != nil {
+			conn.Close()
+			return nil, false, err
+		}
+		request = append(append([]byte{logFilterQueryCommand}, b...), '\n')
+	}
+	if _, err := conn.Write(request); err != nil {
+		conn.Close()
+		return nil, false, fmt.Errorf("failed to request logs from logger: %v", err)
+	}
+	return conn, filtered, nil
+}
+
+// dialQuery connects to the memlogd query socket and says hello. A memlogd
+// which doesn't answer has taken the hello for a command, so it is
+// connected to again and treated as version 0, which supports nothing.
+func (r *remoteLog) dialQuery() (*net.UnixConn, *memlogdHello, error) {
+	addr := net.UnixAddr{
+		Name: r.readSocket,
+		Net:  "unix",
+	}
+	conn, err := net.DialUnix("unix", nil, &addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to logger: %v", err)
+	}
+	h, err := sayHello(conn)
+	if err == nil {
+		return conn, h, nil
+	}
+	conn.Close()
+	log.Debugf("memlogd did not answer our hello, assuming it is an old version: %v", err)
+	if conn, err = net.DialUnix("unix", nil, &addr); err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to logger: %v", err)
+	}
+	return conn, &memlogdHello{}, nil
+}
+
+// sayHello sends our hello on a query connection and returns the reply.
+func sayHello(conn *net.UnixConn) (*memlogdHello, error) {
+	if _, err := conn.Write(append([]byte{logHelloCommand}, "{\"version\":1}\n"...)); err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(helloTimeout)); err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	// Read a byte at a time so we don't consume the messages which follow
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	var h memlogdHello
+	if err := json.Unmarshal(line, &h); err != nil {
+		return nil, fmt.Errorf("invalid hello: %v", err)
+	}
+	return &h, nil
+}
+
+// lineSince returns true if the line was logged at or after since, by the
+// timestamp memlogd prefixed it with, or since is zero.
+func lineSince(line string, since time.Time) bool {
+	if since.IsZero() {
+		return true
+	}
+	csv := strings.Split(strings.SplitN(line, ";", 2)[0], ",")
+	t, err := time.Parse(time.RFC3339, csv[0])
+	return err != nil || !t.Before(since.Truncate(time.Second))
+}
+
+// parseLogPrefix returns the log name and sequence number (0 if absent)
+// from a line of the form <timestamp>,<log>[,<seq>];<body>
+func parseLogPrefix(line string) (string, uint64, bool) {
+	prefixBody := strings.SplitN(line, ";", 2)
+	csv := strings.Split(prefixBody[0], ",")
+	if len(prefixBody) < 2 || len(csv) < 2 {
+		return "", 0, false
+	}
+	var seq uint64
+	if len(csv) > 2 {
+		seq, _ = strconv.ParseUint(csv[2], 10, 64)
+	}
+	return csv[1], seq, true
+}
+
+// escapeGlob quotes the characters which are special in a glob.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[\`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// mergeFiles writes the lines selected by opts from each file to w in time
+// order, each prefixed with the name of its log, so that the logs of
+// several services can be read together. Lines are ordered by a leading
+// RFC3339 timestamp, and lines without one stay after the line before them
+// in the same file. Lines before the first timestamp in a file, which is
+// all of them in the output of services written by containerd, are placed
+// by the modification time of the file instead. Only the next line of each
+// file is held in memory, unless opts.tail is set.
+func mergeFiles(w io.Writer, paths []string, opts logsOptions) error {
+	files, err := openLogFiles(paths, opts.since)
+	if err != nil {
+		return err
+	}
+	var sources []*mergeSource
+	for _, file := range files {
+		s := &mergeSource{name: logFileName(file.Name())}
+		if fi, err := file.Stat(); err == nil {
+			s.time = fi.ModTime()
+		}
+		if opts.tail < 0 {
+			reader := bufio.NewReader(file)
+			s.next = func() (string, error) { return reader.ReadString('\n') }
+		} else {
+			lines, err := tailLines(file, opts.tail, func(string) bool { return true })
+			if err != nil {
+				closeFiles(files)
+				return err
+			}
+			s.next = func() (string, error) {
+				if len(lines) == 0 {
+					return "", io.EOF
+				}
+				line := lines[0]
+				lines = lines[1:]
+				return line, nil
+			}
+		}
+		sources = append(sources, s)
+	}
+	var live []*mergeSource
+	for _, s := range sources {
+		ok, err := s.advance()
+		if err != nil {
+			closeFiles(files)
+			return err
+		}
+		if ok {
+			live = append(live, s)
+		}
+	}
+	for len(live) > 0 {
+		// the earliest line, or the first file's on a tie
+		first := 0
+		for i, s := range live {
+			if s.time.Before(live[first].time) {
+				first = i
+			}
+		}
+		s := live[first]
+		line := s.line
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		if _, err := io.WriteString(w, s.name+": "+line); err != nil {
+			closeFiles(files)
+			return err
+		}
+		ok, err := s.advance()
+		if err != nil {
+			closeFiles(files)
+			return err
+		}
+		if !ok {
+			live = append(live[:first], live[first+1:]...)
+		}
+	}
+	if !opts.follow {
+		closeFiles(files)
+		return nil
+	}
+	return followFiles(w, files, true)
+}
+
+// mergeSource is a file being merged by mergeFiles.
+type mergeSource struct {
+	name string
+	next func() (string, error) // returns io.EOF after the last line
+	line string                 // the next line to write
+	time time.Time              // the time of line, of an earlier line or of the file
+}
+
+// advance reads the next line, returning false at the end of the file.
+func (s *mergeSource) advance() (bool, error) {
+	line, err := s.next()
+	if len(line) == 0 {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	s.line = line
+	if t, ok := lineTime(line); ok {
+		s.time = t
+	}
+	return true, nil
+}
+
+// lineTime returns the time at the start of a line, if there is one.
+func lineTime(line string) (time.Time, bool) {
+	field := strings.SplitN(line, " ", 2)[0]
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(field))
+	return t, err == nil
+}
+
+// logFileName returns the name of the log held in a file.
+func logFileName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".log")
+}
+
+// prefixWriter writes a prefix at the start of each line.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	start  bool // the next byte starts a line
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	var out []byte
+	for _, c := range b {
+		if p.start {
+			out = append(out, p.prefix...)
+		}
+		out = append(out, c)
+		p.start = c == '\n'
+	}
+	if _, err := p.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
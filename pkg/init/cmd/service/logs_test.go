@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linuxkit/linuxkit/pkg/memlogd/memlogdtest"
+)
+
+func TestMergeFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Date(2018, 7, 8, 9, 16, 53, 0, time.UTC)
+	stamp := func(d time.Duration) string {
+		return start.Add(d).Format(time.RFC3339)
+	}
+	files := []struct {
+		name     string
+		contents string
+		modTime  time.Time
+	}{
+		{"init.log", stamp(0) + " first\n" + stamp(2*time.Second) + " third\n  continued\n", start.Add(2 * time.Second)},
+		{"dhcpcd.out.log", stamp(time.Second) + " second\n" + stamp(3*time.Second) + " fourth\n", start.Add(3 * time.Second)},
+		// written by containerd without timestamps
+		{"sshd.out.log", "Server listening on :: port 22.\n", start.Add(2500 * time.Millisecond)},
+	}
+	var paths []string
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(path, []byte(f.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, f.modTime, f.modTime); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	for _, test := range []struct {
+		tail     int
+		expected string
+	}{
+		{-1, "init: " + stamp(0) + " first\n" +
+			"dhcpcd.out: " + stamp(time.Second) + " second\n" +
+			"init: " + stamp(2*time.Second) + " third\n" +
+			"init:   continued\n" +
+			"sshd.out: Server listening on :: port 22.\n" +
+			"dhcpcd.out: " + stamp(3*time.Second) + " fourth\n"},
+		{1, "init:   continued\n" +
+			"sshd.out: Server listening on :: port 22.\n" +
+			"dhcpcd.out: " + stamp(3*time.Second) + " fourth\n"},
+	} {
+		var b bytes.Buffer
+		if err := mergeFiles(&b, paths, logsOptions{tail: test.tail}); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.expected {
+			t.Errorf("With tail %d expected:\n%s\ngot:\n%s", test.tail, test.expected, b.String())
+		}
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2018, 7, 8, 9, 16, 53, 0, time.UTC)
+	for _, test := range []struct {
+		since    string
+		expected time.Time
+		err      bool
+	}{
+		{"10m", now.Add(-10 * time.Minute), false},
+		{"1h30m", now.Add(-90 * time.Minute), false},
+		{"2018-07-08T09:00:00Z", time.Date(2018, 7, 8, 9, 0, 0, 0, time.UTC), false},
+		{"yesterday", time.Time{}, true},
+		{"", time.Time{}, true},
+	} {
+		got, err := parseSince(test.since, now)
+		if (err != nil) != test.err {
+			t.Errorf("%q: expected error %t, got %v", test.since, test.err, err)
+			continue
+		}
+		if !test.err && !got.Equal(test.expected) {
+			t.Errorf("%q: expected %s, got %s", test.since, test.expected, got)
+		}
+	}
+}
+
+func TestTailLines(t *testing.T) {
+	input := "first\nsecond\nskip me\nthird\nno newline"
+	keep := func(line string) bool { return !strings.HasPrefix(line, "skip") }
+	for _, test := range []struct {
+		n        int
+		expected []string
+	}{
+		{-1, []string{"first\n", "second\n", "third\n", "no newline"}},
+		{2, []string{"third\n", "no newline"}},
+		{10, []string{"first\n", "second\n", "third\n", "no newline"}},
+		{0, []string{}},
+	} {
+		got, err := tailLines(strings.NewReader(input), test.n, keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%d: expected %q, got %q", test.n, test.expected, got)
+		}
+	}
+}
+
+func TestLineSince(t *testing.T) {
+	since := time.Date(2018, 7, 8, 9, 16, 53, 500000000, time.UTC)
+	for _, test := range []struct {
+		line     string
+		since    time.Time
+		expected bool
+	}{
+		{"2018-07-08T09:16:52Z,sshd;before\n", since, false},
+		// memlogd timestamps are only to the second
+		{"2018-07-08T09:16:53Z,sshd;same second\n", since, true},
+		{"2018-07-08T09:16:54Z,sshd;after\n", since, true},
+		{"2018-07-08T09:16:52Z,sshd;before\n", time.Time{}, true},
+		// lines we can't parse are kept
+		{"garbage\n", since, true},
+	} {
+		if got := lineSince(test.line, test.since); got != test.expected {
+			t.Errorf("%q since %s: expected %t, got %t", test.line, test.since, test.expected, got)
+		}
+	}
+}
+
+func TestParseLogPrefix(t *testing.T) {
+	for _, test := range []struct {
+		line string
+		name string
+		seq  uint64
+		ok   bool
+	}{
+		{"2018-07-08T09:16:53Z,sshd;hello\n", "sshd", 0, true},
+		{"2018-07-08T09:16:53Z,sshd.out,42;hello, world; again\n", "sshd.out", 42, true},
+		{"2018-07-08T09:16:53Z,sshd,bad;hello\n", "sshd", 0, true},
+		{"2018-07-08T09:16:53Z;no name\n", "", 0, false},
+		{"2018-07-08T09:16:53Z,sshd no body\n", "", 0, false},
+		{"", "", 0, false},
+	} {
+		name, seq, ok := parseLogPrefix(test.line)
+		if name != test.name || seq != test.seq || ok != test.ok {
+			t.Errorf("%q: expected %q %d %t, got %q %d %t", test.line, test.name, test.seq, test.ok, name, seq, ok)
+		}
+	}
+}
+
+func TestEscapeGlob(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expected string
+	}{
+		{"sshd", "sshd"},
+		{"a*b?c[d]", `a\*b\?c\[d]`},
+		{`back\slash`, `back\\slash`},
+	} {
+		got := escapeGlob(test.name)
+		if got != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.name, test.expected, got)
+		}
+		if ok, err := path.Match(got+"*", test.name+".out"); err != nil || !ok {
+			t.Errorf("%q: expected %q to match %q.out: %v", test.name, got+"*", test.name, err)
+		}
+	}
+}
+
+// lineWriter passes each line written to it to a channel, and fails once
+// closed so that followers stop.
+type lineWriter struct {
+	lines  chan string
+	closed chan struct{}
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	select {
+	case <-l.closed:
+		return 0, io.ErrClosedPipe
+	case l.lines <- string(p):
+		return len(p), nil
+	}
+}
+
+func TestFollowFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sshd.log")
+	if err := ioutil.WriteFile(path, []byte("first\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &lineWriter{lines: make(chan string), closed: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		done <- followFile(w, file)
+	}()
+	expect := func(expected string) {
+		select {
+		case got := <-w.lines:
+			if got != expected {
+				t.Errorf("expected %q, got %q", expected, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+	appendTo := func(path, s string) {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(s)
+		f.Close()
+	}
+
+	expect("first\n")
+	// partial lines are held back until they are complete
+	appendTo(path, "sec")
+	time.Sleep(2 * followInterval)
+	appendTo(path, "ond\n")
+	expect("second\n")
+	// the rest of a rotated file is copied before the new one
+	appendTo(path, "third\n")
+	if err := rotateLogFile(path, 1); err != nil {
+		t.Fatal(err)
+	}
+	appendTo(path, "fourth\n")
+	expect("third\n")
+	expect("fourth\n")
+
+	close(w.closed)
+	appendTo(path, "fifth\n")
+	if err := <-done; err != io.ErrClosedPipe {
+		t.Errorf("expected the follower to stop with %v, got %v", io.ErrClosedPipe, err)
+	}
+}
+
+func TestDumpFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// modified a second apart, in this order
+	writeLogDir(t, dir, [][2]string{
+		{"sshd.out.log", "out 1\nout 2\nout 3\n"},
+		{"sshd.log", "err 1\nerr 2\n"},
+		{"dhcpcd.log", "other\n"},
+		{"sshd.events.log", "lifecycle event=started\n"},
+	})
+	l := &fileLog{dir: dir}
+	start := time.Date(2018, 7, 8, 9, 16, 53, 0, time.UTC)
+
+	for _, test := range []struct {
+		opts     logsOptions
+		expected string
+	}{
+		{logsOptions{tail: -1}, "out 1\nout 2\nout 3\nerr 1\nerr 2\nlifecycle event=started\n"},
+		// the tail is taken from each file
+		{logsOptions{tail: 1}, "out 3\nerr 2\nlifecycle event=started\n"},
+		{logsOptions{tail: 0}, ""},
+		// files are selected by modification time
+		{logsOptions{tail: -1, since: start.Add(500 * time.Millisecond)}, "err 1\nerr 2\nlifecycle event=started\n"},
+		{logsOptions{tail: -1, since: start.Add(time.Hour)}, ""},
+	} {
+		var b bytes.Buffer
+		if err := l.logs(&b, "sshd", test.opts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.expected {
+			t.Errorf("%+v: expected %q, got %q", test.opts, test.expected, b.String())
+		}
+	}
+}
+
+func TestDumpFilesFollow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeLogDir(t, dir, [][2]string{
+		{"sshd.out.log", "out 1\nout 2\n"},
+		{"sshd.log", "err 1\n"},
+	})
+	l := &fileLog{dir: dir}
+	w := &lineWriter{lines: make(chan string), closed: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		done <- l.logs(w, "sshd", logsOptions{tail: 1, follow: true})
+	}()
+
+	expect := func(expected string) {
+		select {
+		case got := <-w.lines:
+			if got != expected {
+				t.Errorf("expected %q, got %q", expected, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+	appendTo := func(name, s string) {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(s)
+		f.Close()
+	}
+
+	// the tail of each file, then the lines written after it
+	expect("out 2\n")
+	expect("err 1\n")
+	appendTo("sshd.log", "err 2\n")
+	expect("err 2\n")
+
+	// following stops once every follower has failed
+	close(w.closed)
+	appendTo("sshd.out.log", "out 3\n")
+	appendTo("sshd.log", "err 3\n")
+	select {
+	case err := <-done:
+		if err != io.ErrClosedPipe {
+			t.Errorf("expected following to stop with %v, got %v", io.ErrClosedPipe, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for following to stop")
+	}
+}
+
+// newTestQueryMemlogd starts a simulated memlogd serving queries on socket,
+// with messages logged a second apart from start.
+func newTestQueryMemlogd(t *testing.T, socket string, start time.Time, version int) *memlogdtest.Server {
+	s := memlogdtest.NewServer()
+	s.Version = version
+	next := start
+	s.Now = func() time.Time {
+		now := next
+		next = next.Add(time.Second)
+		return now
+	}
+	if err := s.ListenQuery(socket); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRemoteLogLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Date(2018, 7, 8, 9, 16, 53, 0, time.UTC)
+	messages := [][2]string{
+		{"sshd", "first"},
+		{"sshd.out", "second"},
+		{"sshd.events", "lifecycle event=started service=sshd"},
+		// matched by the glob sent to memlogd, but not a log of sshd
+		{"sshdx", "other"},
+		{"dhcpcd", "not sshd"},
+		{"sshd", "third"},
+	}
+
+	for _, version := range []int{memlogdtest.ProtocolVersion, memlogdtest.NoHello} {
+		socket := filepath.Join(dir, fmt.Sprintf("%d.sock", version))
+		s := newTestQueryMemlogd(t, socket, start, version)
+		for _, m := range messages {
+			s.Log(m[0], m[1])
+		}
+		// a memlogd which predates the handshake sends every message in
+		// the original format, and service logs selects them itself
+		line := func(i int) string {
+			e := s.Entries()[i]
+			if version == memlogdtest.NoHello {
+				return fmt.Sprintf("%s,%s;%s\n", e.Time.Format(time.RFC3339), e.Source, e.Msg)
+			}
+			return e.String() + "\n"
+		}
+		r := &remoteLog{readSocket: socket}
+
+		for _, test := range []struct {
+			opts     logsOptions
+			expected []int // indexes of the messages
+		}{
+			{logsOptions{tail: -1}, []int{0, 1, 2, 5}},
+			{logsOptions{tail: 2}, []int{2, 5}},
+			{logsOptions{tail: 0}, nil},
+			{logsOptions{tail: -1, since: start.Add(2 * time.Second)}, []int{2, 5}},
+			{logsOptions{tail: -1, since: start.Add(time.Hour)}, nil},
+		} {
+			var expected string
+			for _, i := range test.expected {
+				expected += line(i)
+			}
+			var b bytes.Buffer
+			if err := r.logs(&b, "sshd", test.opts); err != nil {
+				t.Fatalf("version %d %+v: %v", version, test.opts, err)
+			}
+			if b.String() != expected {
+				t.Errorf("version %d %+v: expected %q, got %q", version, test.opts, expected, b.String())
+			}
+		}
+
+		var b bytes.Buffer
+		if err := r.DumpAll(&b, logsOptions{tail: -1}); err != nil {
+			t.Fatal(err)
+		}
+		var expected string
+		for i := range messages {
+			expected += line(i)
+		}
+		if b.String() != expected {
+			t.Errorf("version %d: expected all the logs %q, got %q", version, expected, b.String())
+		}
+		s.Close()
+	}
+
+	r := &remoteLog{readSocket: filepath.Join(dir, "missing.sock")}
+	if err := r.logs(ioutil.Discard, "sshd", logsOptions{tail: -1}); err == nil {
+		t.Errorf("expected an error when memlogd is not running")
+	}
+}
+
+func TestRemoteLogFollow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "memlogdq.sock")
+	s := newTestQueryMemlogd(t, socket, time.Date(2018, 7, 8, 9, 16, 53, 0, time.UTC), memlogdtest.ProtocolVersion)
+	s.Instance = "TestRemoteLogFollow"
+	s.Log("sshd", "first")
+	s.Log("sshd", "second")
+	r := &remoteLog{readSocket: socket}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- r.logs(pw, "sshd", logsOptions{tail: 1, follow: true})
+		pw.Close()
+	}()
+	lines := bufio.NewReader(pr)
+	next := func() string {
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+	// the tail of the dump, then new messages of sshd, resuming after
+	// the dump so that none are missed or repeated
+	if line := next(); !strings.HasSuffix(line, ",sshd,2;second\n") {
+		t.Errorf("expected the last message, got %q", line)
+	}
+	s.Log("dhcpcd", "not sshd")
+	s.Log("sshd.out", "third")
+	if line := next(); !strings.HasSuffix(line, ",sshd.out,4;third\n") {
+		t.Errorf("expected the next message of sshd, got %q", line)
+	}
+	s.Log("sshd", "fourth")
+	if line := next(); !strings.HasSuffix(line, ",sshd,5;fourth\n") {
+		t.Errorf("expected the next message of sshd, got %q", line)
+	}
+	// following ends when memlogd goes away
+	s.Close()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
@@ -46,6 +46,14 @@ func main() {
 		fmt.Printf("  stop        Stop a service\n")
 		fmt.Printf("  start       Start a service\n")
 		fmt.Printf("  restart     Restart a service\n")
+		fmt.Printf("  update      Update a service to a new image and restart it\n")
+		fmt.Printf("  shutdown    Stop services gracefully at poweroff\n")
+		fmt.Printf("  status      Print the state of a service\n")
+		fmt.Printf("  list        Print the state of all services\n")
+		fmt.Printf("  limits      Print or change the resource limits of a service\n")
+		fmt.Printf("  logs        Print the logs of a service\n")
+		fmt.Printf("  dump        Print the logs of all services\n")
+		fmt.Printf("  monitor     Record exits of services in their logs\n")
 		fmt.Printf("  help        Print this message\n")
 		fmt.Printf("\n")
 		fmt.Printf("Run '%s COMMAND --help' for more information on the command\n", filepath.Base(os.Args[0]))
@@ -85,12 +93,15 @@ func main() {
 		command := os.Args[0]
 		switch {
 		case strings.Contains(command, "onboot"):
-			os.Exit(runcInit(onbootPath, "onboot"))
+			startSelfLogging()
+			exit(runcInit(onbootPath, "onboot"))
 		case strings.Contains(command, "onshutdown"):
-			os.Exit(runcInit(shutdownPath, "shutdown"))
+			startSelfLogging()
+			exit(runcInit(shutdownPath, "shutdown"))
 		case strings.Contains(command, "containerd"):
+			startSelfLogging()
 			systemInitCmd(ctx, []string{})
-			os.Exit(0)
+			exit(0)
 		}
 	}
 
@@ -99,6 +110,11 @@ func main() {
 		os.Exit(1)
 	}
 
+	switch args[0] {
+	case "stop", "start", "restart", "update", "shutdown", "system-init", "monitor":
+		startSelfLogging()
+	}
+
 	switch args[0] {
 	case "stop":
 		stopCmd(ctx, args[1:])
@@ -106,11 +122,41 @@ func main() {
 		startCmd(ctx, args[1:])
 	case "restart":
 		restartCmd(ctx, args[1:])
+	case "update":
+		updateCmd(ctx, args[1:])
+	case "shutdown":
+		shutdownCmd(ctx, args[1:])
 	case "system-init":
 		systemInitCmd(ctx, args[1:])
+	case "dump":
+		dumpCmd(ctx, args[1:])
+	case "logs":
+		logsCmd(ctx, args[1:])
+	case "status":
+		statusCmd(ctx, args[1:])
+	case "list":
+		listCmd(ctx, args[1:])
+	case "limits":
+		limitsCmd(ctx, args[1:])
+	case "monitor":
+		monitorCmd(ctx, args[1:])
 	default:
 		fmt.Printf("%q is not valid command.\n\n", args[0])
 		flag.Usage()
 		os.Exit(1)
 	}
+	flushLogs()
+}
+
+// exit waits for logs to be handed over to the logger before exiting.
+func exit(code int) {
+	flushLogs()
+	os.Exit(code)
+}
+
+func flushLogs() {
+	stopSelfLogging()
+	if err := GetLog(varLogDir).Flush(); err != nil {
+		log.Printf("Failed to flush logs: %v", err)
+	}
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultMetricsAddress is where "service monitor" serves the metrics of
+// the services, so that they are only visible on the host.
+const defaultMetricsAddress = "/run/service/metrics.sock"
+
+// serviceMetrics are the metrics of a service.
+type serviceMetrics struct {
+	name     string
+	running  bool
+	restarts int
+	cpu      float64 // seconds, or -1 if not known
+	memory   int64   // bytes, or -1 if not known
+}
+
+// cpuUsage returns the CPU time used by the cgroup at cgroupsPath, in
+// seconds, or -1 if it can't be read.
+func cpuUsage(cgroupsPath string) float64 {
+	// cgroup v1 counts nanoseconds
+	if b, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cpuacct", cgroupsPath, "cpuacct.usage")); err == nil {
+		if ns, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil {
+			return float64(ns) / 1e9
+		}
+	}
+	// cgroup v2 counts microseconds
+	b, err := ioutil.ReadFile(filepath.Join(cgroupRoot, cgroupsPath, "cpu.stat"))
+	if err != nil {
+		return -1
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			if us, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				return float64(us) / 1e6
+			}
+		}
+	}
+	return -1
+}
+
+// memoryUsage returns the memory used by the cgroup at cgroupsPath, in
+// bytes, or -1 if it can't be read.
+func memoryUsage(cgroupsPath string) int64 {
+	s := readLimit(cgroupsPath, cgroupLimit{"memory-usage", "memory", "memory.usage_in_bytes", "memory.current"})
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// getMetrics returns the metrics of the services in basePath.
+func getMetrics(ctx context.Context, client *containerd.Client, basePath string) []*serviceMetrics {
+	services, err := serviceNames(basePath)
+	if err != nil {
+		return nil
+	}
+	var metrics []*serviceMetrics
+	for _, service := range services {
+		s, err := getStatus(ctx, client, basePath, service)
+		if err != nil {
+			log.WithError(err).Errorf("getting status of %s", service)
+			continue
+		}
+		m := &serviceMetrics{name: service, restarts: s.Restarts, cpu: -1, memory: -1}
+		if s.Status == "running" {
+			m.running = true
+			if cgroupsPath := specCgroupsPath(filepath.Join(basePath, service)); cgroupsPath != "" {
+				m.cpu = cpuUsage(cgroupsPath)
+				m.memory = memoryUsage(cgroupsPath)
+			}
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// writeMetrics writes metrics in the Prometheus text exposition format.
+// CPU and memory are only written for running services whose cgroup could
+// be read.
+func writeMetrics(b *strings.Builder, metrics []*serviceMetrics) {
+	fmt.Fprintf(b, "# HELP service_up Whether the service is running.\n")
+	fmt.Fprintf(b, "# TYPE service_up gauge\n")
+	for _, m := range metrics {
+		up := 0
+		if m.running {
+			up = 1
+		}
+		fmt.Fprintf(b, "service_up{service=%q} %d\n", m.name, up)
+	}
+	fmt.Fprintf(b, "# HELP service_restarts_total Times the service has been restarted by its restart policy.\n")
+	fmt.Fprintf(b, "# TYPE service_restarts_total counter\n")
+	for _, m := range metrics {
+		fmt.Fprintf(b, "service_restarts_total{service=%q} %d\n", m.name, m.restarts)
+	}
+	fmt.Fprintf(b, "# HELP service_cpu_seconds_total CPU time used by the service since it started.\n")
+	fmt.Fprintf(b, "# TYPE service_cpu_seconds_total counter\n")
+	for _, m := range metrics {
+		if m.cpu >= 0 {
+			fmt.Fprintf(b, "service_cpu_seconds_total{service=%q} %g\n", m.name, m.cpu)
+		}
+	}
+	fmt.Fprintf(b, "# HELP service_memory_bytes Memory used by the service.\n")
+	fmt.Fprintf(b, "# TYPE service_memory_bytes gauge\n")
+	for _, m := range metrics {
+		if m.memory >= 0 {
+			fmt.Fprintf(b, "service_memory_bytes{service=%q} %d\n", m.name, m.memory)
+		}
+	}
+}
+
+// serveMetrics serves the metrics of the services in basePath over HTTP at
+// /metrics. addr is either the path of a unix domain socket or a TCP
+// host:port.
+func serveMetrics(ctx context.Context, client *containerd.Client, basePath, addr string) error {
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+		if err := os.MkdirAll(filepath.Dir(addr), 0755); err != nil {
+			return err
+		}
+		_ = os.Remove(addr)
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var b strings.Builder
+		writeMetrics(&b, getMetrics(ctx, client, basePath))
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte(b.String()))
+	})
+	go func() {
+		_ = http.Serve(l, mux)
+	}()
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	var b strings.Builder
+	writeMetrics(&b, []*serviceMetrics{
+		{name: "sshd", running: true, restarts: 2, cpu: 1.5, memory: 4096},
+		// cpu and memory are left out if they are not known
+		{name: "dhcpcd", running: true, cpu: -1, memory: -1},
+		{name: "format", cpu: -1, memory: -1},
+	})
+	expected := `# HELP service_up Whether the service is running.
+# TYPE service_up gauge
+service_up{service="sshd"} 1
+service_up{service="dhcpcd"} 1
+service_up{service="format"} 0
+# HELP service_restarts_total Times the service has been restarted by its restart policy.
+# TYPE service_restarts_total counter
+service_restarts_total{service="sshd"} 2
+service_restarts_total{service="dhcpcd"} 0
+service_restarts_total{service="format"} 0
+# HELP service_cpu_seconds_total CPU time used by the service since it started.
+# TYPE service_cpu_seconds_total counter
+service_cpu_seconds_total{service="sshd"} 1.5
+# HELP service_memory_bytes Memory used by the service.
+# TYPE service_memory_bytes gauge
+service_memory_bytes{service="sshd"} 4096
+`
+	if b.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+func TestCgroupUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(root string) { cgroupRoot = root }(cgroupRoot)
+	cgroupRoot = dir
+
+	for _, test := range []struct {
+		files  map[string]string
+		cpu    float64
+		memory int64
+	}{
+		// cgroup v1
+		{map[string]string{
+			"cpuacct/services/sshd/cpuacct.usage":        "1500000000\n",
+			"memory/services/sshd/memory.usage_in_bytes": "4096\n",
+		}, 1.5, 4096},
+		// cgroup v2
+		{map[string]string{
+			"services/sshd/cpu.stat":       "usage_usec 2500000\nuser_usec 2000000\nsystem_usec 500000\n",
+			"services/sshd/memory.current": "8192\n",
+		}, 2.5, 8192},
+		{nil, -1, -1},
+		{map[string]string{
+			"services/sshd/cpu.stat":       "user_usec 2000000\n",
+			"services/sshd/memory.current": "max\n",
+		}, -1, -1},
+		{map[string]string{
+			"cpuacct/services/sshd/cpuacct.usage": "lots\n",
+			"services/sshd/cpu.stat":              "usage_usec 1000000\n",
+		}, 1, -1},
+	} {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+		for name, contents := range test.files {
+			path := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if cpu := cpuUsage("/services/sshd"); cpu != test.cpu {
+			t.Errorf("%v: expected cpu %g, got %g", test.files, test.cpu, cpu)
+		}
+		if memory := memoryUsage("/services/sshd"); memory != test.memory {
+			t.Errorf("%v: expected memory %d, got %d", test.files, test.memory, memory)
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "run", "metrics.sock")
+	// with no services containerd is not asked
+	if err := serveMetrics(context.Background(), nil, filepath.Join(dir, "services"), socket); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(string, string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://localhost/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("expected the Prometheus text format, got %q", ct)
+	}
+	var expected strings.Builder
+	writeMetrics(&expected, nil)
+	if string(b) != expected.String() {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected.String(), b)
+	}
+}
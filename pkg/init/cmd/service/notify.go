@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Services which support the sd_notify protocol can tell "service monitor"
+// when they are ready, and prove that they are still alive, by sending
+// datagrams such as "READY=1" to the socket named by $NOTIFY_SOCKET.
+const (
+	// notifyAnnotation set to "true" on a service's OCI spec gives it a
+	// notify socket. The service is then only ready once it sends READY=1.
+	notifyAnnotation = "org.mobyproject.notify"
+
+	// watchdogAnnotation sets how often a service must send WATCHDOG=1,
+	// passed to it as $WATCHDOG_USEC. A service which misses it is killed.
+	watchdogAnnotation = notifyAnnotation + ".watchdog"
+
+	// notifyDir holds a directory per service containing its socket,
+	// which is bound into the container at notifyMountPoint.
+	notifyDir        = "/run/service/notify"
+	notifyMountPoint = "/run/notify"
+	notifySocketName = "notify.sock"
+
+	// notifySocketTimeout is how long start waits for "service monitor"
+	// to create the socket of a service.
+	notifySocketTimeout = 5 * time.Second
+)
+
+// notifyState is what a service has sent to its notify socket.
+type notifyState struct {
+	Ready     time.Time `json:"ready,omitempty"`     // the last READY=1
+	Reloading bool      `json:"reloading,omitempty"` // RELOADING=1 since then
+	Stopping  bool      `json:"stopping,omitempty"`
+	Watchdog  time.Time `json:"watchdog,omitempty"` // the last WATCHDOG=1
+	Status    string    `json:"status,omitempty"`   // the last STATUS=
+}
+
+func notifyEnabled(annotations map[string]string) bool {
+	return annotations[notifyAnnotation] == "true"
+}
+
+// watchdogFor returns the watchdog timeout of a service, or 0 if it has
+// none. Invalid timeouts are reported and ignored.
+func watchdogFor(service string, annotations map[string]string) time.Duration {
+	s := annotations[watchdogAnnotation]
+	if s == "" || !notifyEnabled(annotations) {
+		return 0
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		log.Printf("Ignoring watchdog of %s: invalid duration %q", service, s)
+		return 0
+	}
+	return d
+}
+
+func notifySocket(service string) string {
+	return filepath.Join(notifyDir, service, notifySocketName)
+}
+
+// withNotify gives a service its notify socket, waiting for "service
+// monitor" to create it.
+func withNotify(spec *specs.Spec, service string) {
+	socket := notifySocket(service)
+	// the directory must exist for the bind mount, even without a socket
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		log.Printf("Failed to create notify socket directory for %s: %v", service, err)
+	}
+	for deadline := time.Now().Add(notifySocketTimeout); ; {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("No notify socket for %s: is service monitor running?", service)
+			break
+		}
+		time.Sleep(readyInterval)
+	}
+	spec.Mounts = append(spec.Mounts, specs.Mount{
+		Destination: notifyMountPoint,
+		Type:        "bind",
+		Source:      filepath.Dir(socket),
+		Options:     []string{"rbind", "rw"},
+	})
+	if spec.Process == nil {
+		return
+	}
+	spec.Process.Env = append(spec.Process.Env, "NOTIFY_SOCKET="+filepath.Join(notifyMountPoint, notifySocketName))
+	if d := watchdogFor(service, spec.Annotations); d != 0 {
+		spec.Process.Env = append(spec.Process.Env, "WATCHDOG_USEC="+strconv.FormatInt(int64(d/time.Microsecond), 10))
+	}
+}
+
+// listenNotify creates the notify sockets of the services in basePath
+// which want one, and records what they are sent.
+func listenNotify(basePath string) {
+	services, err := serviceNames(basePath)
+	if err != nil {
+		return
+	}
+	for _, service := range services {
+		if !notifyEnabled(bundleAnnotations(filepath.Join(basePath, service))) {
+			continue
+		}
+		socket := notifySocket(service)
+		if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+			log.Printf("Failed to create notify socket for %s: %v", service, err)
+			continue
+		}
+		_ = os.Remove(socket)
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+		if err != nil {
+			log.Printf("Failed to create notify socket for %s: %v", service, err)
+			continue
+		}
+		// services may run as any user
+		_ = os.Chmod(socket, 0777)
+		go readNotify(service, conn)
+	}
+}
+
+// readNotify records the messages sent to the notify socket of a service.
+func readNotify(service string, conn *net.UnixConn) {
+	b := make([]byte, 4096)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			log.Printf("Failed to read notify socket of %s: %v", service, err)
+			return
+		}
+		now := time.Now().UTC()
+		updateState(service, func(s *monitorState) {
+			if s.Notify == nil {
+				s.Notify = &notifyState{}
+			}
+			s.Notify.update(string(b[:n]), now)
+		})
+	}
+}
+
+// update applies a message sent to the notify socket at now. Unknown
+// variables are ignored, as sd_notify allows.
+func (n *notifyState) update(msg string, now time.Time) {
+	for _, line := range strings.Split(msg, "\n") {
+		bits := strings.SplitN(line, "=", 2)
+		if len(bits) != 2 {
+			continue
+		}
+		switch bits[0] {
+		case "READY":
+			if bits[1] == "1" {
+				n.Ready, n.Reloading, n.Stopping = now, false, false
+			}
+		case "RELOADING":
+			n.Reloading = bits[1] == "1"
+		case "STOPPING":
+			n.Stopping = bits[1] == "1"
+		case "WATCHDOG":
+			if bits[1] == "1" {
+				n.Watchdog = now
+			}
+		case "STATUS":
+			n.Status = bits[1]
+		}
+	}
+}
+
+// notifiedReady returns true if the task of a service has said it is
+// ready. Messages sent before the task started are from an earlier task.
+func notifiedReady(service string, task containerd.Task) bool {
+	n := readState(service).Notify
+	if n == nil || n.Ready.IsZero() || n.Reloading || n.Stopping {
+		return false
+	}
+	return !n.Ready.Before(processStartTime(task.Pid()))
+}
+
+// watchWatchdog kills a task which does not send WATCHDOG=1, or READY=1,
+// at least every timeout, until exited is closed.
+func watchWatchdog(ctx context.Context, ctr containerd.Container, task containerd.Task, timeout time.Duration, exited <-chan struct{}, logger Log) {
+	service := ctr.ID()
+	started := processStartTime(task.Pid())
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exited:
+			return
+		case <-ticker.C:
+		}
+		last := started
+		if n := readState(service).Notify; n != nil {
+			for _, t := range []time.Time{n.Ready, n.Watchdog} {
+				if t.After(last) {
+					last = t
+				}
+			}
+		}
+		if time.Since(last) < timeout {
+			continue
+		}
+		recordEvent(logger, &lifecycleEvent{event: eventWatchdog, service: service, pid: task.Pid(), exitCode: -1})
+		log.Infof("Killing service %q which missed its watchdog", service)
+		if err := task.Kill(ctx, syscall.SIGKILL); err != nil {
+			log.WithError(err).Errorf("killing %s", service)
+		}
+		return
+	}
+}
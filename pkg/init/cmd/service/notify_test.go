@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdogFor(t *testing.T) {
+	for _, test := range []struct {
+		annotations map[string]string
+		expected    time.Duration
+		reported    bool
+	}{
+		{nil, 0, false},
+		{map[string]string{notifyAnnotation: "true"}, 0, false},
+		{map[string]string{notifyAnnotation: "true", watchdogAnnotation: "30s"}, 30 * time.Second, false},
+		// the watchdog needs the notify socket
+		{map[string]string{watchdogAnnotation: "30s"}, 0, false},
+		// invalid values are reported and ignored
+		{map[string]string{notifyAnnotation: "true", watchdogAnnotation: "soon"}, 0, true},
+		{map[string]string{notifyAnnotation: "true", watchdogAnnotation: "0s"}, 0, true},
+	} {
+		var d time.Duration
+		out := captureLog(func() {
+			d = watchdogFor("test", test.annotations)
+		})
+		if d != test.expected {
+			t.Errorf("%v: expected %s, got %s", test.annotations, test.expected, d)
+		}
+		if reported := strings.Contains(out, "Ignoring watchdog of test"); reported != test.reported {
+			t.Errorf("%v: expected reported %t, got %q", test.annotations, test.reported, out)
+		}
+	}
+}
+
+func TestNotifyEnabled(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected bool
+	}{
+		{"", false},
+		{"false", false},
+		{"yes", false},
+		{"true", true},
+	} {
+		if enabled := notifyEnabled(map[string]string{notifyAnnotation: test.value}); enabled != test.expected {
+			t.Errorf("%q: expected %v", test.value, test.expected)
+		}
+	}
+}
+
+func TestNotifyStateUpdate(t *testing.T) {
+	earlier := time.Date(2018, 7, 8, 9, 16, 53, 0, time.UTC)
+	now := earlier.Add(time.Minute)
+	for _, test := range []struct {
+		state    notifyState
+		msg      string
+		expected notifyState
+	}{
+		{notifyState{}, "READY=1", notifyState{Ready: now}},
+		{notifyState{}, "READY=1\nSTATUS=Listening on port 22", notifyState{Ready: now, Status: "Listening on port 22"}},
+		// READY=1 ends a reload
+		{notifyState{Ready: earlier, Reloading: true}, "READY=1", notifyState{Ready: now}},
+		{notifyState{Ready: earlier}, "RELOADING=1", notifyState{Ready: earlier, Reloading: true}},
+		{notifyState{Ready: earlier}, "STOPPING=1", notifyState{Ready: earlier, Stopping: true}},
+		{notifyState{Ready: earlier}, "WATCHDOG=1", notifyState{Ready: earlier, Watchdog: now}},
+		{notifyState{Status: "starting"}, "STATUS=", notifyState{}},
+		// only the values which mean something to us are used
+		{notifyState{Ready: earlier}, "READY=0\nWATCHDOG=trigger", notifyState{Ready: earlier}},
+		// unknown variables and lines are ignored
+		{notifyState{Ready: earlier}, "MAINPID=42\nERRNO=2\ngarbage\n", notifyState{Ready: earlier}},
+	} {
+		state := test.state
+		state.update(test.msg, now)
+		if state != test.expected {
+			t.Errorf("%+v %q: expected %+v, got %+v", test.state, test.msg, test.expected, state)
+		}
+	}
+}
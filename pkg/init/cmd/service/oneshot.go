@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// oneshotAnnotation set to "true" on a service's OCI spec makes it a
+// oneshot service, which runs to completion like an onboot step. It is
+// ready once it has exited successfully, and services which depend on it
+// are only started if it does.
+const oneshotAnnotation = "org.mobyproject.oneshot"
+
+// completionState is how the last run of a oneshot service ended.
+type completionState struct {
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished"`
+	ExitCode uint32    `json:"exit_code"`
+}
+
+func oneshotEnabled(annotations map[string]string) bool {
+	return annotations[oneshotAnnotation] == "true"
+}
+
+// oneshotFailedError is returned when waiting for a oneshot service which
+// exited unsuccessfully.
+type oneshotFailedError struct {
+	service  string
+	exitCode uint32
+}
+
+func (e *oneshotFailedError) Error() string {
+	return fmt.Sprintf("%s exited with status %d", e.service, e.exitCode)
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestOneshotEnabled(t *testing.T) {
+	for _, test := range []struct {
+		annotations map[string]string
+		expected    bool
+	}{
+		{nil, false},
+		{map[string]string{oneshotAnnotation: "false"}, false},
+		{map[string]string{oneshotAnnotation: "true"}, true},
+	} {
+		if enabled := oneshotEnabled(test.annotations); enabled != test.expected {
+			t.Errorf("%v: expected %v", test.annotations, test.expected)
+		}
+	}
+}
+
+func TestOneshotFailedError(t *testing.T) {
+	err := &oneshotFailedError{service: "format", exitCode: 2}
+	if expected := "format exited with status 2"; err.Error() != expected {
+		t.Errorf("Expected %q, got %q", expected, err.Error())
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// loggingPersistAnnotation asks for the output of a service to be
+// appended to files in a directory on disk as well as sent to the log
+// driver, so that it is not lost if memlogd evicts it before logwrite
+// writes it out.
+const loggingPersistAnnotation = loggingAnnotationPrefix + "persist"
+
+// teeLog sends output both to a Log and to files on disk.
+type teeLog struct {
+	Log
+	disk    *fileLog
+	fifoDir string
+	relay   logRelay
+}
+
+// newTeeLog returns a Log which also writes to files in dir, or l if dir
+// is not writable, for example because there is no disk.
+func newTeeLog(l Log, service, dir string) Log {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Not persisting the logs of %s: %v", service, err)
+		return l
+	}
+	if err := syscall.Access(dir, 2 /* W_OK */); err != nil {
+		log.Printf("Not persisting the logs of %s: %s is not writable: %v", service, dir, err)
+		return l
+	}
+	return &teeLog{
+		Log:     l,
+		disk:    &fileLog{dir: dir, maxSize: defaultMaxLogSize, maxFiles: defaultMaxLogFiles},
+		fifoDir: "/var/run",
+	}
+}
+
+func (t *teeLog) fifoPath(n string) string {
+	return filepath.Join(t.fifoDir, n+".persist.log")
+}
+
+// Path returns the name of a FIFO which is copied to both destinations.
+func (t *teeLog) Path(n string) string {
+	path := t.fifoPath(n)
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		log.Printf("Not persisting log %s: %v", n, err)
+		return t.Log.Path(n)
+	}
+	relayFIFO(t, t.relay, n, path)
+	return path
+}
+
+// Open returns a stream which is copied to both destinations.
+func (t *teeLog) Open(n string) (io.WriteCloser, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	pendingLogs.Add(1)
+	go func() {
+		defer pendingLogs.Done()
+		t.copy(n, r)
+	}()
+	return w, nil
+}
+
+// copy copies r to both destinations until it is closed. If one fails the
+// other still receives everything.
+func (t *teeLog) copy(n string, r io.ReadCloser) {
+	defer r.Close()
+	var writers []io.WriteCloser
+	for _, l := range []Log{t.Log, t.disk} {
+		w, err := l.Open(n)
+		if err != nil {
+			log.Printf("Failed to open log %s: %v", n, err)
+			continue
+		}
+		defer w.Close()
+		writers = append(writers, w)
+	}
+	b := make([]byte, 4096)
+	for {
+		count, err := r.Read(b)
+		for i, w := range writers {
+			if w == nil {
+				continue
+			}
+			if _, err := w.Write(b[:count]); err != nil {
+				log.Printf("Failed to write log %s: %v", n, err)
+				writers[i] = nil
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Close removes the FIFO created by Path.
+func (t *teeLog) Close(n string) error {
+	if err := removeFifo(t.fifoPath(n)); err != nil {
+		return err
+	}
+	return t.Log.Close(n)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readOnlyLog is a Log whose streams fail to write.
+type readOnlyLog struct {
+	nullLog
+}
+
+func (r *readOnlyLog) Open(string) (io.WriteCloser, error) {
+	return os.Open(os.DevNull)
+}
+
+// waitForFile waits for the file at path to hold expected.
+func waitForFile(t *testing.T, path, expected string) {
+	var b []byte
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if b, _ = ioutil.ReadFile(path); string(b) == expected {
+			return
+		}
+	}
+	t.Errorf("%s: expected %q, got %q", path, expected, b)
+}
+
+func TestTeeLogOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logDir := filepath.Join(dir, "log")
+	persist := filepath.Join(dir, "persist")
+	if err := os.Mkdir(logDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		l        Log
+		expected string // in the log, as well as persisted
+	}{
+		{&fileLog{dir: logDir, maxSize: defaultMaxLogSize, maxFiles: defaultMaxLogFiles}, "hello\n"},
+		// if one destination fails the other still gets everything
+		{&readOnlyLog{}, ""},
+	} {
+		os.RemoveAll(persist)
+		l := newTeeLog(test.l, "sshd", persist)
+		if _, ok := l.(*teeLog); !ok {
+			t.Fatalf("expected a teeLog, got %T", l)
+		}
+		w, err := l.Open("sshd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, "hello\n")
+		w.Close()
+		waitForLogs()
+		waitForFile(t, filepath.Join(persist, "sshd.log"), "hello\n")
+		if test.expected != "" {
+			waitForFile(t, filepath.Join(logDir, "sshd.log"), test.expected)
+		}
+	}
+}
+
+func TestTeeLogNotWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := &nullLog{}
+	if got := newTeeLog(l, "sshd", filepath.Join(file, "persist")); got != l {
+		t.Errorf("expected the log to be used alone, got %T", got)
+	}
+}
+
+func TestTeeLogPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logDir := filepath.Join(dir, "log")
+	persist := filepath.Join(dir, "persist")
+	if err := os.Mkdir(logDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// copy the FIFO here rather than asking service monitor to
+	inMonitor = true
+	defer func() { inMonitor = false }()
+
+	l := newTeeLog(&fileLog{dir: logDir, maxSize: defaultMaxLogSize, maxFiles: defaultMaxLogFiles}, "sshd", persist)
+	tee := l.(*teeLog)
+	tee.fifoDir = dir
+	path := l.Path("sshd.out")
+	if path != filepath.Join(dir, "sshd.out.persist.log") {
+		t.Fatalf("expected a FIFO in %s, got %s", dir, path)
+	}
+	w, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "hello\n")
+	w.Close()
+	waitForFile(t, filepath.Join(persist, "sshd.out.log"), "hello\n")
+	waitForFile(t, filepath.Join(logDir, "sshd.out.log"), "hello\n")
+
+	if err := l.Close("sshd.out"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("expected FIFO to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Log drivers which copy the output of a service to its destination
+// themselves, rather than handing it to memlogd, read it from a FIFO. The
+// copy must outlive "service start" and system-init, which exit once the
+// services have started, so it is made by "service monitor" instead.
+const relaySocket = "/run/service/relay.sock"
+
+// relaySocketTimeout is how long startMonitor waits for the relay socket.
+const relaySocketTimeout = 5 * time.Second
+
+// logCopier is a Log which copies output to its destination itself.
+type logCopier interface {
+	copy(n string, r io.ReadCloser)
+}
+
+// logRelay is what "service monitor" needs to create the same Log as
+// GetServiceLog did for a service.
+type logRelay struct {
+	service     string
+	annotations map[string]string
+}
+
+// relayRequest asks "service monitor" to copy a FIFO to a log.
+type relayRequest struct {
+	Log         string            `json:"log"`
+	FIFO        string            `json:"fifo"`
+	Service     string            `json:"service"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// inMonitor is set in "service monitor", which copies FIFOs itself.
+var inMonitor bool
+
+// relayFIFO has the FIFO at path, log n, copied by "service monitor", or
+// by c in this process if it is not running.
+func relayFIFO(c logCopier, r logRelay, n, path string) {
+	if inMonitor {
+		go copyFIFO(c, n, path)
+		return
+	}
+	if r.service == "" {
+		r.service = metadataFor(n).Service
+	}
+	if err := sendRelay(&relayRequest{Log: n, FIFO: path, Service: r.service, Annotations: r.annotations}); err != nil {
+		log.Printf("service monitor is not running: %s is only logged while this process runs: %v", n, err)
+		go copyFIFO(c, n, path)
+	}
+}
+
+func sendRelay(req *relayRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: relaySocket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(b)
+	return err
+}
+
+// copyFIFO copies the FIFO at path to log n until the writer closes it.
+func copyFIFO(c logCopier, n, path string) {
+	// Open of the FIFO blocks until containerd opens it when the task is
+	// started.
+	f, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		log.Printf("failed to open fifo %s: %s", path, err)
+		return
+	}
+	if fi, err := f.Stat(); err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+		log.Printf("Not logging %s: %s is not a FIFO", n, path)
+		f.Close()
+		return
+	}
+	c.copy(n, f)
+}
+
+// copierFor returns the logCopier which l uses, if any.
+func copierFor(l Log) logCopier {
+	switch l := l.(type) {
+	case *discardLog:
+		return copierFor(l.Log)
+	case logCopier:
+		return l
+	}
+	return nil
+}
+
+// listenRelay copies the FIFOs which "service start" asks us to.
+func listenRelay() {
+	if err := os.MkdirAll(filepath.Dir(relaySocket), 0755); err != nil {
+		log.Printf("Failed to create relay socket: %v", err)
+		return
+	}
+	_ = os.Remove(relaySocket)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: relaySocket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Failed to create relay socket: %v", err)
+		return
+	}
+	// requests name files for root to write to
+	if err := os.Chmod(relaySocket, 0600); err != nil {
+		log.Printf("Failed to restrict relay socket: %v", err)
+		conn.Close()
+		return
+	}
+	go func() {
+		b := make([]byte, 64*1024)
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				log.Printf("Failed to read relay socket: %v", err)
+				return
+			}
+			var req relayRequest
+			if err := json.Unmarshal(b[:n], &req); err != nil {
+				log.Printf("Ignoring invalid relay request: %v", err)
+				continue
+			}
+			c := copierFor(GetServiceLog(varLogDir, req.Service, req.Annotations))
+			if c == nil {
+				log.Printf("Not logging %s: its log driver does not copy output", req.Log)
+				continue
+			}
+			go copyFIFO(c, req.Log, req.FIFO)
+		}
+	}()
+}
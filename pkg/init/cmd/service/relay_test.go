@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCopierFor(t *testing.T) {
+	tee := &teeLog{Log: &nullLog{}}
+	sl := &syslogLog{}
+	for _, test := range []struct {
+		l        Log
+		expected logCopier
+	}{
+		{tee, tee},
+		{sl, sl},
+		{&discardLog{Log: tee}, tee},
+		{&fileLog{}, nil},
+		{&nullLog{}, nil},
+		{&discardLog{Log: &fileLog{}}, nil},
+	} {
+		if got := copierFor(test.l); got != test.expected {
+			t.Errorf("%T: expected %v, got %v", test.l, test.expected, got)
+		}
+	}
+}
+
+// recordingCopier records what is copied to it.
+type recordingCopier struct {
+	copied chan string
+}
+
+func (r *recordingCopier) copy(n string, rc io.ReadCloser) {
+	b, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	r.copied <- n + ": " + string(b)
+}
+
+func TestCopyFIFO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &recordingCopier{copied: make(chan string, 1)}
+
+	fifo := filepath.Join(dir, "sshd.log")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		w, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		io.WriteString(w, "hello\n")
+		w.Close()
+	}()
+	copyFIFO(c, "sshd", fifo)
+	if got := <-c.copied; got != "sshd: hello\n" {
+		t.Errorf("expected %q, got %q", "sshd: hello\n", got)
+	}
+
+	// requests could name any file, so only FIFOs are copied
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{file, filepath.Join(dir, "missing")} {
+		copyFIFO(c, "sshd", path)
+		select {
+		case got := <-c.copied:
+			t.Errorf("%s: expected nothing to be copied, got %q", path, got)
+		default:
+		}
+	}
+}
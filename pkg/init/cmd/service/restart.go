@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// restartAnnotation on a service's OCI spec sets what "service
+	// monitor" does when the service exits:
+	//
+	//	no: leave it stopped (the default)
+	//	on-failure[:max]: restart it if it exits with a non-zero status,
+	//	  giving up after max consecutive failures if max is given
+	//	always: restart it whatever the exit status
+	restartAnnotation = "org.mobyproject.restart"
+
+	// stoppedLabel is set on the containerd container of a service which
+	// is being stopped with "service stop", so that it is not restarted.
+	stoppedLabel = "org.mobyproject.stopped"
+
+	// The delay before a restart doubles with each consecutive restart,
+	// from minRestartDelay up to maxRestartDelay. A service which runs for
+	// restartResetTime is no longer considered to be failing.
+	minRestartDelay  = time.Second
+	maxRestartDelay  = 5 * time.Minute
+	restartResetTime = time.Minute
+)
+
+// restartPolicy is the parsed value of the restart annotation.
+type restartPolicy struct {
+	mode string // "no", "on-failure" or "always"
+	max  int    // for on-failure, the most consecutive restarts, 0 for no limit
+}
+
+func parseRestartPolicy(s string) (restartPolicy, error) {
+	bits := strings.SplitN(s, ":", 2)
+	p := restartPolicy{mode: bits[0]}
+	switch p.mode {
+	case "", "no":
+		p.mode = "no"
+	case "always":
+	case "on-failure":
+		if len(bits) == 2 {
+			max, err := strconv.Atoi(bits[1])
+			if err != nil || max < 1 {
+				return restartPolicy{mode: "no"}, fmt.Errorf("invalid maximum restart count %q", bits[1])
+			}
+			p.max = max
+			return p, nil
+		}
+	default:
+		return restartPolicy{mode: "no"}, fmt.Errorf("unknown restart policy %q", s)
+	}
+	if len(bits) == 2 {
+		return restartPolicy{mode: "no"}, fmt.Errorf("only on-failure takes a maximum restart count: %q", s)
+	}
+	return p, nil
+}
+
+// restartPolicyFor returns the restart policy of a service. An invalid
+// policy is reported and treated as "no".
+func restartPolicyFor(service string, annotations map[string]string) restartPolicy {
+	p, err := parseRestartPolicy(annotations[restartAnnotation])
+	if err != nil {
+		log.Printf("Ignoring restart policy of %s: %v", service, err)
+	}
+	return p
+}
+
+// shouldRestart returns true if a service which exited with status code
+// after restarts consecutive restarts should be restarted.
+func (p restartPolicy) shouldRestart(code uint32, restarts int) bool {
+	switch p.mode {
+	case "always":
+		return true
+	case "on-failure":
+		return code != 0 && (p.max == 0 || restarts < p.max)
+	}
+	return false
+}
+
+// restartDelay returns how long to wait before the next restart of a
+// service which has already been restarted restarts times in a row.
+func restartDelay(restarts int) time.Duration {
+	d := minRestartDelay
+	for i := 0; i < restarts && d < maxRestartDelay; i++ {
+		d *= 2
+	}
+	if d > maxRestartDelay {
+		d = maxRestartDelay
+	}
+	return d
+}
+
+// restartState tracks the restarts of one service in "service monitor".
+type restartState struct {
+	restarts int       // consecutive restarts
+	started  time.Time // when the current task was first seen
+}
+
+// stopping returns true if ctr has gone or is being stopped with "service
+// stop", so must not be restarted.
+func stopping(ctx context.Context, ctr containerd.Container) bool {
+	labels, err := ctr.Labels(ctx)
+	return err != nil || labels[stoppedLabel] != ""
+}
+
+// restartService replaces the exited task of a service with a new one,
+// unless the service has been stopped or started again meanwhile.
+func restartService(ctx context.Context, client *containerd.Client, service, sock, basePath string) error {
+	ctr, err := client.LoadContainer(ctx, service)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if stopping(ctx, ctr) {
+		return nil
+	}
+	task, err := ctr.Task(ctx, nil)
+	if err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	if task != nil {
+		status, err := task.Status(ctx)
+		if err != nil {
+			return err
+		}
+		if status.Status != containerd.Stopped {
+			// started again by someone else
+			return nil
+		}
+		if _, err := task.Delete(ctx); err != nil {
+			return err
+		}
+	}
+	if err := ctr.Delete(ctx); err != nil {
+		return err
+	}
+	logger := GetServiceLog(varLogDir, service, bundleAnnotations(filepath.Join(basePath, service)))
+	for _, n := range []string{service + ".out", service} {
+		if err := logger.Close(n); err != nil {
+			log.WithError(err).Errorf("closing log %s", n)
+		}
+	}
+	recordEvent(logger, &lifecycleEvent{event: eventRestarted, service: service, exitCode: -1})
+	if _, _, msg, err := start(ctx, service, sock, basePath, ""); err != nil {
+		return fmt.Errorf("%s: %v", msg, err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRestartPolicy(t *testing.T) {
+	for _, test := range []struct {
+		s        string
+		expected restartPolicy
+		valid    bool
+	}{
+		{"", restartPolicy{mode: "no"}, true},
+		{"no", restartPolicy{mode: "no"}, true},
+		{"always", restartPolicy{mode: "always"}, true},
+		{"on-failure", restartPolicy{mode: "on-failure"}, true},
+		{"on-failure:3", restartPolicy{mode: "on-failure", max: 3}, true},
+		{"on-failure:0", restartPolicy{mode: "no"}, false},
+		{"on-failure:x", restartPolicy{mode: "no"}, false},
+		{"always:3", restartPolicy{mode: "no"}, false},
+		{"sometimes", restartPolicy{mode: "no"}, false},
+	} {
+		p, err := parseRestartPolicy(test.s)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: unexpected error %v", test.s, err)
+		}
+		if p != test.expected {
+			t.Errorf("%q: expected %+v, got %+v", test.s, test.expected, p)
+		}
+	}
+}
+
+func TestShouldRestart(t *testing.T) {
+	for _, test := range []struct {
+		policy   restartPolicy
+		code     uint32
+		restarts int
+		expected bool
+	}{
+		{restartPolicy{mode: "no"}, 1, 0, false},
+		{restartPolicy{mode: "always"}, 0, 100, true},
+		{restartPolicy{mode: "on-failure"}, 0, 0, false},
+		{restartPolicy{mode: "on-failure"}, 1, 100, true},
+		{restartPolicy{mode: "on-failure", max: 3}, 1, 2, true},
+		{restartPolicy{mode: "on-failure", max: 3}, 1, 3, false},
+	} {
+		if restart := test.policy.shouldRestart(test.code, test.restarts); restart != test.expected {
+			t.Errorf("%+v with status %d after %d restarts: expected %v", test.policy, test.code, test.restarts, test.expected)
+		}
+	}
+}
+
+func TestRestartDelay(t *testing.T) {
+	for _, test := range []struct {
+		restarts int
+		expected time.Duration
+	}{
+		{0, minRestartDelay},
+		{1, 2 * minRestartDelay},
+		{3, 8 * minRestartDelay},
+		{8, 256 * minRestartDelay},
+		{9, maxRestartDelay},
+		{1000, maxRestartDelay},
+	} {
+		if d := restartDelay(test.restarts); d != test.expected {
+			t.Errorf("After %d restarts: expected %s, got %s", test.restarts, test.expected, d)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -62,8 +63,6 @@ func runcInit(rootPath, serviceType string) int {
 		log.Fatalf("Cannot create log directory %s: %v", logDir, err)
 	}
 
-	logger := GetLog(logDir)
-
 	for _, file := range files {
 		name := file.Name()
 		path := filepath.Join(rootPath, name)
@@ -78,7 +77,9 @@ func runcInit(rootPath, serviceType string) int {
 		pidfile := filepath.Join(tmpdir, name)
 		cmd := exec.Command(runcBinary, "create", "--bundle", path, "--pid-file", pidfile, name)
 
-		stdoutLog := serviceType + "." + name + ".out"
+		stderrLog := serviceType + "." + name
+		stdoutLog := stderrLog + ".out"
+		logger := GetServiceLog(logDir, stderrLog, bundleAnnotations(path))
 		stdout, err := logger.Open(stdoutLog)
 		if err != nil {
 			log.Printf("Error opening stdout log connection: %v", err)
@@ -87,7 +88,6 @@ func runcInit(rootPath, serviceType string) int {
 		}
 		defer stdout.Close()
 
-		stderrLog := serviceType + "." + name
 		stderr, err := logger.Open(stderrLog)
 		if err != nil {
 			log.Printf("Error opening stderr log connection: %v", err)
@@ -118,6 +118,10 @@ func runcInit(rootPath, serviceType string) int {
 			continue
 		}
 
+		for _, n := range []string{stdoutLog, stderrLog} {
+			setLogProcess(logger, n, pid, "")
+		}
+
 		if err := prepareProcess(pid, runtimeConfig); err != nil {
 			log.Printf("Cannot prepare process: %v", err)
 			status = 1
@@ -145,7 +149,12 @@ func runcInit(rootPath, serviceType string) int {
 			continue
 		}
 
-		_ = <-waitFor
+		state := <-waitFor
+		e := processExitEvent(stderrLog, pid, state)
+		if e.exitCode > 0 && oomKilled(specCgroupsPath(path)) {
+			e.event = eventOOMKilled
+		}
+		fmt.Fprintln(stderr, e)
 
 		cleanup(path)
 		_ = os.Remove(pidfile)
@@ -155,12 +164,17 @@ func runcInit(rootPath, serviceType string) int {
 		// once that is fixed, this can be cleaned up
 		logger.Dump(stdoutLog)
 		logger.Dump(stderrLog)
+		for _, n := range []string{stdoutLog, stderrLog} {
+			if err := logger.Close(n); err != nil {
+				log.Printf("Error closing log %s: %v", n, err)
+			}
+		}
 	}
 
 	_ = os.RemoveAll(tmpdir)
 
 	// make sure the link exists from /var/log/onboot -> /run/log/onboot
-	logger.Symlink(varLogLink)
+	GetLog(logDir).Symlink(varLogLink)
 
 	return status
 }
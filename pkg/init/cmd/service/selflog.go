@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// initLogName is the log which holds the messages of init/service itself.
+// It is reserved: no service may have this name.
+const initLogName = "init"
+
+// selfLogHook copies the messages of init/service to its own log, as well
+// as stderr, so that they are kept with the logs of everything else.
+type selfLogHook struct {
+	mu        sync.Mutex
+	w         io.WriteCloser
+	formatter log.Formatter
+	prefix    bool // prefix lines with a kernel-style priority for memlogd
+}
+
+// syslogSeverities maps log levels to syslog severities.
+var syslogSeverities = map[log.Level]syslog.Priority{
+	log.PanicLevel: syslog.LOG_CRIT,
+	log.FatalLevel: syslog.LOG_CRIT,
+	log.ErrorLevel: syslog.LOG_ERR,
+	log.WarnLevel:  syslog.LOG_WARNING,
+	log.InfoLevel:  syslog.LOG_INFO,
+	log.DebugLevel: syslog.LOG_DEBUG,
+	log.TraceLevel: syslog.LOG_DEBUG,
+}
+
+var selfLog *selfLogHook
+
+// startSelfLogging adds our own messages to the init log.
+func startSelfLogging() {
+	l := GetLog(varLogDir)
+	w, err := l.Open(initLogName)
+	if err != nil {
+		log.WithError(err).Debug("opening init log")
+		return
+	}
+	_, remote := l.(*remoteLog)
+	selfLog = &selfLogHook{
+		w:         w,
+		formatter: &log.TextFormatter{DisableColors: true, DisableTimestamp: true},
+		prefix:    remote,
+	}
+	log.AddHook(selfLog)
+	// log.Fatal exits without returning to us
+	log.RegisterExitHandler(flushLogs)
+}
+
+// stopSelfLogging closes the init log, so anything spooled is delivered.
+func stopSelfLogging() {
+	if selfLog == nil {
+		return
+	}
+	selfLog.mu.Lock()
+	defer selfLog.mu.Unlock()
+	if selfLog.w != nil {
+		_ = selfLog.w.Close()
+		selfLog.w = nil
+	}
+}
+
+func (h *selfLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *selfLogHook) Fire(entry *log.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.w == nil {
+		return nil
+	}
+	if h.prefix {
+		line = append([]byte(fmt.Sprintf("<%d>", syslogSeverities[entry.Level])), line...)
+	}
+	_, err = h.w.Write(line)
+	return err
+}
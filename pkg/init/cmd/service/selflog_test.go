@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+func TestSelfLogHook(t *testing.T) {
+	for _, test := range []struct {
+		prefix   bool
+		level    log.Level
+		expected string
+	}{
+		{false, log.InfoLevel, "level=info msg=hello\n"},
+		// memlogd reads the priority from the prefix
+		{true, log.InfoLevel, "<6>level=info msg=hello\n"},
+		{true, log.WarnLevel, "<4>level=warning msg=hello\n"},
+		{true, log.ErrorLevel, "<3>level=error msg=hello\n"},
+		{true, log.DebugLevel, "<7>level=debug msg=hello\n"},
+	} {
+		var b bufferCloser
+		h := &selfLogHook{
+			w:         &b,
+			formatter: &log.TextFormatter{DisableColors: true, DisableTimestamp: true},
+			prefix:    test.prefix,
+		}
+		logger := log.New()
+		logger.Out = ioutil.Discard
+		logger.SetLevel(log.DebugLevel)
+		logger.AddHook(h)
+		logger.Log(test.level, "hello")
+		if b.String() != test.expected {
+			t.Errorf("%t %s: expected %q, got %q", test.prefix, test.level, test.expected, b.String())
+		}
+	}
+}
+
+func TestSelfLogHookClosed(t *testing.T) {
+	h := &selfLogHook{formatter: &log.TextFormatter{DisableColors: true, DisableTimestamp: true}}
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	logger.AddHook(h)
+	// messages after the init log is closed only go to stderr
+	if err := h.Fire(log.NewEntry(logger)); err != nil {
+		t.Errorf("expected no error once closed, got %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSpoolSize    = 64 * 1024
+	defaultSpoolTimeout = 10 * time.Second
+	maxSpoolRetryDelay  = 2 * time.Second
+)
+
+var (
+	// pendingLogs tracks logs which have not been handed to memlogd yet,
+	// so that we can wait for them to be delivered before exiting.
+	pendingLogs sync.WaitGroup
+	// pendingTimeout is the longest we might wait for pendingLogs. Logs
+	// are created from several goroutines in "service monitor", so it is
+	// guarded by pendingTimeoutMu.
+	pendingTimeout   = defaultSpoolTimeout
+	pendingTimeoutMu sync.Mutex
+)
+
+// raisePendingTimeout makes waitForLogs wait for at least d.
+func raisePendingTimeout(d time.Duration) {
+	pendingTimeoutMu.Lock()
+	defer pendingTimeoutMu.Unlock()
+	if d > pendingTimeout {
+		pendingTimeout = d
+	}
+}
+
+// waitForLogs waits for pending logs to be delivered or given up on. As a
+// FIFO which is never opened stays pending forever, this gives up after
+// the longest spool timeout.
+func waitForLogs() {
+	pendingTimeoutMu.Lock()
+	timeout := pendingTimeout
+	pendingTimeoutMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		pendingLogs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout + time.Second):
+		log.Printf("timed out waiting for logs to be delivered")
+	}
+}
+
+// logSpool buffers the most recent output of a log until it can be
+// delivered.
+type logSpool struct {
+	mu      sync.Mutex
+	buf     []byte
+	max     int
+	dropped int
+}
+
+func (s *logSpool) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf = append(s.buf, p...)
+	if len(s.buf) > s.max {
+		drop := len(s.buf) - s.max
+		s.dropped += drop
+		s.buf = s.buf[drop:]
+	}
+	return len(p), nil
+}
+
+// WriteTo writes the spooled output to w.
+func (s *logSpool) WriteTo(w io.Writer) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dropped > 0 {
+		if _, err := fmt.Fprintf(w, "[%d bytes of early output dropped]\n", s.dropped); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.Write(s.buf)
+	s.buf = s.buf[n:]
+	return int64(n), err
+}
+
+// spool reads the output from fd into memory while memlogd is unavailable,
+// retrying with backoff. Once memlogd appears the spooled output is sent
+// to it, followed by fd itself. spool takes ownership of fd.
+func (r *remoteLog) spool(n string, fd int) {
+	pendingLogs.Add(1)
+	go func() {
+		defer pendingLogs.Done()
+		// Non-blocking so that reads can be interrupted by a deadline
+		if err := syscall.SetNonblock(fd, true); err != nil {
+			log.Printf("failed to spool log %s: %v", n, err)
+			syscall.Close(fd)
+			return
+		}
+		f := os.NewFile(uintptr(fd), n)
+		defer f.Close()
+
+		s := &logSpool{max: r.spoolSize}
+		copied := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(s, f)
+			copied <- err
+		}()
+
+		log.Printf("logger not available, spooling log %s", n)
+		deadline := time.Now().Add(r.spoolTimeout)
+		delay := 100 * time.Millisecond
+		eof := false
+		var w *os.File
+		for {
+			if !eof {
+				select {
+				case <-copied:
+					// the writer has closed: deliver what we have
+					eof = true
+				case <-time.After(delay):
+				}
+			} else {
+				time.Sleep(delay)
+			}
+			var err error
+			if w, err = r.connect(n); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				log.Printf("giving up waiting for logger, dropping log %s: %v", n, err)
+				return
+			}
+			if delay *= 2; delay > maxSpoolRetryDelay {
+				delay = maxSpoolRetryDelay
+			}
+		}
+		if !eof {
+			// Stop reading so the spool is complete
+			if err := f.SetReadDeadline(time.Now()); err != nil {
+				log.Printf("failed to stop spooling log %s: %v", n, err)
+			} else if err := <-copied; err == nil || !os.IsTimeout(err) {
+				eof = true
+			}
+		}
+		_, err := s.WriteTo(w)
+		w.Close()
+		if err != nil {
+			log.Printf("failed to deliver spooled log %s: %v", n, err)
+		}
+		if eof {
+			return
+		}
+		// Hand the original fd over for the rest of the output
+		if err := syscall.SetNonblock(fd, false); err != nil {
+			log.Printf("failed to restore log %s: %v", n, err)
+			return
+		}
+		if err := sendToLogger(r.writeSocket, n, fd); err != nil {
+			log.Printf("failed to send log %s to logger: %v", n, err)
+		}
+	}()
+}
+
+// connect returns a stream connected to memlogd for the named log.
+func (r *remoteLog) connect(n string) (*os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fds[1])
+	if err := sendToLogger(r.writeSocket, n, fds[1]); err != nil {
+		syscall.Close(fds[0])
+		return nil, err
+	}
+	return os.NewFile(uintptr(fds[0]), n), nil
+}
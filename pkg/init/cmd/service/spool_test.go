@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linuxkit/linuxkit/pkg/memlogd/memlogdtest"
+)
+
+func TestLogSpool(t *testing.T) {
+	for _, test := range []struct {
+		max      int
+		writes   []string
+		expected string
+	}{
+		{16, []string{"first\n", "second\n"}, "first\nsecond\n"},
+		{16, []string{"first\n", "second\n", "third\n"}, "[3 bytes of early output dropped]\nst\nsecond\nthird\n"},
+		{4, []string{"a long line\n"}, "[8 bytes of early output dropped]\nine\n"},
+		{16, nil, ""},
+	} {
+		s := &logSpool{max: test.max}
+		for _, w := range test.writes {
+			if n, err := s.Write([]byte(w)); n != len(w) || err != nil {
+				t.Errorf("%q: expected write of %d, got %d, %v", test.writes, len(w), n, err)
+			}
+		}
+		var b bytes.Buffer
+		if _, err := s.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.writes, test.expected, b.String())
+		}
+	}
+}
+
+// nextRegistration waits for memlogd to be sent a log, which may take a
+// few spool retries.
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, closeEarly := range []bool{false, true} {
+		socket := filepath.Join(dir, fmt.Sprintf("%t.sock", closeEarly))
+		r := &remoteLog{writeSocket: socket, spoolSize: defaultSpoolSize, spoolTimeout: defaultSpoolTimeout}
+		w, err := r.Open("sshd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintln(w, "first")
+		fmt.Fprintln(w, "second")
+		if closeEarly {
+			w.Close()
+		}
+		// let the spool read the output before memlogd starts
+		time.Sleep(200 * time.Millisecond)
+		l := newTestMemlogd(t, socket, nil)
+
+		// the spooled output is sent first, then the rest of the log
+		expected := []string{"sshd: first", "sshd: second"}
+		waitForMessages(t, l, len(expected))
+		if !closeEarly {
+			fmt.Fprintln(w, "third")
+			w.Close()
+			expected = append(expected, "sshd: third")
+		}
+		msgs := waitForMessages(t, l, len(expected))
+		waitForLogs()
+		l.Close()
+
+		if !reflect.DeepEqual(msgs, expected) {
+			t.Errorf("closed early %t: expected %q, got %q", closeEarly, expected, msgs)
+		}
+		meta := &memlogdtest.Metadata{Service: "sshd", Stream: "stderr"}
+		for _, reg := range l.Registrations() {
+			if reg.Name != "sshd" || !reflect.DeepEqual(reg.Meta, meta) {
+				t.Errorf("closed early %t: unexpected registration %+v", closeEarly, reg)
+			}
+		}
+	}
+}
+
+func TestRaisePendingTimeout(t *testing.T) {
+	defer func(d time.Duration) { pendingTimeout = d }(pendingTimeout)
+	pendingTimeout = defaultSpoolTimeout
+	// logs are created concurrently in "service monitor"
+	var wg sync.WaitGroup
+	for _, timeout := range []string{"1s", "30s", "20s", "5s"} {
+		wg.Add(1)
+		go func(timeout string) {
+			defer wg.Done()
+			if _, err := newRemoteLog("/var/log", map[string]string{"spool-timeout": timeout}); err != nil {
+				t.Error(err)
+			}
+		}(timeout)
+	}
+	wg.Wait()
+	// only ever raised, to the longest spool timeout
+	if pendingTimeout != 30*time.Second {
+		t.Errorf("expected a pending timeout of 30s, got %s", pendingTimeout)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	log "github.com/sirupsen/logrus"
+)
+
+// stateDir holds what "service monitor" knows about each service, for
+// "service status".
+const stateDir = "/run/service/state"
+
+// monitorState is what "service monitor" records about a service.
+type monitorState struct {
+	Restarts int          `json:"restarts"`
+	Health   *healthState `json:"health,omitempty"`
+	Notify   *notifyState `json:"notify,omitempty"`
+
+	// Completion is recorded for oneshot services
+	Completion *completionState `json:"completion,omitempty"`
+}
+
+// stateMu serialises updates of the state files within "service monitor".
+var stateMu sync.Mutex
+
+func statePath(service string) string {
+	return filepath.Join(stateDir, service+".json")
+}
+
+// readState returns the recorded state of a service, or an empty state if
+// none has been recorded.
+func readState(service string) *monitorState {
+	var state monitorState
+	b, err := ioutil.ReadFile(statePath(service))
+	if err != nil {
+		return &state
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return &monitorState{}
+	}
+	return &state
+}
+
+// updateState changes the recorded state of a service.
+func updateState(service string, update func(*monitorState)) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	state := readState(service)
+	update(state)
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		log.Printf("Failed to record state of %s: %v", service, err)
+		return
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("Failed to record state of %s: %v", service, err)
+		return
+	}
+	// write and rename so that readers never see part of it
+	tmp := statePath(service) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		log.Printf("Failed to record state of %s: %v", service, err)
+		return
+	}
+	if err := os.Rename(tmp, statePath(service)); err != nil {
+		log.Printf("Failed to record state of %s: %v", service, err)
+	}
+}
+
+// serviceStatus is the state of a service.
+type serviceStatus struct {
+	Name     string       `json:"name"`
+	Status   string       `json:"status"` // "created", "running", "exited" or "not-found"
+	Pid      uint32       `json:"pid,omitempty"`
+	Started  time.Time    `json:"started,omitempty"`
+	Restarts int          `json:"restarts"`
+	Health   *healthState `json:"health,omitempty"` // only while running
+	Notify   string       `json:"notify,omitempty"` // the last STATUS= sent to the notify socket
+	Log      string       `json:"log"`
+
+	// Completion is how the last run of a oneshot service ended
+	Completion *completionState `json:"completion,omitempty"`
+}
+
+// processStartTime returns when a process started, or the zero time if it
+// is not known.
+func processStartTime(pid uint32) time.Time {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}
+	}
+	// the command may contain spaces, but not the fields after it
+	stat := string(b)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return time.Time{}
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	b, err = ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if bits := strings.Fields(line); len(bits) == 2 && bits[0] == "btime" {
+			boot, err := strconv.ParseInt(bits[1], 10, 64)
+			if err != nil {
+				return time.Time{}
+			}
+			// /proc counts in USER_HZ, which is always 100
+			return time.Unix(boot, 0).Add(time.Duration(ticks) * time.Second / 100)
+		}
+	}
+	return time.Time{}
+}
+
+// getStatus returns the state of a service.
+func getStatus(ctx context.Context, client *containerd.Client, basePath, service string) (*serviceStatus, error) {
+	path := filepath.Join(basePath, service)
+	if ns := getRuntimeConfig(path).Namespace; ns != "" {
+		ctx = namespaces.WithNamespace(ctx, ns)
+	}
+	annotations := bundleAnnotations(path)
+	state := readState(service)
+	s := &serviceStatus{
+		Name:     service,
+		Status:   "not-found",
+		Restarts: state.Restarts,
+		Log:      logDestination(annotations),
+	}
+	if oneshotEnabled(annotations) {
+		s.Completion = state.Completion
+	}
+	ctr, err := client.LoadContainer(ctx, service)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	s.Status = "created"
+	task, err := ctr.Task(ctx, nil)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	status, err := task.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch status.Status {
+	case containerd.Running, containerd.Paused, containerd.Pausing:
+		s.Status = "running"
+		s.Pid = task.Pid()
+		s.Started = processStartTime(s.Pid)
+		if state.Notify != nil {
+			s.Notify = state.Notify.Status
+		}
+		if healthCheckFor(service, annotations) != nil {
+			if s.Health = state.Health; s.Health == nil {
+				s.Health = &healthState{Status: healthStarting}
+			}
+		}
+	case containerd.Stopped:
+		s.Status = "exited"
+	}
+	return s, nil
+}
+
+// uptime formats how long a service has been running, or "-".
+func (s *serviceStatus) uptime() string {
+	if s.Started.IsZero() {
+		return "-"
+	}
+	return time.Since(s.Started).Round(time.Second).String()
+}
+
+// health formats the health of a service, or "-" if it has no check.
+func (s *serviceStatus) health() string {
+	if s.Health == nil {
+		return "-"
+	}
+	return s.Health.Status
+}
+
+func statusCmd(ctx context.Context, args []string) {
+	invoked := filepath.Base(os.Args[0])
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s status [service]\n\n", invoked)
+		fmt.Printf("Print the state of a service.\n\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	sock := flags.String("sock", defaultSocket, "Path to containerd socket")
+	path := flags.String("path", defaultPath, "Path to service configs")
+	jsonOut := flags.Bool("json", false, "Print the state as JSON")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() != 1 {
+		fmt.Println("Please specify the service")
+		flags.Usage()
+		os.Exit(1)
+	}
+	service := flags.Arg(0)
+
+	client, err := containerd.New(*sock)
+	if err != nil {
+		log.WithError(err).Fatal("creating containerd client")
+	}
+	s, err := getStatus(ctx, client, *path, service)
+	if err != nil {
+		log.WithError(err).Fatalf("getting status of %s", service)
+	}
+	if *jsonOut {
+		if err := json.NewEncoder(os.Stdout).Encode(s); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	printStatus(os.Stdout, s)
+}
+
+// printStatus writes the state of a service as "key: value" lines.
+func printStatus(w io.Writer, s *serviceStatus) {
+	fmt.Fprintf(w, "name: %s\n", s.Name)
+	fmt.Fprintf(w, "status: %s\n", s.Status)
+	if s.Pid != 0 {
+		fmt.Fprintf(w, "pid: %d\n", s.Pid)
+		fmt.Fprintf(w, "uptime: %s\n", s.uptime())
+	}
+	fmt.Fprintf(w, "restarts: %d\n", s.Restarts)
+	if s.Health != nil {
+		fmt.Fprintf(w, "health: %s\n", s.Health.Status)
+		if s.Health.Error != "" {
+			fmt.Fprintf(w, "health error: %s\n", s.Health.Error)
+		}
+	}
+	if s.Notify != "" {
+		fmt.Fprintf(w, "notify: %s\n", s.Notify)
+	}
+	if c := s.Completion; c != nil {
+		if !c.Started.IsZero() {
+			fmt.Fprintf(w, "started: %s\n", c.Started.Format(time.RFC3339))
+		}
+		fmt.Fprintf(w, "finished: %s\n", c.Finished.Format(time.RFC3339))
+		fmt.Fprintf(w, "exit code: %d\n", c.ExitCode)
+	}
+	fmt.Fprintf(w, "log: %s\n", s.Log)
+}
+
+func listCmd(ctx context.Context, args []string) {
+	invoked := filepath.Base(os.Args[0])
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s list\n\n", invoked)
+		fmt.Printf("Print the state of all services.\n\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	sock := flags.String("sock", defaultSocket, "Path to containerd socket")
+	path := flags.String("path", defaultPath, "Path to service configs")
+	jsonOut := flags.Bool("json", false, "Print the states as JSON")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() != 0 {
+		fmt.Println("Unexpected argument")
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	client, err := containerd.New(*sock)
+	if err != nil {
+		log.WithError(err).Fatal("creating containerd client")
+	}
+	services, err := serviceNames(*path)
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Fatal("listing services")
+	}
+	statuses := []*serviceStatus{}
+	for _, service := range services {
+		s, err := getStatus(ctx, client, *path, service)
+		if err != nil {
+			log.WithError(err).Errorf("getting status of %s", service)
+			continue
+		}
+		statuses = append(statuses, s)
+	}
+	if *jsonOut {
+		if err := json.NewEncoder(os.Stdout).Encode(statuses); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	printStatuses(os.Stdout, statuses)
+}
+
+// printStatuses writes the states of services as a table.
+func printStatuses(out io.Writer, statuses []*serviceStatus) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tPID\tUPTIME\tRESTARTS\tHEALTH\tLOG")
+	for _, s := range statuses {
+		pid := "-"
+		if s.Pid != 0 {
+			pid = strconv.FormatUint(uint64(s.Pid), 10)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", s.Name, s.Status, pid, s.uptime(), s.Restarts, s.health(), s.Log)
+	}
+	w.Flush()
+}
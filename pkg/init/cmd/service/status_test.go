@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPrintStatus(t *testing.T) {
+	finished := time.Date(2018, 7, 8, 9, 16, 53, 0, time.UTC)
+	for _, test := range []struct {
+		status   serviceStatus
+		expected string
+	}{
+		{serviceStatus{Name: "sshd", Status: "not-found", Log: "memlogd"},
+			"name: sshd\nstatus: not-found\nrestarts: 0\nlog: memlogd\n"},
+		{serviceStatus{Name: "sshd", Status: "running", Pid: 42, Restarts: 2, Health: &healthState{Status: healthUnhealthy, Error: "connection refused"}, Notify: "Ready", Log: "file"},
+			"name: sshd\nstatus: running\npid: 42\nuptime: -\nrestarts: 2\nhealth: unhealthy\nhealth error: connection refused\nnotify: Ready\nlog: file\n"},
+		{serviceStatus{Name: "format", Status: "exited", Completion: &completionState{Started: finished.Add(-time.Minute), Finished: finished, ExitCode: 1}, Log: "memlogd"},
+			"name: format\nstatus: exited\nrestarts: 0\nstarted: 2018-07-08T09:15:53Z\nfinished: 2018-07-08T09:16:53Z\nexit code: 1\nlog: memlogd\n"},
+		// the start of a oneshot service isn't known after a reboot
+		{serviceStatus{Name: "format", Status: "exited", Completion: &completionState{Finished: finished}, Log: "memlogd"},
+			"name: format\nstatus: exited\nrestarts: 0\nfinished: 2018-07-08T09:16:53Z\nexit code: 0\nlog: memlogd\n"},
+	} {
+		var b bytes.Buffer
+		printStatus(&b, &test.status)
+		if b.String() != test.expected {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", test.status.Name, test.expected, b.String())
+		}
+	}
+}
+
+func TestPrintStatuses(t *testing.T) {
+	var b bytes.Buffer
+	printStatuses(&b, []*serviceStatus{
+		{Name: "sshd", Status: "running", Pid: 42, Restarts: 1, Health: &healthState{Status: healthHealthy}, Log: "memlogd"},
+		{Name: "dhcpcd", Status: "exited", Log: "file persist=/var/persist/log"},
+	})
+	expected := "NAME    STATUS   PID  UPTIME  RESTARTS  HEALTH   LOG\n" +
+		"sshd    running  42   -       1         healthy  memlogd\n" +
+		"dhcpcd  exited   -    -       0         -        file persist=/var/persist/log\n"
+	if b.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+func TestUptime(t *testing.T) {
+	for _, test := range []struct {
+		started  time.Time
+		expected string
+	}{
+		{time.Time{}, "-"},
+		{time.Now().Add(-90 * time.Second), "1m30s"},
+	} {
+		s := &serviceStatus{Started: test.started}
+		if got := s.uptime(); got != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.started, test.expected, got)
+		}
+	}
+}
+
+func TestProcessStartTime(t *testing.T) {
+	started := processStartTime(uint32(os.Getpid()))
+	if started.IsZero() || started.After(time.Now()) || time.Since(started) > time.Hour {
+		t.Errorf("expected this process to have started recently, got %s", started)
+	}
+	if started := processStartTime(0); !started.IsZero() {
+		t.Errorf("expected an unknown process to have no start time, got %s", started)
+	}
+}
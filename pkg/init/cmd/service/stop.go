@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Annotations on a service's OCI spec which set how it is stopped:
+	//
+	//	org.mobyproject.stop.signal: the signal to send, SIGKILL by default
+	//	org.mobyproject.stop.timeout: how long to wait after the signal
+	//	  before sending SIGKILL, 10s by default
+	//	org.mobyproject.stop.pre-stop: a command to run in the container,
+	//	  with /bin/sh -c, before the signal is sent
+	stopAnnotationPrefix    = "org.mobyproject.stop."
+	stopSignalAnnotation    = stopAnnotationPrefix + "signal"
+	stopTimeoutAnnotation   = stopAnnotationPrefix + "timeout"
+	stopPreStopAnnotation   = stopAnnotationPrefix + "pre-stop"
+	defaultStopTimeout      = 10 * time.Second
+	shutdownServicesTimeout = 5 * time.Minute
+)
+
+// stopSignals are the signals which may be named in the stop annotation.
+var stopSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+	"PWR":  syscall.SIGPWR,
+}
+
+// stopConfig is how a service is stopped.
+type stopConfig struct {
+	signal  syscall.Signal
+	timeout time.Duration
+	preStop string
+}
+
+// parseSignal parses a signal such as "SIGTERM", "TERM" or "15".
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil && n > 0 && n < 65 {
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := stopSignals[strings.TrimPrefix(strings.ToUpper(s), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", s)
+}
+
+// stopConfigFor returns how to stop a service. Invalid annotations are
+// reported and ignored.
+func stopConfigFor(service string, annotations map[string]string) stopConfig {
+	c := stopConfig{
+		signal:  syscall.SIGKILL,
+		timeout: defaultStopTimeout,
+		preStop: annotations[stopPreStopAnnotation],
+	}
+	if s := annotations[stopSignalAnnotation]; s != "" {
+		sig, err := parseSignal(s)
+		if err != nil {
+			log.Printf("Ignoring stop signal of %s: %v", service, err)
+		} else {
+			c.signal = sig
+		}
+	}
+	if s := annotations[stopTimeoutAnnotation]; s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			log.Printf("Ignoring stop timeout of %s: invalid duration %q", service, s)
+		} else {
+			c.timeout = d
+		}
+	}
+	return c
+}
+
+// stopTask runs the pre-stop command of a task, sends it the stop signal
+// and waits for it to exit, killing it if it takes longer than the stop
+// timeout.
+func stopTask(ctx context.Context, ctr containerd.Container, task containerd.Task, c stopConfig) error {
+	statusC, err := task.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	deadline := time.After(c.timeout)
+	if c.preStop != "" {
+		preCtx, cancel := context.WithTimeout(ctx, c.timeout)
+		err := execInTask(preCtx, ctr, task, c.preStop)
+		cancel()
+		if err != nil {
+			log.Printf("Pre-stop command of %s failed: %v", ctr.ID(), err)
+		}
+	}
+	if err := task.Kill(ctx, c.signal); err != nil {
+		return err
+	}
+	if c.signal == syscall.SIGKILL {
+		<-statusC
+		return nil
+	}
+	select {
+	case <-statusC:
+		return nil
+	case <-deadline:
+	}
+	log.Printf("%s did not stop within %s, killing it", ctr.ID(), c.timeout)
+	if err := task.Kill(ctx, syscall.SIGKILL); err != nil {
+		return err
+	}
+	<-statusC
+	return nil
+}
+
+// shutdownCmd stops the running services which have a stop configuration,
+// each after the services which depend on it, at poweroff.
+func shutdownCmd(ctx context.Context, args []string) {
+	invoked := filepath.Base(os.Args[0])
+	flags := flag.NewFlagSet("shutdown", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s shutdown\n\n", invoked)
+		fmt.Printf("Stop the services which have a stop configuration, each after the\n")
+		fmt.Printf("services which depend on it.\n\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	sock := flags.String("sock", defaultSocket, "Path to containerd socket")
+	path := flags.String("path", defaultPath, "Path to service configs")
+	timeout := flags.Duration("timeout", shutdownServicesTimeout, "Maximum time to wait for all services to stop")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	services, err := serviceNames(*path)
+	if err != nil {
+		return
+	}
+	annotations := map[string]map[string]string{}
+	for _, service := range services {
+		annotations[service] = bundleAnnotations(filepath.Join(*path, service))
+	}
+	deps := serviceDependencies(annotations)
+	// a service is stopped once everything which depends on it has stopped
+	dependents := map[string][]string{}
+	for service, ds := range deps {
+		for _, dep := range ds {
+			dependents[dep] = append(dependents[dep], service)
+		}
+	}
+	// Only services with a stop configuration are stopped here, the rest
+	// are left to be sent SIGTERM and then SIGKILL by rc.shutdown as usual.
+	stopped := map[string]chan struct{}{}
+	for service, a := range annotations {
+		for k := range a {
+			if strings.HasPrefix(k, stopAnnotationPrefix) {
+				stopped[service] = make(chan struct{})
+				break
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	for service := range stopped {
+		wg.Add(1)
+		go func(service string) {
+			defer wg.Done()
+			defer close(stopped[service])
+			for _, d := range dependents[service] {
+				// services in a dependency cycle don't wait for each other
+				if stopped[d] != nil && !dependsOn(deps, service, d, map[string]bool{}) {
+					<-stopped[d]
+				}
+			}
+			// services which are not running are not found
+			if _, _, msg, err := stop(ctx, service, *sock, *path); err != nil && !errdefs.IsNotFound(err) {
+				log.WithError(err).Errorf("stopping %s: %s", service, msg)
+			}
+		}(service)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(*timeout):
+		log.Errorf("Services did not stop within %s", *timeout)
+	}
+}
+
+// dependsOn returns true if service depends on dep, directly or not.
+func dependsOn(deps map[string][]string, service, dep string, seen map[string]bool) bool {
+	if seen[service] {
+		return false
+	}
+	seen[service] = true
+	for _, d := range deps[service] {
+		if d == dep || dependsOn(deps, d, dep, seen) {
+			return true
+		}
+	}
+	return false
+}
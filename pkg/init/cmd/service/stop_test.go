@@ -0,0 +1,71 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseSignal(t *testing.T) {
+	for _, test := range []struct {
+		s        string
+		expected syscall.Signal
+		valid    bool
+	}{
+		{"SIGTERM", syscall.SIGTERM, true},
+		{"term", syscall.SIGTERM, true},
+		{"HUP", syscall.SIGHUP, true},
+		{"15", syscall.SIGTERM, true},
+		{"0", 0, false},
+		{"65", 0, false},
+		{"SIGFOO", 0, false},
+	} {
+		sig, err := parseSignal(test.s)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: unexpected error %v", test.s, err)
+		}
+		if sig != test.expected {
+			t.Errorf("%q: expected %d, got %d", test.s, test.expected, sig)
+		}
+	}
+}
+
+func TestStopConfigFor(t *testing.T) {
+	for _, test := range []struct {
+		annotations map[string]string
+		expected    stopConfig
+	}{
+		{nil, stopConfig{signal: syscall.SIGKILL, timeout: defaultStopTimeout}},
+		{map[string]string{
+			stopSignalAnnotation:  "TERM",
+			stopTimeoutAnnotation: "30s",
+			stopPreStopAnnotation: "nginx -s quit",
+		}, stopConfig{signal: syscall.SIGTERM, timeout: 30 * time.Second, preStop: "nginx -s quit"}},
+		{map[string]string{
+			stopSignalAnnotation:  "FOO",
+			stopTimeoutAnnotation: "-1s",
+		}, stopConfig{signal: syscall.SIGKILL, timeout: defaultStopTimeout}},
+	} {
+		if c := stopConfigFor("test", test.annotations); c != test.expected {
+			t.Errorf("%v: expected %+v, got %+v", test.annotations, test.expected, c)
+		}
+	}
+}
+
+func TestDependsOn(t *testing.T) {
+	deps := map[string][]string{"a": {"b"}, "b": {"c"}, "x": {"y"}, "y": {"x"}}
+	for _, test := range []struct {
+		service, dep string
+		expected     bool
+	}{
+		{"a", "b", true},
+		{"a", "c", true},
+		{"c", "a", false},
+		{"x", "a", false},
+		{"x", "x", true},
+	} {
+		if d := dependsOn(deps, test.service, test.dep, map[string]bool{}); d != test.expected {
+			t.Errorf("%s depends on %s: expected %v", test.service, test.dep, test.expected)
+		}
+	}
+}
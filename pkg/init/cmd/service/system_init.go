@@ -15,6 +15,7 @@ import (
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
 	"github.com/pelletier/go-toml"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -172,14 +173,57 @@ func systemInitCmd(ctx context.Context, args []string) {
 		}
 	}
 
+	createInstances(*path)
+
+	// before the services, so that it can create their notify sockets
+	ns, _ := namespaces.Namespace(ctx)
+	startMonitor(ns, *sock, *path)
+
 	// Start up containers
-	files, err := ioutil.ReadDir(*path)
+	services, err := serviceNames(*path)
 	// just skip if there is an error, eg no such path
 	if err != nil {
 		return
 	}
-	for _, file := range files {
-		if id, pid, msg, err := start(ctx, file.Name(), *sock, *path, ""); err != nil {
+	annotations := map[string]map[string]string{}
+	for _, service := range services {
+		annotations[service] = bundleAnnotations(filepath.Join(*path, service))
+	}
+	deps := serviceDependencies(annotations)
+	failed := map[string]bool{}
+	for _, service := range startOrder(services, deps) {
+		// services are only started if the oneshot services they depend
+		// on succeed, but are started anyway if other dependencies fail
+		var wait, oneshots []string
+		skip := false
+		for _, dep := range deps[service] {
+			switch {
+			case failed[dep] && oneshotEnabled(annotations[dep]):
+				log.Errorf("Not starting %s as %s failed to start", service, dep)
+				skip = true
+			case failed[dep]:
+				log.Errorf("Starting %s although %s failed to start", service, dep)
+			case oneshotEnabled(annotations[dep]):
+				oneshots = append(oneshots, dep)
+			default:
+				wait = append(wait, dep)
+			}
+		}
+		if !skip {
+			if err := waitReady(ctx, client, *path, oneshots); err != nil {
+				log.WithError(err).Errorf("not starting %s", service)
+				skip = true
+			}
+		}
+		if skip {
+			failed[service] = true
+			continue
+		}
+		if err := waitReady(ctx, client, *path, wait); err != nil {
+			log.WithError(err).Errorf("starting %s without its dependencies", service)
+		}
+		if id, pid, msg, err := start(ctx, service, *sock, *path, ""); err != nil {
+			failed[service] = true
 			log.WithError(err).Error(msg)
 		} else {
 			log.Debugf("Started %s pid %d", id, pid)
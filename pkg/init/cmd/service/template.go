@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// instancesAnnotation on a service's OCI spec makes it a template,
+	// which is not run itself. Instances of it, named <template>@<instance>,
+	// are created from it with "%i" replaced by the instance name, and
+	// those listed in the annotation, separated by commas, are started by
+	// system-init.
+	instancesAnnotation = "org.mobyproject.instances"
+	instancePlaceholder = "%i"
+)
+
+var instanceName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.:-]*$`)
+
+func isTemplate(annotations map[string]string) bool {
+	_, ok := annotations[instancesAnnotation]
+	return ok
+}
+
+// serviceNames returns the names of the services in basePath, in name
+// order, leaving out templates.
+func serviceNames(basePath string) ([]string, error) {
+	files, err := ioutil.ReadDir(basePath)
+	if err != nil {
+		return nil, err
+	}
+	var services []string
+	for _, file := range files {
+		if !isTemplate(bundleAnnotations(filepath.Join(basePath, file.Name()))) {
+			services = append(services, file.Name())
+		}
+	}
+	return services, nil
+}
+
+// splitInstance splits the name of an instance into the names of its
+// template and the instance.
+func splitInstance(service string) (string, string, error) {
+	i := strings.LastIndex(service, "@")
+	if i <= 0 || !instanceName.MatchString(service[i+1:]) {
+		return "", "", fmt.Errorf("%q is not a valid instance name", service)
+	}
+	return service[:i], service[i+1:], nil
+}
+
+// instantiate creates the bundle of an instance of a template. Its OCI
+// spec and runtime config are those of the template with "%i" replaced by
+// the instance name, and it shares the root filesystem of the template.
+func instantiate(basePath, service string) error {
+	template, instance, err := splitInstance(service)
+	if err != nil {
+		return err
+	}
+	templatePath := filepath.Join(basePath, template)
+	b, err := ioutil.ReadFile(filepath.Join(templatePath, "config.json"))
+	if err != nil {
+		return fmt.Errorf("reading template %s: %v", template, err)
+	}
+	var spec specs.Spec
+	if err := json.Unmarshal(bytes.Replace(b, []byte(instancePlaceholder), []byte(instance), -1), &spec); err != nil {
+		return fmt.Errorf("parsing template %s: %v", template, err)
+	}
+	if !isTemplate(spec.Annotations) {
+		return fmt.Errorf("%s is not a template", template)
+	}
+	// the instances of a template form a target named after it
+	delete(spec.Annotations, instancesAnnotation)
+	spec.Annotations[targetsAnnotation] = strings.Join(append(splitList(spec.Annotations[targetsAnnotation]), template), ",")
+	if spec.Process != nil {
+		spec.Process.Env = append(spec.Process.Env, "INSTANCE="+instance)
+	}
+	if b, err = json.Marshal(&spec); err != nil {
+		return err
+	}
+
+	path := filepath.Join(basePath, service)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, "config.json"), b, 0644); err != nil {
+		return err
+	}
+	if runtime, err := ioutil.ReadFile(filepath.Join(templatePath, "runtime.json")); err == nil {
+		runtime = bytes.Replace(runtime, []byte(instancePlaceholder), []byte(instance), -1)
+		if err := ioutil.WriteFile(filepath.Join(path, "runtime.json"), runtime, 0644); err != nil {
+			return err
+		}
+	}
+	rootfs := filepath.Join(path, "rootfs")
+	if _, err := os.Lstat(rootfs); os.IsNotExist(err) {
+		return os.Symlink(filepath.Join("..", template, "rootfs"), rootfs)
+	}
+	return nil
+}
+
+// createInstances creates the bundles of the instances listed by the
+// templates in basePath. Failures are reported and the instance skipped.
+func createInstances(basePath string) {
+	files, err := ioutil.ReadDir(basePath)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		annotations := bundleAnnotations(filepath.Join(basePath, file.Name()))
+		if !isTemplate(annotations) {
+			continue
+		}
+		for _, instance := range splitList(annotations[instancesAnnotation]) {
+			if err := instantiate(basePath, file.Name()+"@"+instance); err != nil {
+				log.Printf("Failed to create instance %s of %s: %v", instance, file.Name(), err)
+			}
+		}
+	}
+}
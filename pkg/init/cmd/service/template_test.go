@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestSplitInstance(t *testing.T) {
+	for _, test := range []struct {
+		service  string
+		template string
+		instance string
+		valid    bool
+	}{
+		{"getty@tty1", "getty", "tty1", true},
+		{"a@b@eth0.100", "a@b", "eth0.100", true},
+		{"getty", "", "", false},
+		{"@tty1", "", "", false},
+		{"getty@", "", "", false},
+		{"getty@-tty1", "", "", false},
+		{"getty@tty/1", "", "", false},
+	} {
+		template, instance, err := splitInstance(test.service)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: unexpected error %v", test.service, err)
+		}
+		if template != test.template || instance != test.instance {
+			t.Errorf("%q: expected %q and %q, got %q and %q", test.service, test.template, test.instance, template, instance)
+		}
+	}
+}
+
+func writeSpec(t *testing.T, bundle string, spec *specs.Spec) {
+	if err := os.MkdirAll(filepath.Join(bundle, "rootfs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundle, "config.json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstantiate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeSpec(t, filepath.Join(dir, "getty"), &specs.Spec{
+		Process: &specs.Process{Args: []string{"/sbin/getty", "/dev/%i"}},
+		Annotations: map[string]string{
+			instancesAnnotation: "tty1,ttyS0",
+			targetsAnnotation:   "console",
+		},
+	})
+	writeSpec(t, filepath.Join(dir, "sshd"), &specs.Spec{})
+
+	if err := instantiate(dir, "sshd@tty1"); err == nil {
+		t.Errorf("Expected an error instantiating a service which is not a template")
+	}
+	createInstances(dir)
+
+	services, err := serviceNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"getty@tty1", "getty@ttyS0", "sshd"}; !reflect.DeepEqual(services, expected) {
+		t.Errorf("Expected services %v, got %v", expected, services)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "getty@tty1", "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec specs.Spec
+	if err := json.Unmarshal(b, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"/sbin/getty", "/dev/tty1"}; !reflect.DeepEqual(spec.Process.Args, expected) {
+		t.Errorf("Expected args %v, got %v", expected, spec.Process.Args)
+	}
+	if expected := []string{"INSTANCE=tty1"}; !reflect.DeepEqual(spec.Process.Env, expected) {
+		t.Errorf("Expected env %v, got %v", expected, spec.Process.Env)
+	}
+	if isTemplate(spec.Annotations) {
+		t.Errorf("Instance is a template")
+	}
+	if targets := spec.Annotations[targetsAnnotation]; targets != "console,getty" {
+		t.Errorf("Expected the instance to be in the targets console and getty, got %q", targets)
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "getty@tty1", "rootfs")); err != nil || link != filepath.Join("..", "getty", "rootfs") {
+		t.Errorf("Expected rootfs to link to the template's, got %q: %v", link, err)
+	}
+}
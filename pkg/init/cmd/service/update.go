@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/image-spec/identity"
+	log "github.com/sirupsen/logrus"
+)
+
+// unpackImage pulls an image and copies its root filesystem to dir.
+func unpackImage(ctx context.Context, client *containerd.Client, ref, dir string) error {
+	img, err := client.Pull(ctx, ref, containerd.WithPullUnpack)
+	if err != nil {
+		return fmt.Errorf("pulling %s: %v", ref, err)
+	}
+	diffIDs, err := img.RootFS(ctx)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", ref, err)
+	}
+	snapshotter := client.SnapshotService(containerd.DefaultSnapshotter)
+	key := "service-update-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	mounts, err := snapshotter.View(ctx, key, identity.ChainID(diffIDs).String())
+	if err != nil {
+		return fmt.Errorf("mounting %s: %v", ref, err)
+	}
+	defer snapshotter.Remove(ctx, key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return mount.WithTempMount(ctx, mounts, func(root string) error {
+		cmd := exec.Command("cp", "-a", root+"/.", dir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("copying %s: %v: %s", ref, err, out)
+		}
+		return nil
+	})
+}
+
+// removeContainer removes the container of a service, and its task, if
+// there is one.
+func removeContainer(ctx context.Context, client *containerd.Client, service string) {
+	ctr, err := client.LoadContainer(ctx, service)
+	if err != nil {
+		return
+	}
+	if err := cleanupTask(ctx, ctr); err != nil {
+		log.WithError(err).Error("cleaning up task")
+	}
+	if err := ctr.Delete(ctx); err != nil {
+		log.WithError(err).Error("deleting container")
+	}
+}
+
+// replaceRootfs moves the root filesystem of a service at rootfs aside to
+// rootfs.old and puts rootfs.new in its place. If that fails the old one
+// is left in place.
+func replaceRootfs(rootfs string) error {
+	if err := os.Rename(rootfs, rootfs+".old"); err != nil {
+		return err
+	}
+	if err := os.Rename(rootfs+".new", rootfs); err != nil {
+		if err := os.Rename(rootfs+".old", rootfs); err != nil {
+			log.WithError(err).Errorf("putting back %s", rootfs)
+		}
+		return err
+	}
+	return nil
+}
+
+// restoreRootfs puts back the root filesystem moved aside by
+// replaceRootfs.
+func restoreRootfs(rootfs string) error {
+	if err := os.RemoveAll(rootfs); err != nil {
+		return err
+	}
+	return os.Rename(rootfs+".old", rootfs)
+}
+
+// startPrevious starts the previous version of a service again after an
+// update failed.
+func startPrevious(ctx context.Context, service, sock, basePath string) {
+	if _, _, msg, err := start(ctx, service, sock, basePath, ""); err != nil {
+		log.WithError(err).Errorf("%s: starting the previous version of %s", msg, service)
+	}
+}
+
+// update replaces the root filesystem of a service with that of an image,
+// keeping the rest of its configuration, and restarts it. If the new
+// version fails to start the old one is put back.
+func update(ctx context.Context, service, ref, sock, basePath string) error {
+	path := filepath.Join(basePath, service)
+	if _, err := os.Stat(filepath.Join(path, "config.json")); err != nil {
+		return fmt.Errorf("unknown service %s: %v", service, err)
+	}
+	client, err := containerd.New(sock)
+	if err != nil {
+		return err
+	}
+	if ns := getRuntimeConfig(path).Namespace; ns != "" {
+		ctx = namespaces.WithNamespace(ctx, ns)
+	}
+
+	rootfs := filepath.Join(path, "rootfs")
+	newRootfs, oldRootfs := rootfs+".new", rootfs+".old"
+	for _, dir := range []string{newRootfs, oldRootfs} {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	if err := unpackImage(ctx, client, ref, newRootfs); err != nil {
+		os.RemoveAll(newRootfs)
+		return err
+	}
+
+	if _, _, msg, err := stop(ctx, service, sock, basePath); err != nil {
+		if !errdefs.IsNotFound(err) {
+			os.RemoveAll(newRootfs)
+			return fmt.Errorf("%s: %v", msg, err)
+		}
+		// not running, but there may be a container without a task
+		removeContainer(ctx, client, service)
+	}
+	if err := replaceRootfs(rootfs); err != nil {
+		// the old root filesystem is still in place, so don't leave
+		// the service stopped
+		os.RemoveAll(newRootfs)
+		startPrevious(ctx, service, sock, basePath)
+		return err
+	}
+	if _, _, msg, err := start(ctx, service, sock, basePath, ""); err != nil {
+		startErr := fmt.Errorf("%s: %v", msg, err)
+		log.WithError(startErr).Errorf("putting back the previous version of %s", service)
+		removeContainer(ctx, client, service)
+		if err := restoreRootfs(rootfs); err != nil {
+			return err
+		}
+		startPrevious(ctx, service, sock, basePath)
+		return startErr
+	}
+	logger := GetServiceLog(varLogDir, service, bundleAnnotations(path))
+	recordEvent(logger, &lifecycleEvent{event: eventUpdated, service: service, exitCode: -1})
+	return os.RemoveAll(oldRootfs)
+}
+
+func updateCmd(ctx context.Context, args []string) {
+	if len(args) < 2 {
+		fmt.Printf("USAGE: %s update [options] [service] [image]\n\n", filepath.Base(os.Args[0]))
+		fmt.Println("Please specify the service and the image")
+		os.Exit(1)
+	}
+	// the image is the last argument, the rest are as for start
+	ref := args[len(args)-1]
+	log, service, sock, path, _ := parseCmd(ctx, "update", args[:len(args)-1])
+
+	log.Infof("Updating service %q to %s", service, ref)
+	if err := update(ctx, service, ref, sock, path); err != nil {
+		log.WithError(err).Fatal("updating service")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// rootfsVersions returns the contents of the version file in each of the
+// root filesystems of a service, or "" for those which don't exist.
+func rootfsVersions(t *testing.T, rootfs string) [3]string {
+	var versions [3]string
+	for i, dir := range []string{rootfs, rootfs + ".new", rootfs + ".old"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "version"))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		versions[i] = string(b)
+	}
+	return versions
+}
+
+func TestReplaceRootfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rootfs := filepath.Join(dir, "rootfs")
+
+	for _, test := range []struct {
+		versions [3]string // of rootfs, rootfs.new and rootfs.old
+		restore  bool
+		expected [3]string
+		valid    bool
+	}{
+		{[3]string{"1", "2", ""}, false, [3]string{"2", "", "1"}, true},
+		{[3]string{"1", "2", ""}, true, [3]string{"1", "", ""}, true},
+		// the old version is kept if there is no new one
+		{[3]string{"1", "", ""}, false, [3]string{"1", "", ""}, false},
+	} {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+		for i, d := range []string{rootfs, rootfs + ".new", rootfs + ".old"} {
+			if test.versions[i] == "" {
+				continue
+			}
+			if err := os.MkdirAll(d, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(d, "version"), []byte(test.versions[i]), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := replaceRootfs(rootfs)
+		if (err == nil) != test.valid {
+			t.Errorf("%v: unexpected error %v", test.versions, err)
+		}
+		if err == nil && test.restore {
+			if err := restoreRootfs(rootfs); err != nil {
+				t.Errorf("%v: %v", test.versions, err)
+			}
+		}
+		if got := rootfsVersions(t, rootfs); got != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.versions, test.expected, got)
+		}
+	}
+}
+
+func TestUpdateUnknownService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// checked before connecting to containerd
+	err = update(context.Background(), "sshd", "docker.io/library/alpine:latest", filepath.Join(dir, "containerd.sock"), dir)
+	if err == nil || !strings.Contains(err.Error(), "unknown service sshd") {
+		t.Errorf("expected an unknown service error, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/containerd/containerd"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// criticalAnnotation set to "true" on a service's OCI spec makes the
+	// system reboot, by way of the hardware watchdog, if it stops running
+	// or becomes unhealthy for longer than the watchdog timeout.
+	criticalAnnotation = "org.mobyproject.critical"
+
+	defaultWatchdogDevice = "/dev/watchdog"
+
+	// wdiocGetTimeout is WDIOC_GETTIMEOUT from linux/watchdog.h.
+	wdiocGetTimeout = 0x80045707
+
+	// defaultWatchdogTimeout is assumed if the device can't tell us its
+	// timeout.
+	defaultWatchdogTimeout = 60 * time.Second
+)
+
+// criticalServices returns the services in basePath which are critical,
+// sorted by name.
+func criticalServices(basePath string) []string {
+	services, err := serviceNames(basePath)
+	if err != nil {
+		return nil
+	}
+	var critical []string
+	for _, service := range services {
+		if bundleAnnotations(filepath.Join(basePath, service))[criticalAnnotation] == "true" {
+			critical = append(critical, service)
+		}
+	}
+	return critical
+}
+
+// criticalHealthy returns true if the critical services are running and
+// none is unhealthy, and otherwise the first which is not. Since the state
+// comes from containerd this also fails if containerd is not responding.
+func criticalHealthy(ctx context.Context, client *containerd.Client, basePath string, critical []string) (bool, string) {
+	for _, service := range critical {
+		s, err := getStatus(ctx, client, basePath, service)
+		if err != nil || s.Status != "running" {
+			return false, service
+		}
+		if s.Health != nil && s.Health.Status == healthUnhealthy {
+			return false, service
+		}
+	}
+	return true, ""
+}
+
+// watchdogTimeout returns the timeout of an open watchdog device.
+func watchdogTimeout(f *os.File) time.Duration {
+	var seconds int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), wdiocGetTimeout, uintptr(unsafe.Pointer(&seconds))); errno != 0 || seconds <= 0 {
+		return defaultWatchdogTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// petWatchdog keeps the hardware watchdog at device from rebooting the
+// system only while the critical services in basePath are healthy. The
+// watchdog is not opened, and so not started, until they have all been
+// healthy, so that a system which never comes up is not rebooted
+// repeatedly.
+func petWatchdog(ctx context.Context, client *containerd.Client, basePath, device string) {
+	critical := criticalServices(basePath)
+	if len(critical) == 0 {
+		return
+	}
+	for {
+		if ok, _ := criticalHealthy(ctx, client, basePath, critical); ok {
+			break
+		}
+		time.Sleep(monitorInterval)
+	}
+	f, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		log.WithError(err).Errorf("opening watchdog %s", device)
+		return
+	}
+	// Stop the watchdog when we are asked to exit, at shutdown, by writing
+	// the magic character before closing it.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-sigs
+		_, _ = f.Write([]byte("V"))
+		f.Close()
+		os.Exit(0)
+	}()
+	timeout := watchdogTimeout(f)
+	log.Infof("Watchdog %s armed with a timeout of %s for %v", device, timeout, critical)
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		if ok, service := criticalHealthy(ctx, client, basePath, critical); !ok {
+			log.Errorf("Not petting watchdog: critical service %q is not healthy", service)
+			continue
+		}
+		if _, err := f.Write([]byte{0}); err != nil {
+			log.WithError(err).Errorf("petting watchdog %s", device)
+		}
+	}
+}
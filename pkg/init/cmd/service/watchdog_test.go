@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestCriticalServices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for service, annotations := range map[string]map[string]string{
+		"sshd":   {criticalAnnotation: "true"},
+		"dhcpcd": {criticalAnnotation: "true", healthAnnotation: "file:/run/ready"},
+		"ntpd":   nil,
+		// only "true" makes a service critical
+		"getty":  {criticalAnnotation: "yes"},
+		"rngd":   {criticalAnnotation: "false"},
+		"docker": {criticalAnnotation: "TRUE"},
+		// templates are not services themselves
+		"agetty": {criticalAnnotation: "true", instancesAnnotation: "tty1"},
+	} {
+		writeSpec(t, filepath.Join(dir, service), &specs.Spec{Annotations: annotations})
+	}
+
+	expected := []string{"dhcpcd", "sshd"}
+	if got := criticalServices(dir); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if got := criticalServices(filepath.Join(dir, "missing")); got != nil {
+		t.Errorf("expected no critical services without a service directory, got %v", got)
+	}
+}
+
+func TestCriticalHealthyNone(t *testing.T) {
+	// with nothing critical containerd is not asked
+	if ok, service := criticalHealthy(context.Background(), nil, "/containers/services", nil); !ok || service != "" {
+		t.Errorf("expected no critical services to be healthy, got %t %q", ok, service)
+	}
+}
+
+func TestWatchdogTimeout(t *testing.T) {
+	// a file which isn't a watchdog can't tell us its timeout
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if d := watchdogTimeout(f); d != defaultWatchdogTimeout {
+		t.Errorf("expected %s, got %s", defaultWatchdogTimeout, d)
+	}
+}
@@ -4,15 +4,27 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -21,14 +33,38 @@ const (
 	logDump byte = iota
 	logFollow
 	logDumpFollow
+	logFilterQuery
+	logHello byte = 6
 )
 
+// hello is exchanged with memlogd to find out what it supports. It must be
+// kept in sync with memlogd.
+type hello struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features,omitempty"`
+	Instance string   `json:"instance,omitempty"`
+}
+
+// helloTimeout is how long to wait for memlogd to answer a hello. memlogds
+// which predate the handshake never answer.
+const helloTimeout = time.Second
+
+// logFilter must be kept in sync with memlogd
+type logFilter struct {
+	Mode      byte   `json:"mode"`
+	FromSeq   uint64 `json:"from_seq,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Reliable  bool   `json:"reliable,omitempty"`
+}
+
 const mb = 1024 * 1024
 
 // LogMessage is a message received from memlogd.
 type LogMessage struct {
 	Time    time.Time // time message was received by memlogd
 	Name    string    // name of the service that wrote the message
+	Seq     uint64    // sequence number assigned by memlogd, 0 if unknown
 	Message string    // body of the message
 }
 
@@ -37,7 +73,7 @@ func (m *LogMessage) String() string {
 }
 
 // ParseLogMessage reconstructs a LogMessage from a line of text which looks like:
-// <timestamp>,<origin>;<body>
+// <timestamp>,<origin>[,<seq>];<body>
 func ParseLogMessage(line string) (*LogMessage, error) {
 	bits := strings.SplitN(line, ";", 2)
 	if len(bits) != 2 {
@@ -52,9 +88,16 @@ func ParseLogMessage(line string) (*LogMessage, error) {
 	if err != nil {
 		return nil, err
 	}
+	var seq uint64
+	if len(bits2) > 2 {
+		if seq, err = strconv.ParseUint(bits2[2], 10, 64); err != nil {
+			return nil, err
+		}
+	}
 	return &LogMessage{
 		Time:    Time,
 		Name:    bits2[1],
+		Seq:     seq,
 		Message: bits[1],
 	}, nil
 }
@@ -64,12 +107,26 @@ type LogFile struct {
 	File         *os.File // active file handle
 	Path         string   // Path to the logfile
 	BytesWritten int      // total number of bytes written so far
+
+	w    *bufio.Writer // buffer in front of File, nil if unbuffered
+	seal *sealWriter   // encrypts what is written to File, nil if plain
 }
 
-// NewLogFile creates a new LogFile.
-func NewLogFile(dir, name string) (*LogFile, error) {
+// NewLogFile creates a new LogFile. Writes are buffered in memory up to
+// bufferSize bytes until Flush is called; a bufferSize of 0 disables
+// buffering.
+func NewLogFile(dir, name string, bufferSize int) (*LogFile, error) {
+	return newLogFile(filepath.Join(dir, name+".log"), bufferSize, nil)
+}
+
+// NewEncryptedLogFile creates a new LogFile like NewLogFile, but the file,
+// which is named with an extra .enc suffix, holds records sealed with aead.
+func NewEncryptedLogFile(dir, name string, bufferSize int, aead cipher.AEAD) (*LogFile, error) {
+	return newLogFile(filepath.Join(dir, name+".log.enc"), bufferSize, aead)
+}
+
+func newLogFile(p string, bufferSize int, aead cipher.AEAD) (*LogFile, error) {
 	// If the log exists already we want to append to it.
-	p := filepath.Join(dir, name+".log")
 	f, err := os.OpenFile(p, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
@@ -78,32 +135,76 @@ func NewLogFile(dir, name string) (*LogFile, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &LogFile{
+	l := &LogFile{
 		File:         f,
 		Path:         p,
 		BytesWritten: int(fi.Size()),
-	}, nil
+	}
+	if aead != nil {
+		l.seal = &sealWriter{w: f, aead: aead, written: int(fi.Size())}
+	}
+	if bufferSize > 0 {
+		l.w = bufio.NewWriterSize(l.dest(), bufferSize)
+	}
+	return l, nil
+}
+
+// dest returns the writer for File, which encrypts if needed.
+func (l *LogFile) dest() io.Writer {
+	if l.seal == nil {
+		return l.File
+	}
+	return l.seal
 }
 
 // Write appends a message to the log file
 func (l *LogFile) Write(m *LogMessage) error {
 	s := m.String()
-	_, err := io.WriteString(l.File, s)
-	if err == nil {
-		l.BytesWritten += len(s)
+	var (
+		n   int
+		err error
+	)
+	if l.w != nil {
+		n, err = l.w.WriteString(s)
+	} else {
+		n, err = io.WriteString(l.dest(), s)
+	}
+	if l.seal == nil {
+		l.BytesWritten += n
+		return err
+	}
+	// the size of the encrypted file, including the record the buffered
+	// messages will be sealed in
+	l.BytesWritten = l.seal.written
+	if l.w != nil && l.w.Buffered() > 0 {
+		l.BytesWritten += l.seal.overhead() + l.w.Buffered()
 	}
 	return err
 }
 
+// Flush writes any buffered messages to the log file
+func (l *LogFile) Flush() error {
+	if l.w == nil {
+		return nil
+	}
+	return l.w.Flush()
+}
+
 // Close a log file
 func (l *LogFile) Close() error {
+	if err := l.Flush(); err != nil {
+		l.File.Close()
+		return err
+	}
 	return l.File.Close()
 }
 
 // Rotate closes the current log file, rotates the files and creates an empty log file.
-func (l *LogFile) Rotate(maxLogFiles int) error {
-	if err := l.File.Close(); err != nil {
-		return err
+// It returns the path the previous contents were rotated to, which is empty
+// if no rotated files are kept.
+func (l *LogFile) Rotate(maxLogFiles int) (string, error) {
+	if err := l.Close(); err != nil {
+		return "", err
 	}
 	for i := maxLogFiles - 1; i >= 0; i-- {
 		newerFile := fmt.Sprintf("%s.%d", l.Path, i-1)
@@ -120,82 +221,604 @@ func (l *LogFile) Rotate(maxLogFiles int) error {
 			continue
 		}
 		if err != nil {
-			return err
+			return "", err
 		}
 	}
 	f, err := os.Create(l.Path)
 	if err != nil {
-		return err
+		return "", err
 	}
 	l.File = f
+	if l.seal != nil {
+		l.seal.w = f
+		l.seal.written = 0
+	}
+	if l.w != nil {
+		l.w.Reset(l.dest())
+	}
 	l.BytesWritten = 0
+	if maxLogFiles < 1 {
+		return "", nil
+	}
+	return fmt.Sprintf("%s.%d", l.Path, 0), nil
+}
+
+// Encrypted log files are a sequence of records, one per write, so that
+// they can be appended to like plain ones. Each record is
+//
+//	<length, 4 bytes big endian><nonce><sealed data>
+//
+// where the length covers the nonce and the sealed data, and the data is
+// sealed with AES-256-GCM and a random nonce.
+
+// maxRecordSize limits the records read, so that a corrupt length can't
+// exhaust memory.
+const maxRecordSize = 64 * mb
+
+// sealWriter encrypts each Write as a record.
+type sealWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	written int // bytes of records written to w
+}
+
+// overhead returns the number of bytes a record adds to the data sealed in
+// it: the length, the nonce and the authentication tag.
+func (s *sealWriter) overhead() int {
+	return 4 + s.aead.NonceSize() + s.aead.Overhead()
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	record := make([]byte, 4+s.aead.NonceSize(), 4+s.aead.NonceSize()+len(p)+s.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, record[4:]); err != nil {
+		return 0, err
+	}
+	record = s.aead.Seal(record, record[4:], p, nil)
+	binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+	n, err := s.w.Write(record)
+	s.written += n
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// readKey reads a 256 bit key, either as 32 raw bytes or 64 hex digits as
+// provisioned by the metadata package, and returns an AEAD using it.
+func readKey(path string) (cipher.AEAD, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 32 {
+		b, err = hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("%s must hold a 256 bit key, as 32 bytes or 64 hex digits", path)
+		}
+	}
+	block, err := aes.NewCipher(b)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Decrypt copies the plain text of the encrypted log file r to w.
+func Decrypt(w io.Writer, r io.Reader, aead cipher.AEAD) error {
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n := binary.BigEndian.Uint32(header)
+		if n < uint32(aead.NonceSize()) || n > maxRecordSize {
+			return fmt.Errorf("invalid record length %d", n)
+		}
+		record := make([]byte, n)
+		if _, err := io.ReadFull(r, record); err != nil {
+			return err
+		}
+		nonce, sealed := record[:aead.NonceSize()], record[aead.NonceSize():]
+		plain, err := aead.Open(sealed[:0], nonce, sealed, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+	}
+}
+
+// decryptFiles writes the plain text of the named files to stdout.
+func decryptFiles(aead cipher.AEAD, paths []string) error {
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = Decrypt(os.Stdout, f, aead)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
 	return nil
 }
 
+// LogWriter writes LogMessages to one LogFile per service, rotating the
+// files when they grow too large.
+type LogWriter struct {
+	Dir         string // directory containing the log files
+	MaxLogFiles int    // maximum number of rotated files per service
+	MaxLogSize  int    // maximum size of a file before rotation
+	BufferSize  int    // size of the per-file write buffer
+
+	// Key, if set, encrypts the log files
+	Key cipher.AEAD
+
+	// Checkpoint, if set, is a file recording the sequence number of the
+	// last message flushed, so that a restart can resume after it
+	Checkpoint string
+
+	// Instance is the instance of memlogd which gave the sequence numbers,
+	// recorded in the checkpoint as they start again when it changes
+	Instance string
+
+	// PostRotate, if set, is called in the background with the service
+	// name and the path of each rotated file. The log is not rotated
+	// again until it returns, so the file is not renamed while in use:
+	// rotations due meanwhile are made by the next Flush after it returns.
+	PostRotate func(name, path string)
+
+	logs    map[string]*LogFile      // map of service name to active log file
+	hooks   map[string]chan struct{} // closed when the PostRotate of a service returns
+	pending map[string]bool          // logs to rotate once their PostRotate returns
+	lastSeq uint64                   // sequence number of the last message written
+}
+
+// NewLogWriter creates a LogWriter for the given directory.
+func NewLogWriter(dir string, maxLogFiles, maxLogSize, bufferSize int) *LogWriter {
+	return &LogWriter{
+		Dir:         dir,
+		MaxLogFiles: maxLogFiles,
+		MaxLogSize:  maxLogSize,
+		BufferSize:  bufferSize,
+		logs:        make(map[string]*LogFile),
+		hooks:       make(map[string]chan struct{}),
+		pending:     make(map[string]bool),
+	}
+}
+
+// Write appends a message to the log file of the service which sent it.
+func (w *LogWriter) Write(msg *LogMessage) {
+	logF, ok := w.logs[msg.Name]
+	if !ok {
+		var err error
+		if w.Key != nil {
+			logF, err = NewEncryptedLogFile(w.Dir, msg.Name, w.BufferSize, w.Key)
+		} else {
+			logF, err = NewLogFile(w.Dir, msg.Name, w.BufferSize)
+		}
+		if err != nil {
+			log.Printf("Failed to create log file %s: %v", msg.Name, err)
+			return
+		}
+		w.logs[msg.Name] = logF
+	}
+	if err := logF.Write(msg); err != nil {
+		log.Printf("Failed to write to log file %s: %v", msg.Name, err)
+		if err := logF.Close(); err != nil {
+			log.Printf("Failed to close log file %s: %v", msg.Name, err)
+		}
+		delete(w.logs, msg.Name)
+		return
+	}
+	if msg.Seq != 0 {
+		w.lastSeq = msg.Seq
+	}
+	if logF.BytesWritten > w.MaxLogSize {
+		w.rotate(msg.Name, logF)
+	}
+}
+
+// rotate rotates a log now, or once its last PostRotate has returned if
+// that may still be using the file we are about to rename. Messages are
+// never held up waiting for a hook.
+func (w *LogWriter) rotate(name string, logF *LogFile) {
+	if w.hookRunning(name) {
+		w.pending[name] = true
+		return
+	}
+	delete(w.pending, name)
+	rotated, err := logF.Rotate(w.MaxLogFiles)
+	if err != nil {
+		log.Printf("Failed to rotate log file %s: %v", name, err)
+		delete(w.logs, name)
+		return
+	}
+	if rotated != "" && w.PostRotate != nil {
+		done := make(chan struct{})
+		w.hooks[name] = done
+		go func() {
+			defer close(done)
+			w.PostRotate(name, rotated)
+		}()
+	}
+}
+
+// hookRunning returns true if the PostRotate of a service has not yet
+// returned.
+func (w *LogWriter) hookRunning(name string) bool {
+	done, ok := w.hooks[name]
+	if !ok {
+		return false
+	}
+	select {
+	case <-done:
+		delete(w.hooks, name)
+		return false
+	default:
+		return true
+	}
+}
+
+// rotatePending makes the rotations which were waiting for a PostRotate
+// which has since returned.
+func (w *LogWriter) rotatePending() {
+	for name := range w.pending {
+		if logF, ok := w.logs[name]; ok {
+			w.rotate(name, logF)
+		} else {
+			delete(w.pending, name)
+		}
+	}
+}
+
+// postRotateCommand returns a PostRotate hook which runs the given command
+// line with the path of the rotated file appended as the last argument. The
+// command is killed if it runs for longer than timeout, if non-zero.
+func postRotateCommand(command string, timeout time.Duration) func(name, path string) {
+	args := strings.Fields(command)
+	return func(name, path string) {
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		cmd := exec.CommandContext(ctx, args[0], append(args[1:], path)...)
+		cmd.Env = append(os.Environ(), "LOGWRITE_SERVICE="+name)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("killed after %s", timeout)
+			}
+			log.Printf("Post-rotate command for %s failed: %v", path, err)
+		}
+	}
+}
+
+// Rotate forces rotation of the named services' log files, or of all log
+// files if no names are given.
+func (w *LogWriter) Rotate(names ...string) {
+	if len(names) == 0 {
+		for name := range w.logs {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		if logF, ok := w.logs[name]; ok {
+			w.rotate(name, logF)
+		}
+	}
+}
+
+// Flush writes buffered messages of all services to disk, and makes any
+// rotations which were waiting for a PostRotate.
+func (w *LogWriter) Flush() {
+	for name, logF := range w.logs {
+		if err := logF.Flush(); err != nil {
+			log.Printf("Failed to flush log file %s: %v", name, err)
+		}
+	}
+	w.checkpoint()
+	w.rotatePending()
+}
+
+// checkpoint records the sequence number of the last message written and
+// the memlogd instance which gave it.
+func (w *LogWriter) checkpoint() {
+	if w.Checkpoint == "" || w.lastSeq == 0 {
+		return
+	}
+	// write and rename so a crash can't leave a truncated checkpoint
+	tmp := w.Checkpoint + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %s\n", w.lastSeq, w.Instance)), 0644); err != nil {
+		log.Printf("Failed to write checkpoint %s: %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, w.Checkpoint); err != nil {
+		log.Printf("Failed to rename checkpoint %s: %v", tmp, err)
+	}
+}
+
+// readCheckpoint returns the sequence number and memlogd instance recorded
+// in path, or 0 and "". Checkpoints written before instances were recorded
+// have no instance.
+func readCheckpoint(path string) (uint64, string) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read checkpoint %s: %v", path, err)
+		}
+		return 0, ""
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 || len(fields) > 2 {
+		log.Printf("Failed to parse checkpoint %s: %q", path, b)
+		return 0, ""
+	}
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		log.Printf("Failed to parse checkpoint %s: %v", path, err)
+		return 0, ""
+	}
+	if len(fields) == 1 {
+		return seq, ""
+	}
+	return seq, fields[1]
+}
+
+// Close flushes and closes all log files, and waits for PostRotate hooks.
+func (w *LogWriter) Close() {
+	for name, logF := range w.logs {
+		if err := logF.Close(); err != nil {
+			log.Printf("Failed to close log file %s: %v", name, err)
+		}
+		delete(w.logs, name)
+	}
+	for name, done := range w.hooks {
+		<-done
+		delete(w.hooks, name)
+	}
+	w.checkpoint()
+}
+
+// readRotateFile returns the log names listed one per line in path, and
+// removes the file so that the next signal rotates everything again.
+func readRotateFile(path string) []string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read %s: %v", path, err)
+		}
+		return nil
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("Failed to remove %s: %v", path, err)
+	}
+	return strings.Fields(string(b))
+}
+
+// supports returns true if memlogd said it supports the feature.
+func (h *hello) supports(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// sayHello sends our hello to memlogd and returns its reply.
+func sayHello(conn net.Conn) (*hello, error) {
+	if _, err := conn.Write(append([]byte{logHello}, "{\"version\":1}\n"...)); err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(helloTimeout)); err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	// Read a byte at a time so we don't consume the messages which follow
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	var h hello
+	if err := json.Unmarshal(line, &h); err != nil {
+		return nil, fmt.Errorf("invalid hello from memlogd: %v", err)
+	}
+	return &h, nil
+}
+
+// dialMemlogd connects to the memlogd query socket and says hello. A
+// memlogd which doesn't answer has taken the hello for a command, so it is
+// connected to again and treated as version 0, which supports nothing.
+func dialMemlogd(socketPath string) (net.Conn, *hello, error) {
+	addr := net.UnixAddr{
+		Name: socketPath,
+		Net:  "unix",
+	}
+	conn, err := net.DialUnix("unix", nil, &addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := sayHello(conn)
+	if err == nil {
+		return conn, h, nil
+	}
+	conn.Close()
+	log.Printf("memlogd did not answer our hello, assuming it is an old version: %v", err)
+	if conn, err = net.DialUnix("unix", nil, &addr); err != nil {
+		return nil, nil, err
+	}
+	return conn, &hello{}, nil
+}
+
+// queryLogs asks memlogd, which said hello h, for the messages selected by
+// filter. A filter query is only sent if needed, and the parts of the
+// filter which memlogd doesn't support are left out, so older memlogds
+// still work, but with duplicate or missed messages.
+func queryLogs(conn net.Conn, h *hello, filter logFilter) error {
+	if filter.Namespace != "" && !h.supports("namespace") {
+		return errors.New("memlogd can't select the logs of a namespace")
+	}
+	if filter.FromSeq != 0 && !h.supports("seq") {
+		log.Printf("memlogd can't resume from the checkpoint: writing all buffered messages")
+		filter.FromSeq = 0
+		filter.Instance = ""
+	}
+	if filter.Reliable && !h.supports("reliable") {
+		log.Printf("memlogd can't buffer more messages for us: messages may be missed")
+		filter.Reliable = false
+	}
+	request := []byte{filter.Mode}
+	if filter.FromSeq != 0 || filter.Namespace != "" || filter.Reliable {
+		b, err := json.Marshal(&filter)
+		if err != nil {
+			return err
+		}
+		request = append(append([]byte{logFilterQuery}, b...), '\n')
+	}
+	_, err := conn.Write(request)
+	return err
+}
+
 func main() {
 	socketPath := flag.String("socket", "/var/run/memlogdq.sock", "memlogd log query socket")
 	logDir := flag.String("log-dir", "/var/log", "Directory containing log files")
 	maxLogFiles := flag.Int("max-log-files", 10, "Maximum number of rotated log files before deletion")
 	maxLogSize := flag.Int("max-log-size", mb, "Maximum size of a log file before rotation")
+	dump := flag.Bool("dump", true, "Dump the existing ring buffer before following new messages")
+	bufferSize := flag.Int("buffer-size", 64*1024, "Size of the per-file write buffer, 0 to disable buffering")
+	flushInterval := flag.Duration("flush-interval", time.Second, "Maximum time a message is buffered before being written to disk")
+	postRotate := flag.String("post-rotate", "", "Command to run after rotation, with the path of the rotated file appended")
+	postRotateTimeout := flag.Duration("post-rotate-timeout", time.Minute, "Kill the -post-rotate command if it runs for longer than this, 0 for never")
+	checkpoint := flag.String("checkpoint", "", "File recording the last message written, used to resume without duplicates after a restart")
+	rotateFile := flag.String("rotate-file", "/var/run/logwrite.rotate", "File listing the logs to rotate on SIGUSR1; all logs are rotated if it is missing")
+	reliable := flag.Bool("reliable", false, "Ask memlogd for a larger buffer so that messages are not missed if we fall behind for a while")
+	namespace := flag.String("namespace", "", "Only write logs from services in this containerd namespace")
+	keyFile := flag.String("encryption-key", "", "File holding a 256 bit key to encrypt the log files with, eg /run/config/logwrite/key")
+	decrypt := flag.Bool("decrypt", false, "Decrypt the log files given as arguments to stdout with -encryption-key, and exit")
 	flag.Parse()
 
-	addr := net.UnixAddr{
-		Name: *socketPath,
-		Net:  "unix",
+	var key cipher.AEAD
+	if *keyFile != "" {
+		var err error
+		if key, err = readKey(*keyFile); err != nil {
+			log.Fatalf("Failed to read encryption key: %v", err)
+		}
 	}
-	conn, err := net.DialUnix("unix", nil, &addr)
+	if *decrypt {
+		if key == nil {
+			log.Fatal("-decrypt needs -encryption-key")
+		}
+		if err := decryptFiles(key, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	conn, h, err := dialMemlogd(*socketPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer conn.Close()
 
-	n, err := conn.Write([]byte{logDumpFollow})
-	if err != nil || n < 1 {
+	mode := logFollow
+	if *dump {
+		mode = logDumpFollow
+	}
+	filter := logFilter{Mode: mode, Namespace: *namespace, Reliable: *reliable}
+	if *checkpoint != "" {
+		if seq, instance := readCheckpoint(*checkpoint); seq != 0 {
+			// resume after the last message we wrote, unless the
+			// sequence numbers have started again since
+			filter.Mode = logDumpFollow
+			if instance != "" && instance == h.Instance {
+				filter.FromSeq = seq + 1
+				filter.Instance = instance
+			} else {
+				log.Printf("memlogd has restarted since the checkpoint: writing all buffered messages")
+			}
+		}
+	}
+	if err := queryLogs(conn, h, filter); err != nil {
 		log.Fatalf("Failed to write request to memlogd socket: %v", err)
 	}
 
-	// map of service name to active log file
-	logs := make(map[string]*LogFile)
+	w := NewLogWriter(*logDir, *maxLogFiles, *maxLogSize, *bufferSize)
+	w.Checkpoint = *checkpoint
+	w.Instance = h.Instance
+	w.Key = key
+	if strings.TrimSpace(*postRotate) != "" {
+		w.PostRotate = postRotateCommand(*postRotate, *postRotateTimeout)
+	}
+	defer w.Close()
 
-	r := bufio.NewReader(conn)
-	for {
-		line, err := r.ReadString('\n')
-		if err == io.EOF {
-			return
-		}
-		if err != nil {
-			log.Fatalf("Failed to read from memlogd: %v", err)
-		}
-		msg, err := ParseLogMessage(line)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		if strings.HasPrefix(msg.Name, "logwrite") {
-			// don't log our own output in a loop
-			continue
+	// Read lines in the background so that buffered messages can be
+	// flushed periodically even when memlogd is quiet.
+	lines := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				readErr <- err
+				return
+			}
+			lines <- line
 		}
+	}()
+
+	flush := time.NewTicker(*flushInterval)
+	defer flush.Stop()
 
-		var logF *LogFile
-		var ok bool
-		if logF, ok = logs[msg.Name]; !ok {
-			logF, err = NewLogFile(*logDir, msg.Name)
+	rotate := make(chan os.Signal, 1)
+	signal.Notify(rotate, syscall.SIGUSR1)
+
+	// flush the buffers and write the checkpoint when we are stopped, or
+	// buffered messages would be lost at shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	for {
+		select {
+		case line := <-lines:
+			msg, err := ParseLogMessage(line)
 			if err != nil {
-				log.Printf("Failed to create log file %s: %v", msg.Name, err)
+				log.Println(err)
 				continue
 			}
-			logs[msg.Name] = logF
-		}
-		if err = logF.Write(msg); err != nil {
-			log.Printf("Failed to write to log file %s: %v", msg.Name, err)
-			if err := logF.Close(); err != nil {
-				log.Printf("Failed to close log file %s: %v", msg.Name, err)
+			if strings.HasPrefix(msg.Name, "logwrite") {
+				// don't log our own output in a loop
+				continue
 			}
-			delete(logs, msg.Name)
-			continue
-		}
-		if logF.BytesWritten > *maxLogSize {
-			logF.Rotate(*maxLogFiles)
+			w.Write(msg)
+		case <-flush.C:
+			w.Flush()
+		case <-rotate:
+			w.Rotate(readRotateFile(*rotateFile)...)
+		case <-stop:
+			return
+		case err := <-readErr:
+			if err == io.EOF {
+				return
+			}
+			w.Close()
+			log.Fatalf("Failed to read from memlogd: %v", err)
 		}
 	}
 }
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linuxkit/linuxkit/pkg/memlogd/memlogdtest"
+)
+
+func TestBufferedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logwrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := NewLogFile(dir, "test", 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	m := &LogMessage{Time: time.Now(), Name: "test", Message: "hello\n"}
+	if err := l.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if l.BytesWritten != len(m.String()) {
+		t.Errorf("BytesWritten is %d, expected %d", l.BytesWritten, len(m.String()))
+	}
+	b, err := ioutil.ReadFile(l.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 0 {
+		t.Errorf("Message was written before Flush: %q", string(b))
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	b, err = ioutil.ReadFile(l.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != m.String() {
+		t.Errorf("Read %q, expected %q", string(b), m.String())
+	}
+}
+
+func TestEncryptedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logwrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte(strings.Repeat("0f", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := readKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected string
+	for _, bufferSize := range []int{0, 4096} {
+		l, err := NewEncryptedLogFile(dir, "test", bufferSize, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			m := &LogMessage{Time: time.Now(), Name: "test", Message: fmt.Sprintf("secret %d\n", i)}
+			if err := l.Write(m); err != nil {
+				t.Fatal(err)
+			}
+			expected += m.String()
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// rotation is by the size of the encrypted file
+		fi, err := os.Stat(l.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.BytesWritten != int(fi.Size()) {
+			t.Errorf("BytesWritten is %d, expected the size of the file %d", l.BytesWritten, fi.Size())
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "test.log.enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret") {
+		t.Errorf("Log file holds plain text: %q", string(b))
+	}
+	var plain bytes.Buffer
+	if err := Decrypt(&plain, bytes.NewReader(b), key); err != nil {
+		t.Fatal(err)
+	}
+	if plain.String() != expected {
+		t.Errorf("Decrypted %q, expected %q", plain.String(), expected)
+	}
+	b[len(b)-1] ^= 1
+	if err := Decrypt(ioutil.Discard, bytes.NewReader(b), key); err == nil {
+		t.Errorf("Decrypted a corrupt file")
+	}
+}
+
+func benchmarkWrite(b *testing.B, bufferSize int) {
+	dir, err := ioutil.TempDir("", "logwrite")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := NewLogWriter(dir, 2, 16*mb, bufferSize)
+	defer w.Close()
+
+	m := &LogMessage{
+		Time:    time.Now(),
+		Name:    "bench",
+		Message: strings.Repeat("x", 120) + "\n",
+	}
+	b.SetBytes(int64(len(m.String())))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.Write(m)
+	}
+	w.Flush()
+}
+
+// Each message is written to the file as soon as it is received. This has
+// the lowest latency but costs one write(2) per message.
+func BenchmarkWriteUnbuffered(b *testing.B) { benchmarkWrite(b, 0) }
+
+// Messages are batched and only reach the file when the buffer fills or
+// the flush interval expires, trading latency for throughput.
+func BenchmarkWriteBuffered4K(b *testing.B)  { benchmarkWrite(b, 4*1024) }
+func BenchmarkWriteBuffered64K(b *testing.B) { benchmarkWrite(b, 64*1024) }
+
+func TestPostRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logwrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := NewLogWriter(dir, 2, 10, 0)
+	var rotated, contents []string
+	release := make(chan struct{})
+	w.PostRotate = func(name, path string) {
+		<-release
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("Failed to read rotated file %s: %v", path, err)
+		}
+		rotated = append(rotated, path)
+		contents = append(contents, string(b))
+	}
+
+	// the second rotation must wait for the hook reading the first file,
+	// without holding up the messages
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Write(&LogMessage{Time: time.Now(), Name: "test", Message: "first\n"})
+		w.Write(&LogMessage{Time: time.Now(), Name: "test", Message: "second\n"})
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Write waited for PostRotate")
+	}
+	if !w.pending["test"] {
+		t.Fatal("Rotated again before PostRotate returned")
+	}
+	release <- struct{}{}
+	for deadline := time.Now().Add(time.Second); w.pending["test"]; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Rotation was not made by Flush once PostRotate returned")
+		}
+		w.Flush()
+	}
+	release <- struct{}{}
+	w.Close()
+
+	if len(rotated) != 2 {
+		t.Fatalf("PostRotate called %d times, expected 2", len(rotated))
+	}
+	for i, expected := range []string{"first", "second"} {
+		if rotated[i] != rotated[0] || !strings.HasSuffix(contents[i], expected+"\n") {
+			t.Errorf("PostRotate %d saw %s holding %q, expected %s", i, rotated[i], contents[i], expected)
+		}
+	}
+}
+
+func TestPostRotateTimeout(t *testing.T) {
+	hook := postRotateCommand("sleep 10", 50*time.Millisecond)
+	start := time.Now()
+	// the path is appended, making it "sleep 10 1"
+	hook("test", "1")
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Post-rotate command ran for %s, expected it to be killed", elapsed)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logwrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+
+	w := NewLogWriter(dir, 1, mb, 0)
+	w.Checkpoint = path
+	w.Instance = "TestCheckpoint"
+	w.Write(&LogMessage{Time: time.Now(), Name: "sshd", Seq: 42, Message: "hello\n"})
+	w.Close()
+	if seq, instance := readCheckpoint(path); seq != 42 || instance != "TestCheckpoint" {
+		t.Errorf("Read checkpoint %d %q, expected 42 %q", seq, instance, "TestCheckpoint")
+	}
+
+	// checkpoints from before instances were recorded can't be resumed
+	if err := ioutil.WriteFile(path, []byte("42\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if seq, instance := readCheckpoint(path); seq != 42 || instance != "" {
+		t.Errorf("Read checkpoint %d %q, expected 42 with no instance", seq, instance)
+	}
+}
+
+func TestQueryLogs(t *testing.T) {
+	server := memlogdtest.NewServer()
+	server.Instance = "TestQueryLogs"
+	defer server.Close()
+	server.Log("onboot.000-dhcpcd", "first")
+	server.Log("sshd", "second")
+
+	// resume after a checkpoint, then follow
+	conn := server.Dial()
+	defer conn.Close()
+	h, err := sayHello(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Instance != server.Instance {
+		t.Errorf("Expected instance %q in the hello, got %q", server.Instance, h.Instance)
+	}
+	if err := queryLogs(conn, h, logFilter{Mode: logDumpFollow, FromSeq: 2, Instance: h.Instance}); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	next := func() *LogMessage {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := ParseLogMessage(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	if msg := next(); msg.Name != "sshd" || msg.Seq != 2 || msg.Message != "second\n" {
+		t.Errorf("Expected the message after the checkpoint, got %+v", msg)
+	}
+	server.Log("sshd", "third")
+	if msg := next(); msg.Seq != 3 || msg.Message != "third\n" {
+		t.Errorf("Expected to follow new messages, got %+v", msg)
+	}
+
+	// a memlogd which can't resume sends everything instead
+	old := server.Dial()
+	defer old.Close()
+	if err := queryLogs(old, &hello{}, logFilter{Mode: logDump, FromSeq: 2}); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(old).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := ParseLogMessage(line); err != nil || msg.Name != "onboot.000-dhcpcd" || msg.Seq != 0 {
+		t.Errorf("Expected the first message without a sequence number, got %+v: %v", msg, err)
+	}
+	if err := queryLogs(old, &hello{}, logFilter{Mode: logFollow, Namespace: "services.linuxkit"}); err == nil {
+		t.Errorf("Expected an error selecting a namespace from a memlogd which can't")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const logConsole byte = 5
+
+// consoleRequest must be kept in sync with memlogd
+type consoleRequest struct {
+	Enable bool   `json:"enable"`
+	Source string `json:"source,omitempty"`
+}
+
+func main() {
+	var socketPath string
+	var source string
+
+	flag.StringVar(&socketPath, "socket", "/var/run/memlogdq.sock", "memlogd log query socket")
+	flag.StringVar(&source, "s", "", "only change logs whose name matches this glob")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: %s [options] on|off\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "Enable or disable copying logs to the console. With -s the change\n")
+		fmt.Fprintf(os.Stderr, "lasts until this command is interrupted.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || (flag.Arg(0) != "on" && flag.Arg(0) != "off") {
+		flag.Usage()
+		os.Exit(1)
+	}
+	req := consoleRequest{Enable: flag.Arg(0) == "on", Source: source}
+	b, err := json.Marshal(&req)
+	if err != nil {
+		panic(err)
+	}
+
+	addr := net.UnixAddr{
+		Name: socketPath,
+		Net:  "unix",
+	}
+	conn, err := net.DialUnix("unix", nil, &addr)
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(append(append([]byte{logConsole}, b...), '\n')); err != nil {
+		panic(err)
+	}
+	r := bufio.NewReader(conn)
+	reply, err := r.ReadString('\n')
+	if err != nil {
+		panic(err)
+	}
+	if reply = strings.TrimSpace(reply); reply != "OK" {
+		fmt.Fprintf(os.Stderr, "Failed to change console logging: %s\n", strings.TrimPrefix(reply, "ERROR: "))
+		os.Exit(1)
+	}
+	if source == "" {
+		return
+	}
+	// memlogd drops the setting when we disconnect
+	closed := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, r)
+		close(closed)
+	}()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-sigs:
+	case <-closed:
+		fmt.Fprintf(os.Stderr, "memlogd closed the connection\n")
+		os.Exit(1)
+	}
+}
@@ -2,27 +2,72 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"net"
 	"os"
+	"time"
 )
 
 const (
 	logDump byte = iota
 	logFollow
 	logDumpFollow
+	logFilterQuery
+	logHello byte = 6
 )
 
+// helloTimeout is how long to wait for memlogd to answer a hello. memlogds
+// which predate the handshake never answer.
+const helloTimeout = time.Second
+
+// hello must be kept in sync with memlogd
+type hello struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features,omitempty"`
+}
+
+func (h *hello) supports(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// logFilter must be kept in sync with memlogd
+type logFilter struct {
+	Mode      byte      `json:"mode"`
+	Source    string    `json:"source,omitempty"`
+	Since     time.Time `json:"since,omitempty"`
+	Until     time.Time `json:"until,omitempty"`
+	Max       int       `json:"max,omitempty"`
+	Format    string    `json:"format,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+}
+
 func main() {
 	var err error
 
 	var socketPath string
 	var follow bool
 	var dumpFollow bool
+	var source string
+	var since time.Duration
+	var max int
+	var jsonFormat bool
+	var namespace string
 
 	flag.StringVar(&socketPath, "socket", "/var/run/memlogdq.sock", "memlogd log query socket")
 	flag.BoolVar(&dumpFollow, "F", false, "dump log, then follow")
 	flag.BoolVar(&follow, "f", false, "follow log buffer")
+	flag.StringVar(&source, "s", "", "only show logs whose name matches this glob")
+	flag.DurationVar(&since, "since", 0, "only show logs newer than this duration")
+	flag.IntVar(&max, "n", 0, "only show this many of the most recent buffered lines")
+	flag.StringVar(&namespace, "namespace", "", "only show logs from services in this containerd namespace")
+	flag.BoolVar(&jsonFormat, "json", false, "print each message as a JSON record")
 	flag.Parse()
 
 	addr := net.UnixAddr{
@@ -33,16 +78,61 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	h, err := sayHello(conn)
+	if err != nil {
+		// an old memlogd has taken the hello for a command
+		conn.Close()
+		if conn, err = net.DialUnix("unix", nil, &addr); err != nil {
+			panic(err)
+		}
+		h = &hello{}
+	}
 	defer conn.Close()
 
-	var n int
+	var mode byte
 	switch {
 	case dumpFollow:
-		n, err = conn.Write([]byte{logDumpFollow})
+		mode = logDumpFollow
 	case follow && !dumpFollow:
-		n, err = conn.Write([]byte{logFollow})
+		mode = logFollow
 	default:
-		n, err = conn.Write([]byte{logDump})
+		mode = logDump
+	}
+
+	var n int
+	if source != "" || since != 0 || max != 0 || jsonFormat || namespace != "" {
+		needed := []string{"filter"}
+		if jsonFormat {
+			needed = append(needed, "json")
+		}
+		if namespace != "" {
+			needed = append(needed, "namespace")
+		}
+		for _, feature := range needed {
+			if !h.supports(feature) {
+				fmt.Fprintf(os.Stderr, "memlogd is too old to support %q\n", feature)
+				os.Exit(1)
+			}
+		}
+		filter := logFilter{
+			Mode:      mode,
+			Source:    source,
+			Max:       max,
+			Namespace: namespace,
+		}
+		if jsonFormat {
+			filter.Format = "json"
+		}
+		if since != 0 {
+			filter.Since = time.Now().Add(-since)
+		}
+		var b []byte
+		if b, err = json.Marshal(&filter); err != nil {
+			panic(err)
+		}
+		n, err = conn.Write(append(append([]byte{logFilterQuery}, b...), '\n'))
+	} else {
+		n, err = conn.Write([]byte{mode})
 	}
 
 	if err != nil || n < 1 {
@@ -53,3 +143,31 @@ func main() {
 	r.WriteTo(os.Stdout)
 
 }
+
+// sayHello sends our hello to memlogd and returns its reply.
+func sayHello(conn *net.UnixConn) (*hello, error) {
+	if _, err := conn.Write(append([]byte{logHello}, "{\"version\":1}\n"...)); err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(helloTimeout)); err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	// Read a byte at a time so we don't consume the messages which follow
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	var h hello
+	if err := json.Unmarshal(line, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const logSnapshot byte = 4
+
+func main() {
+	var socketPath string
+
+	flag.StringVar(&socketPath, "socket", "/var/run/memlogdq.sock", "memlogd log query socket")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: %s [options] FILE\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "Atomically write the contents of the memlogd buffer to FILE.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	// memlogd may have a different working directory
+	path, err := filepath.Abs(flag.Arg(0))
+	if err != nil {
+		panic(err)
+	}
+
+	addr := net.UnixAddr{
+		Name: socketPath,
+		Net:  "unix",
+	}
+	conn, err := net.DialUnix("unix", nil, &addr)
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(append(append([]byte{logSnapshot}, path...), '\n')); err != nil {
+		panic(err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		panic(err)
+	}
+	if reply = strings.TrimSpace(reply); reply != "OK" {
+		fmt.Fprintf(os.Stderr, "Failed to write snapshot to %s: %s\n", path, strings.TrimPrefix(reply, "ERROR: "))
+		os.Exit(1)
+	}
+}
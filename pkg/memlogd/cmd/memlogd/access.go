@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// readACL is a flag.Value restricting which logs a client may read,
+// depending on the uid of its process, set with repeated uid=glob
+// arguments. root may always read everything. If the ACL is empty anyone
+// who can connect may read everything; otherwise other users may only
+// read the logs whose names match one of their globs.
+type readACL map[uint32][]string
+
+func (a readACL) String() string {
+	var rules []string
+	for uid, globs := range a {
+		for _, glob := range globs {
+			rules = append(rules, fmt.Sprintf("%d=%s", uid, glob))
+		}
+	}
+	sort.Strings(rules)
+	return strings.Join(rules, ",")
+}
+
+func (a readACL) Set(value string) error {
+	bits := strings.SplitN(value, "=", 2)
+	if len(bits) != 2 || bits[1] == "" {
+		return fmt.Errorf("expected uid=glob, got %q", value)
+	}
+	uid, err := lookupUID(bits[0])
+	if err != nil {
+		return err
+	}
+	if _, err := path.Match(bits[1], ""); err != nil {
+		return fmt.Errorf("invalid glob %q: %v", bits[1], err)
+	}
+	a[uid] = append(a[uid], bits[1])
+	return nil
+}
+
+// allowed returns the globs of the logs a client with the given uid may
+// read, or nil if it may read everything.
+func (a readACL) allowed(uid uint32) []string {
+	if len(a) == 0 || uid == 0 {
+		return nil
+	}
+	if globs := a[uid]; len(globs) > 0 {
+		return globs
+	}
+	// an impossible name, as names may not contain ";"
+	return []string{";"}
+}
+
+// peerUID returns the uid of the process at the other end of conn.
+func peerUID(conn *net.UnixConn) (uint32, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return cred.Uid, nil
+}
+
+// setSocketAccess sets the permissions and group of a socket. mode and
+// group are ignored if empty.
+func setSocketAccess(socket, mode, group string) error {
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid mode %q: %v", mode, err)
+		}
+		if err := os.Chmod(socket, os.FileMode(m)); err != nil {
+			return err
+		}
+	}
+	if group != "" {
+		gid, err := lookupGID(group)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(socket, -1, int(gid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupUID parses a numeric uid or looks up a user name.
+func lookupUID(name string) (uint32, error) {
+	if n, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(n), err
+}
+
+// lookupGID parses a numeric gid or looks up a group name.
+func lookupGID(name string) (uint32, error) {
+	if n, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(g.Gid, 10, 32)
+	return uint32(n), err
+}
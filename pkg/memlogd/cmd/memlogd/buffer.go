@@ -0,0 +1,113 @@
+package main
+
+import (
+	"container/ring"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// logBuffer holds the most recent log entries. By default all sources share
+// one ring, but sources may be given rings of their own so that a noisy
+// source cannot evict the history of the others.
+type logBuffer struct {
+	shared      *ring.Ring            // ring for sources without their own
+	sources     map[string]*ring.Ring // per-source rings
+	sourceSizes sourceSizes           // sizes of specific per-source rings
+	defaultSize int                   // size of other per-source rings, 0 to use the shared ring
+}
+
+func newLogBuffer(sharedSize, defaultSize int, sizes sourceSizes) *logBuffer {
+	return &logBuffer{
+		shared:      ring.New(sharedSize),
+		sources:     make(map[string]*ring.Ring),
+		sourceSizes: sizes,
+		defaultSize: defaultSize,
+	}
+}
+
+// add stores an entry, overwriting the oldest entry in its ring if full.
+// It returns the overwritten entry, if any.
+func (b *logBuffer) add(msg logEntry) *logEntry {
+	r, ok := b.sources[msg.source]
+	if !ok {
+		size, ok := b.sourceSizes[msg.source]
+		if !ok {
+			size = b.defaultSize
+		}
+		if size <= 0 {
+			evicted := replace(b.shared, msg)
+			b.shared = b.shared.Next()
+			return evicted
+		}
+		r = ring.New(size)
+	}
+	evicted := replace(r, msg)
+	b.sources[msg.source] = r.Next()
+	return evicted
+}
+
+// replace stores msg in r, returning the previous entry if there was one.
+func replace(r *ring.Ring, msg logEntry) *logEntry {
+	old, ok := r.Value.(logEntry)
+	r.Value = msg
+	if !ok {
+		return nil
+	}
+	return &old
+}
+
+// do calls f on every buffered entry, oldest first.
+func (b *logBuffer) do(f func(logEntry)) {
+	if len(b.sources) == 0 {
+		b.shared.Do(func(v interface{}) {
+			if msg, ok := v.(logEntry); ok {
+				f(msg)
+			}
+		})
+		return
+	}
+	var entries []logEntry
+	collect := func(v interface{}) {
+		if msg, ok := v.(logEntry); ok {
+			entries = append(entries, msg)
+		}
+	}
+	b.shared.Do(collect)
+	for _, r := range b.sources {
+		r.Do(collect)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	for _, msg := range entries {
+		f(msg)
+	}
+}
+
+// sourceSizes is a flag.Value mapping source names to ring sizes, set with
+// repeated name=lines arguments.
+type sourceSizes map[string]int
+
+func (s sourceSizes) String() string {
+	var pairs []string
+	for name, size := range s {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", name, size))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (s sourceSizes) Set(value string) error {
+	bits := strings.SplitN(value, "=", 2)
+	if len(bits) != 2 || bits[0] == "" {
+		return fmt.Errorf("expected name=lines, got %q", value)
+	}
+	size, err := strconv.Atoi(bits[1])
+	if err != nil || size < 1 {
+		return fmt.Errorf("invalid number of lines for %s: %q", bits[0], bits[1])
+	}
+	s[bits[0]] = size
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	// configFile holds settings added to the image, one name=value per
+	// line, for example "max-lines=20000".
+	configFile = "/etc/linuxkit/memlogd.conf"
+	// kernelCmdline may hold settings such as memlogd.max-lines=20000.
+	kernelCmdline = "/proc/cmdline"
+	// cmdlinePrefix marks our settings on the kernel command line.
+	cmdlinePrefix = "memlogd."
+)
+
+// bootSettingNames are the flags which may be set at boot, so that the
+// buffer sizes can be tuned without rebuilding the package.
+var bootSettingNames = map[string]bool{
+	"max-lines":            true,
+	"max-lines-per-source": true,
+	"source-lines":         true,
+}
+
+// setting is a flag name and value.
+type setting struct {
+	name   string
+	value  string
+	origin string
+}
+
+// bootSettings returns the settings from the config file and then the
+// kernel command line, so that the command line wins. Missing files are
+// ignored, and invalid settings are reported and skipped so that one typo
+// doesn't lose the others.
+func bootSettings(configPath, cmdlinePath string) ([]setting, error) {
+	var settings []setting
+	if f, err := os.Open(configPath); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			s, err := parseSetting(line, configPath)
+			if err != nil {
+				log.Printf("Ignoring setting: %s", err)
+				continue
+			}
+			settings = append(settings, s)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(cmdlinePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, arg := range strings.Fields(string(b)) {
+		if !strings.HasPrefix(arg, cmdlinePrefix) {
+			continue
+		}
+		s, err := parseSetting(strings.TrimPrefix(arg, cmdlinePrefix), "the kernel command line")
+		if err != nil {
+			log.Printf("Ignoring setting: %s", err)
+			continue
+		}
+		settings = append(settings, s)
+	}
+	return settings, nil
+}
+
+func parseSetting(s, origin string) (setting, error) {
+	bits := strings.SplitN(s, "=", 2)
+	if len(bits) != 2 {
+		return setting{}, fmt.Errorf("expected name=value in %s, got %q", origin, s)
+	}
+	name := strings.TrimSpace(bits[0])
+	if !bootSettingNames[name] {
+		return setting{}, fmt.Errorf("%s cannot be set in %s", name, origin)
+	}
+	return setting{name: name, value: strings.TrimSpace(bits[1]), origin: origin}, nil
+}
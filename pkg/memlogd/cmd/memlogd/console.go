@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+)
+
+// consoleRequest is sent after the logConsole command byte as a line of
+// JSON. It enables or disables copying the logs whose names match Source
+// to the console, or all logs if Source is empty. A setting for a Source
+// lasts until the client closes the connection.
+type consoleRequest struct {
+	Enable bool   `json:"enable"`
+	Source string `json:"source,omitempty"`
+}
+
+// consoleRule enables or disables the console for logs matching a glob.
+type consoleRule struct {
+	source string
+	enable bool
+	conn   net.Conn // the client which asked for it
+}
+
+// mirrorToConsole is whether logs are copied to the console at start.
+var mirrorToConsole = true
+
+// consoleMirror decides which messages memlogd copies to its stdout, which
+// is normally the console. It is owned by ringBufferHandler.
+type consoleMirror struct {
+	enable bool          // default for logs no rule matches
+	rules  []consoleRule // the last matching rule wins
+}
+
+// apply updates the settings for the client on conn. A request without a
+// source sets the default and removes any per-source rules.
+func (c *consoleMirror) apply(req *consoleRequest, conn net.Conn) error {
+	if req.Source == "" {
+		c.enable = req.Enable
+		c.rules = nil
+		return nil
+	}
+	if _, err := path.Match(req.Source, ""); err != nil {
+		return fmt.Errorf("invalid glob %q: %v", req.Source, err)
+	}
+	c.rules = append(c.rules, consoleRule{source: req.Source, enable: req.Enable, conn: conn})
+	return nil
+}
+
+// remove removes the rules of the client on conn.
+func (c *consoleMirror) remove(conn net.Conn) {
+	rules := c.rules[:0]
+	for _, rule := range c.rules {
+		if rule.conn != conn {
+			rules = append(rules, rule)
+		}
+	}
+	c.rules = rules
+}
+
+// enabled returns true if the message should be copied to the console.
+func (c *consoleMirror) enabled(msg *logEntry) bool {
+	enable := c.enable
+	for _, rule := range c.rules {
+		if ok, _ := path.Match(rule.source, msg.source); ok {
+			enable = rule.enable
+		}
+	}
+	return enable
+}
+
+// holdConsoleRule acknowledges a per-source console request and waits for
+// the client to close the connection, then asks ringBufferHandler to
+// remove its rule with a logConsole query without a request.
+func holdConsoleRule(conn net.Conn, queryMsgChan chan queryMessage) {
+	if _, err := io.WriteString(conn, "OK\n"); err == nil {
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}
+	conn.Close()
+	queryMsgChan <- queryMessage{conn: conn, mode: logConsole}
+}
+
+// sendReply sends the result of a command and closes the connection.
+func sendReply(conn net.Conn, err error) {
+	defer conn.Close()
+	line := "OK\n"
+	if err != nil {
+		line = fmt.Sprintf("ERROR: %s\n", err)
+	}
+	_, _ = io.WriteString(conn, line)
+}
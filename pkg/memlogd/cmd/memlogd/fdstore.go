@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// With -supervise memlogd runs as two processes: a supervisor, which holds
+// the sockets and restarts the worker if it exits, and the worker, which
+// does everything else. The worker sends a copy of every log fd it reads
+// to the supervisor's fd store, and a restarted worker is sent them back,
+// so that it carries on reading the output of services which registered
+// with the previous worker. Without this the output of every running
+// service would be lost after a crash, as they can't register again.
+//
+// The worker and supervisor are connected by a SOCK_SEQPACKET socket,
+// carrying the messages
+//
+//	add <id> <name>\n<metadata JSON>   with the fd attached
+//	remove <id>                        once the worker reaches EOF
+//
+// in both directions for add, and from the worker for remove.
+
+// fdStoreConn is the connection to the supervisor, or nil if there is none.
+var fdStoreConn *net.UnixConn
+
+// restartDelay is how long the supervisor waits before restarting the
+// worker, so that a worker which always crashes doesn't spin.
+const restartDelay = time.Second
+
+// storedFd is a log fd held by the supervisor.
+type storedFd struct {
+	name string
+	meta []byte
+	fd   int
+}
+
+// fdIDs makes ids for new fds which are unique across restarts.
+var fdIDs = struct {
+	sync.Mutex
+	next int
+}{}
+
+func newFdID() string {
+	fdIDs.Lock()
+	defer fdIDs.Unlock()
+	fdIDs.next++
+	return fmt.Sprintf("%d.%d", os.Getpid(), fdIDs.next)
+}
+
+// storeAdd sends a log fd to the store.
+func storeAdd(conn *net.UnixConn, id, name string, meta *sourceMeta, fd int) error {
+	b := []byte("null")
+	if meta != nil {
+		var err error
+		if b, err = json.Marshal(meta); err != nil {
+			return err
+		}
+	}
+	msg := fmt.Sprintf("add %s %s\n%s", id, name, b)
+	_, _, err := conn.WriteMsgUnix([]byte(msg), syscall.UnixRights(fd), nil)
+	return err
+}
+
+// storeRemove tells the store a log fd is no longer needed.
+func storeRemove(conn *net.UnixConn, id string) error {
+	_, err := conn.Write([]byte("remove " + id))
+	return err
+}
+
+// readStoreMessage reads one message, returning the fd attached to an add
+// or -1.
+func readStoreMessage(conn *net.UnixConn) (op, id, name string, meta []byte, fd int, err error) {
+	b := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(b, oob)
+	if err != nil {
+		return "", "", "", nil, -1, err
+	}
+	if n == 0 {
+		return "", "", "", nil, -1, fmt.Errorf("connection closed")
+	}
+	fd = -1
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err == nil && len(msgs) == 1 {
+			if fds, err := syscall.ParseUnixRights(&msgs[0]); err == nil && len(fds) == 1 {
+				fd = fds[0]
+			}
+		}
+	}
+	lines := strings.SplitN(string(b[:n]), "\n", 2)
+	fields := strings.SplitN(lines[0], " ", 3)
+	switch {
+	case fields[0] == "add" && len(fields) == 3 && len(lines) == 2 && fd != -1:
+		return "add", fields[1], fields[2], []byte(lines[1]), fd, nil
+	case fields[0] == "remove" && len(fields) == 2:
+		if fd != -1 {
+			syscall.Close(fd)
+		}
+		return "remove", fields[1], "", nil, -1, nil
+	}
+	if fd != -1 {
+		syscall.Close(fd)
+	}
+	return "", "", "", nil, -1, fmt.Errorf("invalid fd store message %q", b[:n])
+}
+
+// receiveStoredFds passes the fds sent back by the supervisor to the
+// logging request handler, until the supervisor goes away.
+func receiveStoredFds(conn *net.UnixConn, logCh chan logEntry, fdMsgChan chan fdMessage) {
+	for {
+		op, id, name, b, fd, err := readStoreMessage(conn)
+		if err != nil {
+			doLog(logCh, fmt.Sprintf("ERROR: fd store: %s", err))
+			return
+		}
+		if op != "add" {
+			continue
+		}
+		var meta *sourceMeta
+		if err := json.Unmarshal(b, &meta); err == nil && meta != nil {
+			sourceMetadata.update(name, meta)
+		}
+		fdMsgChan <- fdMessage{name: name, fd: fd, id: id}
+	}
+}
+
+// fdStore is the supervisor's copy of the log fds.
+type fdStore struct {
+	mu  sync.Mutex
+	fds map[string]*storedFd
+}
+
+func newFdStore() *fdStore {
+	return &fdStore{fds: make(map[string]*storedFd)}
+}
+
+// receive records the fds sent by a worker, until it exits.
+func (s *fdStore) receive(conn *net.UnixConn) {
+	for {
+		op, id, name, meta, fd, err := readStoreMessage(conn)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		switch op {
+		case "add":
+			s.fds[id] = &storedFd{name: name, meta: meta, fd: fd}
+		case "remove":
+			if stored, ok := s.fds[id]; ok {
+				syscall.Close(stored.fd)
+				delete(s.fds, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// replay sends the stored fds to a new worker.
+func (s *fdStore) replay(conn *net.UnixConn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, stored := range s.fds {
+		msg := fmt.Sprintf("add %s %s\n%s", id, stored.name, stored.meta)
+		if _, _, err := conn.WriteMsgUnix([]byte(msg), syscall.UnixRights(stored.fd), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// supervise runs the worker, with the same arguments as us apart from
+// -supervise, restarting it whenever it exits. It never returns.
+func supervise(logFile, queryFile *os.File) {
+	var args []string
+	for _, arg := range os.Args[1:] {
+		if arg != "-supervise" && arg != "--supervise" && arg != "-supervise=true" && arg != "--supervise=true" {
+			args = append(args, arg)
+		}
+	}
+	args = append(args, "-fd-log", "3", "-fd-query", "4", "-fd-store", "5")
+	store := newFdStore()
+	for {
+		if err := runWorker(store, args, logFile, queryFile); err != nil {
+			fmt.Printf("memlogd worker failed: %s\n", err)
+		}
+		time.Sleep(restartDelay)
+	}
+}
+
+// runWorker starts a worker and waits for it to exit.
+func runWorker(store *fdStore, args []string, logFile, queryFile *os.File) error {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		return err
+	}
+	ours := os.NewFile(uintptr(fds[0]), "fd-store")
+	theirs := os.NewFile(uintptr(fds[1]), "fd-store")
+	c, err := net.FileConn(ours)
+	ours.Close()
+	if err != nil {
+		theirs.Close()
+		return err
+	}
+	conn := c.(*net.UnixConn)
+	defer conn.Close()
+
+	worker := exec.Command(os.Args[0], args...)
+	worker.Stdout = os.Stdout
+	worker.Stderr = os.Stderr
+	worker.ExtraFiles = []*os.File{logFile, queryFile, theirs}
+	err = worker.Start()
+	// so that we see EOF when the worker exits
+	theirs.Close()
+	if err != nil {
+		return err
+	}
+	if err := store.replay(conn); err != nil {
+		fmt.Printf("Failed to send stored fds to memlogd: %s\n", err)
+	}
+	store.receive(conn)
+	return worker.Wait()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"time"
+)
+
+// logFilter is the request sent after the logFilterQuery command byte,
+// encoded as a single line of JSON. It selects the messages returned for
+// the dump and/or follow given by Mode.
+type logFilter struct {
+	Mode   logMode   `json:"mode"`
+	Source string    `json:"source,omitempty"` // glob matched against the log name
+	Since  time.Time `json:"since,omitempty"`  // only messages written at or after this time
+	Until  time.Time `json:"until,omitempty"`  // only messages written before this time
+	Max    int       `json:"max,omitempty"`    // maximum number of buffered messages, newest kept
+
+	// FromSeq skips buffered messages with a lower sequence number, so a
+	// reconnecting client can resume after the last message it saw. It is
+	// ignored unless Instance is the instance of memlogd's hello.
+	FromSeq  uint64 `json:"from_seq,omitempty"`
+	Instance string `json:"instance,omitempty"`
+
+	// Format is formatText (the default, also used if empty) or
+	// formatJSON, for one JSON logRecord per line.
+	Format string `json:"format,omitempty"`
+
+	// Namespace only selects messages from services in this containerd
+	// namespace.
+	Namespace string `json:"namespace,omitempty"`
+
+	// Reliable asks memlogd for a buffer of -reliable-follower-lines
+	// messages, so that the client can fall further behind without
+	// missing messages.
+	Reliable bool `json:"reliable,omitempty"`
+
+	// allowed restricts the client to logs matching one of these globs,
+	// nil for all. It is set from the read ACL, never by the client.
+	allowed []string
+
+	// legacy is set for clients which sent a plain dump or follow command
+	// without saying hello, which are sent messages in the original format.
+	legacy bool
+}
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+// match returns true if the entry passes the filter.
+func (f *logFilter) match(e *logEntry) bool {
+	if f == nil {
+		return true
+	}
+	if f.allowed != nil && !matchAny(f.allowed, e.source) {
+		return false
+	}
+	if f.Namespace != "" && (e.meta == nil || e.meta.Namespace != f.Namespace) {
+		return false
+	}
+	if f.Source != "" {
+		if ok, err := path.Match(f.Source, e.source); err != nil || !ok {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && e.when().Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.when().Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// resume clears FromSeq unless it continues the sequence numbers of this
+// memlogd, of which last is the newest: a client can't have seen the
+// numbers of another instance, or a message which hasn't been sent, so
+// sends like this would otherwise silently skip everything buffered.
+func (f *logFilter) resume(last uint64) {
+	if f == nil || f.FromSeq == 0 {
+		return
+	}
+	if f.Instance != instanceID || f.FromSeq > last+1 {
+		f.FromSeq = 0
+	}
+}
+
+// selectBuffered returns the buffered entries matching the filter, in the
+// order they were written, which for trusted sources may differ from the
+// order they were received in, keeping only the newest f.Max entries if set.
+func (f *logFilter) selectBuffered(buffer *logBuffer) []logEntry {
+	var entries []logEntry
+	buffer.do(func(msg logEntry) {
+		if f != nil && msg.seq < f.FromSeq {
+			return
+		}
+		if f.match(&msg) {
+			entries = append(entries, msg)
+		}
+	})
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].when().Before(entries[j].when())
+	})
+	if f != nil && f.Max > 0 && len(entries) > f.Max {
+		entries = entries[len(entries)-f.Max:]
+	}
+	return entries
+}
+
+// matchAny returns true if name matches one of the globs.
+func matchAny(globs []string, name string) bool {
+	for _, glob := range globs {
+		if ok, err := path.Match(glob, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
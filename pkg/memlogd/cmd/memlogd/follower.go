@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// followerWriteTimeout is how long a client may take to accept a message
+// before it is disconnected.
+const followerWriteTimeout = 30 * time.Second
+
+// reliableFollowerLines is the size of the buffer of a reliable client,
+// which is larger than that of other clients so that it can fall further
+// behind before missing messages. memlogd never waits for a client.
+var reliableFollowerLines int
+
+// maxFollowerDrops is the number of consecutive messages a follower may
+// miss, because its buffer is full, before it is evicted. 0 never evicts.
+var maxFollowerDrops = 0
+
+// connListener streams messages to one client. Each client has its own
+// buffer so that a slow client only loses its own messages and never
+// delays memlogd or the other clients.
+type connListener struct {
+	conn    net.Conn
+	output  chan *logEntry
+	done    chan struct{} // closed when run returns
+	filter  *logFilter    // only send matching messages, nil for all
+	dropped int           // consecutive messages dropped, owned by ringBufferHandler
+}
+
+func newConnListener(conn net.Conn, size int, filter *logFilter) *connListener {
+	if filter != nil && filter.Reliable && size < reliableFollowerLines {
+		size = reliableFollowerLines
+	}
+	return &connListener{
+		conn:   conn,
+		output: make(chan *logEntry, size),
+		done:   make(chan struct{}),
+		filter: filter,
+	}
+}
+
+// followerBatch is the most messages written to a client at once.
+const followerBatch = 64
+
+// run writes messages to the client until output is closed or a write
+// fails. Messages which are already queued are written together with a
+// single writev, so a busy follower costs one syscall per batch rather
+// than one per message.
+func (l *connListener) run() {
+	defer close(l.done)
+	defer l.conn.Close()
+
+	json := l.filter != nil && l.filter.Format == formatJSON
+	legacy := l.filter != nil && l.filter.legacy
+	format := func(msg *logEntry) []byte {
+		switch {
+		case json:
+			return []byte(msg.JSON() + "\n")
+		case legacy:
+			return []byte(msg.legacyString() + "\n")
+		}
+		return []byte(msg.String() + "\n")
+	}
+	for msg := range l.output {
+		batch := net.Buffers{format(msg)}
+	more:
+		for len(batch) < followerBatch {
+			select {
+			case msg, ok := <-l.output:
+				if !ok {
+					break more
+				}
+				batch = append(batch, format(msg))
+			default:
+				break more
+			}
+		}
+		if err := l.conn.SetWriteDeadline(time.Now().Add(followerWriteTimeout)); err != nil {
+			fmt.Println("Removing connection, error: ", err)
+			return
+		}
+		if _, err := batch.WriteTo(l.conn); err != nil {
+			fmt.Println("Removing connection, error: ", err)
+			return
+		}
+	}
+}
+
+// closed returns true if run has returned.
+func (l *connListener) closed() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// send queues a message without blocking, returning false if it was
+// dropped. After messages have been dropped the client is told how many
+// before it is sent anything else.
+func (l *connListener) send(msg *logEntry) bool {
+	if l.dropped > 0 {
+		notice := &logEntry{
+			time:   time.Now(),
+			source: "memlogd",
+			msg:    fmt.Sprintf("%d messages dropped as the client was not reading fast enough", l.dropped),
+		}
+		if l.queue(notice) {
+			l.dropped = 0
+		}
+	}
+	if l.dropped == 0 && l.queue(msg) {
+		return true
+	}
+	// channel is full so drop message
+	l.dropped++
+	memlogdMetrics.drop(msg)
+	return false
+}
+
+// queue adds a message to the output if there is room.
+func (l *connListener) queue(msg *logEntry) bool {
+	select {
+	case l.output <- msg:
+		return true
+	default:
+		return false
+	}
+}
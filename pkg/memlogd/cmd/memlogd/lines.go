@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// partialLineTimeout is how long part of a line is kept waiting for the
+// rest before it is logged on its own.
+var partialLineTimeout = time.Second
+
+// readBufferSize is how much of a service's output is read at once. A
+// pipe holds 64KiB, so a service which writes quickly can be drained in
+// one read.
+const readBufferSize = 64 * 1024
+
+// lineAssembler splits the output of a log into lines, so that output
+// written in small chunks is recorded as whole lines. Lines longer than
+// maxLen are truncated.
+type lineAssembler struct {
+	maxLen  int
+	buf     bytes.Buffer
+	started time.Time // when the pending partial line began
+	emit    func(line string, received time.Time)
+}
+
+// Write adds output to the assembler, emitting any complete lines.
+func (a *lineAssembler) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			a.add(p)
+			break
+		}
+		a.add(p[:i])
+		a.flush()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+func (a *lineAssembler) add(p []byte) {
+	if a.buf.Len() == 0 {
+		a.started = time.Now()
+	}
+	if room := a.maxLen - a.buf.Len(); len(p) > room {
+		p = p[:room]
+	}
+	a.buf.Write(p)
+}
+
+// pending returns true if part of a line is waiting, and since when.
+func (a *lineAssembler) pending() (bool, time.Time) {
+	return a.buf.Len() > 0, a.started
+}
+
+// flush emits the pending line, even if it is incomplete. The line is
+// stamped with the time its first byte was read, rather than when the rest
+// arrived or it was queued, so lines keep the order they were written in.
+func (a *lineAssembler) flush() {
+	a.emit(escapeBinary(bytes.TrimSuffix(a.buf.Bytes(), []byte{'\r'})), a.started)
+	a.buf.Reset()
+}
+
+// escapeBinary returns a line as a string, replacing bytes which are not
+// valid UTF-8 and control characters other than tab with \xNN, so that
+// binary output can't break clients which parse the logs.
+func escapeBinary(line []byte) string {
+	clean := utf8.Valid(line)
+	for _, c := range line {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return string(line)
+	}
+	var b strings.Builder
+	for len(line) > 0 {
+		r, size := utf8.DecodeRune(line)
+		if (r == utf8.RuneError && size <= 1) || (r < ' ' && r != '\t') || r == 0x7f {
+			fmt.Fprintf(&b, "\\x%02x", line[0])
+			line = line[1:]
+			continue
+		}
+		b.Write(line[:size])
+		line = line[size:]
+	}
+	return b.String()
+}
+
+func readLogFromFd(maxLineLen int, fd int, source string, logCh chan logEntry) {
+	// non-blocking so that a read can time out to flush a partial line
+	timeouts := syscall.SetNonblock(fd, true) == nil
+	f := os.NewFile(uintptr(fd), "")
+	defer f.Close()
+
+	trusted := trustedTimestamps.trusted(source)
+	a := &lineAssembler{
+		maxLen: maxLineLen,
+		emit: func(line string, received time.Time) {
+			meta := sourceMetadata.get(source)
+			msg := logEntry{time: received, source: source, msg: line, meta: meta}
+			if meta != nil {
+				msg.pri = validPriority(meta.Priority)
+				if meta.LevelPrefix {
+					if p, rest, ok := splitPriority(msg.msg); ok {
+						msg.pri = p.withDefault(msg.pri)
+						msg.msg = rest
+					}
+				}
+			}
+			if trusted {
+				if t, rest, ok := splitTimestamp(msg.msg); ok {
+					msg.origTime = t
+					msg.msg = rest
+				}
+			}
+			logCh <- msg
+		},
+	}
+	b := make([]byte, readBufferSize)
+	for {
+		if timeouts {
+			var deadline time.Time
+			if ok, started := a.pending(); ok {
+				deadline = started.Add(partialLineTimeout)
+			}
+			// fails if f can't be polled, eg a regular file
+			timeouts = f.SetReadDeadline(deadline) == nil
+		}
+		n, err := f.Read(b)
+		a.Write(b[:n])
+		if err != nil && os.IsTimeout(err) {
+			a.flush()
+			continue
+		}
+		if err != nil {
+			if ok, _ := a.pending(); ok {
+				a.flush()
+			}
+			return
+		}
+	}
+}
@@ -1,31 +1,35 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"container/list"
-	"container/ring"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 )
 
 type logEntry struct {
-	time   time.Time
-	source string
-	msg    string
+	time     time.Time
+	source   string
+	msg      string
+	seq      uint64      // assigned when buffered, starting at 1
+	meta     *sourceMeta // describes the writer, if known
+	origTime time.Time   // when a trusted source says it wrote the message, or zero
+	pri      *priority   // syslog priority, if known
 }
 
 type fdMessage struct {
 	name string
 	fd   int
+	id   string // set if the fd was sent back by the supervisor
 }
 
 type logMode byte
@@ -34,18 +38,23 @@ const (
 	logDump logMode = iota
 	logFollow
 	logDumpFollow
+	logFilterQuery // followed by a JSON logFilter
+	logSnapshot    // followed by the path of a file to write the buffer to
+	logConsole     // followed by a JSON consoleRequest
+	logHello       // followed by a JSON hello, answered before the next command
 )
 
-type queryMessage struct {
-	conn net.Conn
-	mode logMode
-}
+const (
+	filterTimeout = 5 * time.Second // how long a client has to send a logFilter
+	filterMaxLen  = 4096            // maximum length of an encoded logFilter
+)
 
-type connListener struct {
-	conn      net.Conn
-	output    chan *logEntry
-	err       error
-	exitOnEOF bool // exit instead of blocking if no more data in read buffer
+type queryMessage struct {
+	conn     net.Conn
+	mode     logMode
+	filter   *logFilter
+	snapshot string          // path for logSnapshot
+	console  *consoleRequest // request for logConsole
 }
 
 func doLog(logCh chan logEntry, msg string) {
@@ -53,81 +62,172 @@ func doLog(logCh chan logEntry, msg string) {
 	return
 }
 
-func logQueryHandler(l *connListener) {
-	defer l.conn.Close()
-
-	for msg := range l.output {
-		_, err := io.Copy(l.conn, strings.NewReader(msg.String()+"\n"))
-		if err != nil {
-			l.err = err
-			return
+func (msg *logEntry) String() string {
+	prefix := fmt.Sprintf("%s,%s,%d", msg.time.Format(time.RFC3339), msg.source, msg.seq)
+	if !msg.origTime.IsZero() || msg.pri != nil {
+		// the original time is empty if only the priority is known
+		var orig string
+		if !msg.origTime.IsZero() {
+			orig = msg.origTime.Format(time.RFC3339Nano)
 		}
+		prefix += "," + orig
 	}
+	if msg.pri != nil {
+		prefix += fmt.Sprintf(",%d", *msg.pri)
+	}
+	return prefix + ";" + msg.msg
 }
 
-func (msg *logEntry) String() string {
-	return fmt.Sprintf("%s,%s;%s", msg.time.Format(time.RFC3339), msg.source, msg.msg)
+// legacyString formats the entry as memlogd did before sequence numbers
+// were added, for clients which never say hello. They can't see the
+// original time as a separate field, so it replaces the time received.
+func (msg *logEntry) legacyString() string {
+	return fmt.Sprintf("%s,%s;%s", msg.when().Format(time.RFC3339), msg.source, msg.msg)
 }
 
-func ringBufferHandler(ringSize, chanSize int, logCh chan logEntry, queryMsgChan chan queryMessage) {
+// when returns the time the message was written: the original time from a
+// trusted source if there is one, or the time we received it.
+func (msg *logEntry) when() time.Time {
+	if !msg.origTime.IsZero() {
+		return msg.origTime
+	}
+	return msg.time
+}
+
+// parseLogEntry is the inverse of logEntry.String()
+func parseLogEntry(line string) (*logEntry, error) {
+	prefixBody := strings.SplitN(line, ";", 2)
+	if len(prefixBody) != 2 {
+		return nil, fmt.Errorf("failed to parse log entry: %s", line)
+	}
+	csv := strings.Split(prefixBody[0], ",")
+	if len(csv) < 2 {
+		return nil, fmt.Errorf("failed to parse log entry: %s", line)
+	}
+	t, err := time.Parse(time.RFC3339, csv[0])
+	if err != nil {
+		return nil, err
+	}
+	e := &logEntry{time: t, source: csv[1], msg: prefixBody[1]}
+	if len(csv) > 2 {
+		if e.seq, err = strconv.ParseUint(csv[2], 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	if len(csv) > 3 && csv[3] != "" {
+		if e.origTime, err = time.Parse(time.RFC3339Nano, csv[3]); err != nil {
+			return nil, err
+		}
+	}
+	if len(csv) > 4 {
+		n, err := strconv.Atoi(csv[4])
+		if err != nil {
+			return nil, err
+		}
+		if e.pri = validPriority(&n); e.pri == nil {
+			return nil, fmt.Errorf("invalid priority %d", n)
+		}
+	}
+	return e, nil
+}
+
+func ringBufferHandler(buffer *logBuffer, chanSize int, logCh chan logEntry, queryMsgChan chan queryMessage, persist *persistentRing) {
 	// Anything that interacts with the ring buffer goes through this handler
-	ring := ring.New(ringSize)
 	listeners := list.New()
+	var seq uint64
+	console := consoleMirror{enable: mirrorToConsole}
+	sampler := newSampler(sampling)
+
+	if persist != nil {
+		// restore the logs from before we were restarted
+		for _, msg := range persist.entries() {
+			memlogdMetrics.restore(&msg, buffer.add(msg))
+			if msg.seq > seq {
+				seq = msg.seq
+			}
+		}
+	}
 
 	for {
 		select {
 		case msg := <-logCh:
-			fmt.Printf("%s\n", msg.String())
+			if !sampler.keep(&msg) {
+				memlogdMetrics.sample(&msg)
+				continue
+			}
+			seq++
+			msg.seq = seq
+			if console.enabled(&msg) {
+				fmt.Printf("%s\n", msg.legacyString())
+			}
 			// add log entry
-			ring.Value = msg
-			ring = ring.Next()
+			memlogdMetrics.receive(&msg, buffer.add(msg))
+			if persist != nil {
+				persist.write(&msg)
+			}
 
-			// send to listeners
-			var l *connListener
+			// send to listeners, evicting those which have gone away
+			// or can't keep up
 			var remove []*list.Element
 			for e := listeners.Front(); e != nil; e = e.Next() {
-				l = e.Value.(*connListener)
-				if l.err != nil {
+				l := e.Value.(*connListener)
+				if l.closed() {
 					remove = append(remove, e)
 					continue
 				}
-				select {
-				case l.output <- &msg:
-				default:
-					// channel is full so drop message
+				if !l.filter.match(&msg) {
+					continue
+				}
+				if !l.send(&msg) && maxFollowerDrops > 0 && l.dropped >= maxFollowerDrops {
+					fmt.Printf("Evicting connection which dropped %d messages\n", l.dropped)
+					close(l.output)
+					remove = append(remove, e)
 				}
 			}
-			if len(remove) > 0 { // remove listeners that returned errors
+			if len(remove) > 0 {
 				for _, e := range remove {
-					l = e.Value.(*connListener)
-					fmt.Println("Removing connection, error: ", l.err)
 					listeners.Remove(e)
 				}
+				memlogdMetrics.setFollowers(listeners.Len())
 			}
 
 		case msg := <-queryMsgChan:
-			l := connListener{
-				conn:      msg.conn,
-				output:    make(chan *logEntry, chanSize),
-				err:       nil,
-				exitOnEOF: (msg.mode == logDump),
+			if msg.mode == logConsole {
+				if msg.console == nil {
+					// the client of a per-source rule has gone
+					console.remove(msg.conn)
+					continue
+				}
+				if err := console.apply(msg.console, msg.conn); err != nil || msg.console.Source == "" {
+					sendReply(msg.conn, err)
+					continue
+				}
+				go holdConsoleRule(msg.conn, queryMsgChan)
+				continue
 			}
-			go logQueryHandler(&l)
-			if msg.mode == logDumpFollow || msg.mode == logFollow {
-				// register for future logs
-				listeners.PushBack(&l)
+			if msg.mode == logSnapshot {
+				// write the file without blocking new messages
+				go writeSnapshot(msg.conn, msg.snapshot, msg.filter.selectBuffered(buffer))
+				continue
 			}
+			msg.filter.resume(seq)
+			var buffered []logEntry
 			if msg.mode == logDumpFollow || msg.mode == logDump {
-				// fill with current data in buffer
-				ring.Do(func(f interface{}) {
-					if msg, ok := f.(logEntry); ok {
-						select {
-						case l.output <- &msg:
-						default:
-							// channel is full so drop message
-						}
-					}
-				})
+				buffered = msg.filter.selectBuffered(buffer)
+			}
+			// room for everything buffered, which with per-source
+			// rings may be far more than chanSize, so that a dump is
+			// never truncated
+			l := newConnListener(msg.conn, chanSize+len(buffered), msg.filter)
+			go l.run()
+			for _, msg := range buffered {
+				msg := msg
+				l.send(&msg)
+			}
+			if msg.mode == logDumpFollow || msg.mode == logFollow {
+				// register for future logs
+				listeners.PushBack(l)
+				memlogdMetrics.setFollowers(listeners.Len())
 			}
 			if msg.mode == logDump {
 				close(l.output)
@@ -136,7 +236,7 @@ func ringBufferHandler(ringSize, chanSize int, logCh chan logEntry, queryMsgChan
 	}
 }
 
-func receiveQueryHandler(l *net.UnixListener, logCh chan logEntry, queryMsgChan chan queryMessage) {
+func receiveQueryHandler(l *net.UnixListener, acl readACL, logCh chan logEntry, queryMsgChan chan queryMessage) {
 	for {
 		var conn *net.UnixConn
 		var err error
@@ -144,13 +244,121 @@ func receiveQueryHandler(l *net.UnixListener, logCh chan logEntry, queryMsgChan
 			doLog(logCh, fmt.Sprintf("Connection error %s", err))
 			continue
 		}
-		mode := make([]byte, 1)
-		n, err := conn.Read(mode)
-		if err != nil || n != 1 {
+		// the logs this client may read, nil for all
+		var allowed []string
+		if len(acl) > 0 {
+			uid, err := peerUID(conn)
+			if err != nil {
+				doLog(logCh, fmt.Sprintf("ERROR: failed to read peer credentials: %s", err))
+				conn.Close()
+				continue
+			}
+			allowed = acl.allowed(uid)
+		}
+		mode, h, err := readCommand(conn)
+		if err != nil {
 			doLog(logCh, fmt.Sprintf("No mode received: %s", err))
+			conn.Close()
+			continue
+		}
+		if mode > logHello {
+			sendReply(conn, fmt.Errorf("unknown command %d", mode))
+			continue
+		}
+		if mode == logSnapshot {
+			line, err := readLine(conn)
+			if err != nil {
+				doLog(logCh, fmt.Sprintf("ERROR: failed to read snapshot path: %s", err))
+				conn.Close()
+				continue
+			}
+			// only root may have files written, whether or not there is
+			// an ACL, and restricted clients can't read everything
+			if uid, err := peerUID(conn); err != nil || uid != 0 || allowed != nil {
+				sendReply(conn, errors.New("permission denied"))
+				continue
+			}
+			queryMsgChan <- queryMessage{conn: conn, mode: logSnapshot, snapshot: string(line)}
+			continue
+		}
+		if mode == logConsole {
+			line, err := readLine(conn)
+			if err != nil {
+				doLog(logCh, fmt.Sprintf("ERROR: failed to read console request: %s", err))
+				conn.Close()
+				continue
+			}
+			if allowed != nil {
+				sendReply(conn, errors.New("permission denied"))
+				continue
+			}
+			var req consoleRequest
+			if err := json.Unmarshal(line, &req); err != nil {
+				sendReply(conn, err)
+				continue
+			}
+			queryMsgChan <- queryMessage{conn: conn, mode: logConsole, console: &req}
+			continue
+		}
+		if mode == logFilterQuery {
+			filter, err := readFilter(conn)
+			if err != nil {
+				doLog(logCh, fmt.Sprintf("ERROR: failed to read query filter: %s", err))
+				conn.Close()
+				continue
+			}
+			filter.allowed = allowed
+			queryMsgChan <- queryMessage{conn: conn, mode: filter.Mode, filter: filter}
+			continue
+		}
+		var filter *logFilter
+		if allowed != nil || h == nil {
+			filter = &logFilter{Mode: mode, allowed: allowed, legacy: h == nil}
 		}
-		queryMsgChan <- queryMessage{conn, logMode(mode[0])}
+		queryMsgChan <- queryMessage{conn: conn, mode: mode, filter: filter}
+	}
+}
+
+// readLine reads a single line following the command byte.
+func readLine(conn *net.UnixConn) ([]byte, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(filterTimeout)); err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	// Read a byte at a time so we don't consume anything after the newline
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			return line, nil
+		}
+		if len(line) >= filterMaxLen {
+			return nil, errors.New("line too long")
+		}
+		line = append(line, b[0])
+	}
+}
+
+// readFilter reads a single line of JSON encoding a logFilter.
+func readFilter(conn *net.UnixConn) (*logFilter, error) {
+	line, err := readLine(conn)
+	if err != nil {
+		return nil, err
+	}
+	var filter logFilter
+	if err := json.Unmarshal(line, &filter); err != nil {
+		return nil, err
+	}
+	if filter.Mode > logDumpFollow {
+		return nil, fmt.Errorf("invalid mode %d", filter.Mode)
+	}
+	if filter.Format != "" && filter.Format != formatText && filter.Format != formatJSON {
+		return nil, fmt.Errorf("invalid format %q", filter.Format)
 	}
+	return &filter, nil
 }
 
 func receiveFdHandler(conn *net.UnixConn, logCh chan logEntry, fdMsgChan chan fdMessage) {
@@ -158,12 +366,27 @@ func receiveFdHandler(conn *net.UnixConn, logCh chan logEntry, fdMsgChan chan fd
 	b := make([]byte, 512)
 
 	for {
-		n, oobn, _, _, err := conn.ReadMsgUnix(b, oob)
+		n, oobn, _, addr, err := conn.ReadMsgUnix(b, oob)
 		if err != nil {
 			doLog(logCh, fmt.Sprintf("ERROR: Unable to read oob data: %s", err.Error()))
 			continue
 		}
 
+		if isHello(b[:n]) {
+			if err := answerHello(conn, b[:n], addr); err != nil {
+				doLog(logCh, fmt.Sprintf("ERROR: Failed to answer hello: %s", err))
+			}
+			continue
+		}
+
+		name, meta, err := parseRegistration(b[:n])
+		if err != nil {
+			doLog(logCh, fmt.Sprintf("ERROR: Failed to parse metadata for %s: %s", name, err))
+		}
+		if meta != nil && !strings.Contains(name, ";") {
+			sourceMetadata.update(name, meta)
+		}
+
 		if oobn == 0 {
 			continue
 		}
@@ -181,45 +404,12 @@ func receiveFdHandler(conn *net.UnixConn, logCh chan logEntry, fdMsgChan chan fd
 				continue
 			}
 			for _, fd := range r {
-				name := ""
-				if n > 0 {
-					name = string(b[:n])
-				}
 				fdMsgChan <- fdMessage{name: name, fd: fd}
 			}
 		}
 	}
 }
 
-func readLogFromFd(maxLineLen int, fd int, source string, logCh chan logEntry) {
-	f := os.NewFile(uintptr(fd), "")
-	defer f.Close()
-
-	r := bufio.NewReader(f)
-	l, isPrefix, err := r.ReadLine()
-	var buffer bytes.Buffer
-
-	for err == nil {
-		buffer.Write(l)
-		for isPrefix {
-			l, isPrefix, err = r.ReadLine()
-			if err != nil {
-				break
-			}
-			if buffer.Len() < maxLineLen {
-				buffer.Write(l)
-			}
-		}
-		if buffer.Len() > maxLineLen {
-			buffer.Truncate(maxLineLen)
-		}
-		logCh <- logEntry{time: time.Now(), source: source, msg: buffer.String()}
-		buffer.Reset()
-
-		l, isPrefix, err = r.ReadLine()
-	}
-}
-
 func loggingRequestHandler(lineMaxLength int, logCh chan logEntry, fdMsgChan chan fdMessage) {
 	for true {
 		select {
@@ -232,7 +422,21 @@ func loggingRequestHandler(lineMaxLength int, logCh chan logEntry, fdMsgChan cha
 				}
 				continue
 			}
-			go readLogFromFd(lineMaxLength, msg.fd, msg.name, logCh)
+			id := msg.id
+			if fdStoreConn != nil && id == "" {
+				id = newFdID()
+				if err := storeAdd(fdStoreConn, id, msg.name, sourceMetadata.get(msg.name), msg.fd); err != nil {
+					doLog(logCh, fmt.Sprintf("ERROR: failed to store fd of %s: %s", msg.name, err))
+				}
+			}
+			go func(msg fdMessage, id string) {
+				readLogFromFd(lineMaxLength, msg.fd, msg.name, logCh)
+				if fdStoreConn != nil {
+					if err := storeRemove(fdStoreConn, id); err != nil {
+						doLog(logCh, fmt.Sprintf("ERROR: failed to remove stored fd of %s: %s", msg.name, err))
+					}
+				}
+			}(msg, id)
 		}
 	}
 }
@@ -244,17 +448,58 @@ func main() {
 	var passedQueryFD int
 	var socketLogPath string
 	var passedLogFD int
+	var passedStoreFD int
+	var runSupervisor bool
 	var linesInBuffer int
+	var linesPerSource int
+	sourceLines := make(sourceSizes)
 	var lineMaxLength int
 	var daemonize bool
+	var persistFile string
+	var persistSize int
+	var metricsAddr string
+	var followerLines int
+	var queryMode, queryGroup, logSocketMode, logSocketGroup string
+	acl := make(readACL)
 
 	flag.StringVar(&socketQueryPath, "socket-query", "/var/run/memlogdq.sock", "unix domain socket for responding to log queries. Overridden by -fd-query")
 	flag.StringVar(&socketLogPath, "socket-log", "/var/run/linuxkit-external-logging.sock", "unix domain socket to listen for new fds to add to log. Overridden by -fd-log")
 	flag.IntVar(&passedLogFD, "fd-log", -1, "an existing SOCK_DGRAM socket for receiving fd's. Overrides -socket-log.")
 	flag.IntVar(&passedQueryFD, "fd-query", -1, "an existing SOCK_STREAM for receiving log read requets. Overrides -socket-query.")
+	flag.IntVar(&passedStoreFD, "fd-store", -1, "a SOCK_SEQPACKET connection to the supervisor, which keeps a copy of the log fds. Used with -supervise.")
+	flag.BoolVar(&runSupervisor, "supervise", false, "run memlogd in a child process, which is restarted if it exits and carries on reading the logs of running services")
 	flag.IntVar(&linesInBuffer, "max-lines", 5000, "Number of log lines to keep in memory")
+	flag.IntVar(&linesPerSource, "max-lines-per-source", 0, "Number of log lines to keep in memory for each source in its own buffer. If 0, sources share -max-lines.")
+	flag.Var(sourceLines, "source-lines", "name=lines: keep lines of log for source name in its own buffer. May be repeated.")
+	flag.Var(&sampling, "sample", "glob=N[:severity]: keep only 1 in N messages from logs matching glob, and all those at least as severe as severity. May be repeated.")
+	flag.Var(&trustedTimestamps, "source-timestamps", "glob: trust logs matching glob to start each line with the RFC3339 time it was written, which is kept separately. May be repeated.")
 	flag.IntVar(&lineMaxLength, "max-line-len", 1024, "Maximum line length recorded. Additional bytes are dropped.")
 	flag.BoolVar(&daemonize, "daemonize", false, "Bind sockets and then daemonize.")
+	flag.StringVar(&persistFile, "persist-file", "", "file to keep a persistent copy of the log buffer in, so logs survive a restart")
+	flag.IntVar(&persistSize, "persist-size", 1024*1024, "size in bytes of the log data kept in -persist-file")
+	flag.StringVar(&queryMode, "socket-query-mode", "", "octal permissions of -socket-query, eg 0600")
+	flag.StringVar(&queryGroup, "socket-query-group", "", "group owning -socket-query")
+	flag.StringVar(&logSocketMode, "socket-log-mode", "", "octal permissions of -socket-log, eg 0600")
+	flag.StringVar(&logSocketGroup, "socket-log-group", "", "group owning -socket-log")
+	flag.Var(acl, "read-acl", "uid=glob: allow the user to read logs matching glob. May be repeated. If set, other users except root may not read any logs.")
+	flag.IntVar(&followerLines, "follower-lines", 0, "Number of log lines buffered for each client while it is not reading. If 0, -max-lines.")
+	flag.BoolVar(&mirrorToConsole, "console", true, "copy logs to stdout, normally the console. May be changed at runtime with logconsole.")
+	flag.DurationVar(&partialLineTimeout, "partial-line-timeout", time.Second, "how long to wait for the rest of a partial line before recording it on its own")
+	flag.IntVar(&reliableFollowerLines, "reliable-follower-lines", 64*1024, "Number of log lines buffered for each client which asks not to miss messages, such as logwrite -reliable, if more than -follower-lines")
+	flag.IntVar(&maxFollowerDrops, "max-follower-drops", 0, "disconnect a client following the log once it has missed this many consecutive messages by not reading fast enough. If 0, never.")
+	flag.StringVar(&snapshotDir, "snapshot-dir", snapshotDir, "directory in which root may have snapshots of the buffer written, or \"\" to disable snapshots")
+	flag.StringVar(&metricsAddr, "metrics", "", "serve Prometheus metrics over HTTP on this unix domain socket path or TCP host:port")
+
+	// settings from boot are defaults, overridden by our arguments
+	settings, err := bootSettings(configFile, kernelCmdline)
+	if err != nil {
+		log.Printf("Ignoring boot settings: %s", err)
+	}
+	for _, s := range settings {
+		if err := flag.Set(s.name, s.value); err != nil {
+			log.Printf("Ignoring %s=%s from %s: %s", s.name, s.value, s.origin, err)
+		}
+	}
 	flag.Parse()
 
 	var connLogFd *net.UnixConn
@@ -266,6 +511,9 @@ func main() {
 		if connLogFd, err = net.ListenUnixgram("unixgram", &addr); err != nil {
 			log.Fatal("Unable to open socket: ", err)
 		}
+		if err := setSocketAccess(addr.Name, logSocketMode, logSocketGroup); err != nil {
+			log.Fatal("Unable to set socket permissions: ", err)
+		}
 		defer os.Remove(addr.Name)
 	} else { // use given fd
 		var f net.Conn
@@ -285,6 +533,9 @@ func main() {
 		if connQuery, err = net.ListenUnix("unix", &addr); err != nil {
 			log.Fatal("Unable to open socket: ", err)
 		}
+		if err := setSocketAccess(addr.Name, queryMode, queryGroup); err != nil {
+			log.Fatal("Unable to set socket permissions: ", err)
+		}
 		defer os.Remove(addr.Name)
 	} else { // use given fd
 		var f net.Listener
@@ -300,8 +551,33 @@ func main() {
 			"-fd-log", "3", // connLogFd in ExtraFiles below
 			"-fd-query", "4", // connQuery in ExtraFiles below
 			"-max-lines", fmt.Sprintf("%d", linesInBuffer),
+			"-max-lines-per-source", fmt.Sprintf("%d", linesPerSource),
 			"-max-line-len", fmt.Sprintf("%d", lineMaxLength),
+			"-persist-file", persistFile,
+			"-persist-size", fmt.Sprintf("%d", persistSize),
+			"-metrics", metricsAddr,
+			"-max-follower-drops", fmt.Sprintf("%d", maxFollowerDrops),
+			"-follower-lines", fmt.Sprintf("%d", followerLines),
+			fmt.Sprintf("-console=%v", mirrorToConsole),
+			"-partial-line-timeout", partialLineTimeout.String(),
+			"-reliable-follower-lines", fmt.Sprintf("%d", reliableFollowerLines),
+			"-snapshot-dir", snapshotDir,
+			fmt.Sprintf("-supervise=%v", runSupervisor),
 		)
+		for _, rule := range sampling {
+			child.Args = append(child.Args, "-sample", (&samplingRules{rule}).String())
+		}
+		for _, glob := range trustedTimestamps {
+			child.Args = append(child.Args, "-source-timestamps", glob)
+		}
+		for name, lines := range sourceLines {
+			child.Args = append(child.Args, "-source-lines", fmt.Sprintf("%s=%d", name, lines))
+		}
+		for uid, globs := range acl {
+			for _, glob := range globs {
+				child.Args = append(child.Args, "-read-acl", fmt.Sprintf("%d=%s", uid, glob))
+			}
+		}
 		connLogFile, err := connLogFd.File()
 		if err != nil {
 			log.Fatalf("The -fd-log cannot be represented as a *File: %s", err)
@@ -317,16 +593,61 @@ func main() {
 		os.Exit(0)
 	}
 
+	if runSupervisor {
+		connLogFile, err := connLogFd.File()
+		if err != nil {
+			log.Fatalf("The -fd-log cannot be represented as a *File: %s", err)
+		}
+		connQueryFile, err := connQuery.File()
+		if err != nil {
+			log.Fatalf("The -fd-query cannot be represented as a *File: %s", err)
+		}
+		supervise(connLogFile, connQueryFile)
+	}
+
+	instanceID = newInstanceID()
+	var persist *persistentRing
+	if persistFile != "" {
+		if persist, err = openPersistentRing(persistFile, persistSize); err != nil {
+			log.Fatal("Unable to open persistent log buffer: ", err)
+		}
+		defer persist.Close()
+		// the sequence numbers carry on from the restored entries
+		if id := persist.instance(); id != "" {
+			instanceID = id
+		} else {
+			persist.setInstance(instanceID)
+		}
+	}
+
+	if metricsAddr != "" {
+		if err := serveMetrics(metricsAddr, memlogdMetrics); err != nil {
+			log.Fatal("Unable to serve metrics: ", err)
+		}
+	}
+
 	logCh := make(chan logEntry)
 	fdMsgChan := make(chan fdMessage)
 	queryMsgChan := make(chan queryMessage)
 
 	// receive fds from the logging Unix domain socket and send on fdMsgChan
 	go receiveFdHandler(connLogFd, logCh, fdMsgChan)
+	if passedStoreFD != -1 {
+		f, err := net.FileConn(os.NewFile(uintptr(passedStoreFD), ""))
+		if err != nil {
+			log.Fatal("Unable to open fd store: ", err)
+		}
+		fdStoreConn = f.(*net.UnixConn)
+		// receive the fds of the previous memlogd from the supervisor
+		go receiveStoredFds(fdStoreConn, logCh, fdMsgChan)
+	}
 	// receive fds from the querying Unix domain socket and send on queryMsgChan
-	go receiveQueryHandler(connQuery, logCh, queryMsgChan)
+	go receiveQueryHandler(connQuery, acl, logCh, queryMsgChan)
 	// process both log messages and queries
-	go ringBufferHandler(linesInBuffer, linesInBuffer, logCh, queryMsgChan)
+	if followerLines <= 0 {
+		followerLines = linesInBuffer
+	}
+	go ringBufferHandler(newLogBuffer(linesInBuffer, linesPerSource, sourceLines), followerLines, logCh, queryMsgChan, persist)
 
 	doLog(logCh, "memlogd started")
 
@@ -2,10 +2,15 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"testing"
@@ -19,7 +24,7 @@ func TestNonblock(t *testing.T) {
 	logCh := make(chan logEntry)
 	queryMsgChan := make(chan queryMessage)
 
-	go ringBufferHandler(linesInBuffer, linesInBuffer, logCh, queryMsgChan)
+	go ringBufferHandler(newLogBuffer(linesInBuffer, 0, nil), linesInBuffer, logCh, queryMsgChan, nil)
 
 	// Overflow the log to make sure it doesn't block
 	for i := 0; i < 2*linesInBuffer; i++ {
@@ -39,7 +44,7 @@ func TestFinite(t *testing.T) {
 	logCh := make(chan logEntry)
 	queryMsgChan := make(chan queryMessage)
 
-	go ringBufferHandler(linesInBuffer, linesInBuffer, logCh, queryMsgChan)
+	go ringBufferHandler(newLogBuffer(linesInBuffer, 0, nil), linesInBuffer, logCh, queryMsgChan, nil)
 
 	// Overflow the log by 2x
 	for i := 0; i < 2*linesInBuffer; i++ {
@@ -71,15 +76,15 @@ func TestFinite(t *testing.T) {
 }
 
 func TestFinite2(t *testing.T) {
-	// Test that the query connection doesn't store more than the configured
-	// maximum size.
+	// Test that a dump includes the whole ring even when it is larger than
+	// the output buffer.
 	linesInBuffer := 10
 	// the output buffer size will be 1/2 of the ring
 	outputBufferSize := linesInBuffer / 2
 	logCh := make(chan logEntry)
 	queryMsgChan := make(chan queryMessage)
 
-	go ringBufferHandler(linesInBuffer, outputBufferSize, logCh, queryMsgChan)
+	go ringBufferHandler(newLogBuffer(linesInBuffer, 0, nil), outputBufferSize, logCh, queryMsgChan, nil)
 
 	// fill the ring
 	for i := 0; i < linesInBuffer; i++ {
@@ -94,7 +99,7 @@ func TestFinite2(t *testing.T) {
 		mode: logDump,
 	}
 	queryMsgChan <- queryM
-	// since the ring won't fit in the output buffer some should be dropped
+	// the output buffer is sized to fit the ring, so none should be dropped
 
 	r := bufio.NewReader(b)
 	count := 0
@@ -108,8 +113,895 @@ func TestFinite2(t *testing.T) {
 		}
 		count++
 	}
-	if count != outputBufferSize {
-		t.Errorf("Read %d lines but expected %d", count, outputBufferSize)
+	if count != linesInBuffer {
+		t.Errorf("Read %d lines but expected %d", count, linesInBuffer)
+	}
+}
+
+func TestPerSource(t *testing.T) {
+	// Test that a noisy source can't evict the logs of a source with its own ring
+	linesInBuffer := 10
+
+	logCh := make(chan logEntry)
+	queryMsgChan := make(chan queryMessage)
+
+	// the follower buffer is -max-lines by default
+	go ringBufferHandler(newLogBuffer(linesInBuffer, 0, sourceSizes{"onboot": 2}), linesInBuffer, logCh, queryMsgChan, nil)
+
+	logCh <- logEntry{time: time.Now(), source: "onboot", msg: "hello TestPerSource"}
+	for i := 0; i < 2*linesInBuffer; i++ {
+		logCh <- logEntry{time: time.Now(), source: "kubelet", msg: "spam"}
+	}
+	a, b := loopback()
+	defer a.Close()
+	defer b.Close()
+	queryMsgChan <- queryMessage{
+		conn: a,
+		mode: logDump,
+	}
+	r := bufio.NewReader(b)
+	count := 0
+	found := false
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Unexpected error reading from socket: %s", err)
+		}
+		if strings.Contains(line, "hello TestPerSource") {
+			found = true
+		}
+		count++
+	}
+	if !found {
+		t.Error("The onboot log was evicted by the noisy source")
+	}
+	if count != linesInBuffer+1 {
+		t.Errorf("Read %d lines but expected %d", count, linesInBuffer+1)
+	}
+}
+
+func TestPerSourceDump(t *testing.T) {
+	// Test that a dump includes everything in the per-source rings, which
+	// hold more than the follower buffer
+	linesInBuffer := 10
+	sources := 5
+
+	logCh := make(chan logEntry)
+	queryMsgChan := make(chan queryMessage)
+
+	go ringBufferHandler(newLogBuffer(linesInBuffer, linesInBuffer, nil), linesInBuffer, logCh, queryMsgChan, nil)
+
+	for i := 0; i < sources; i++ {
+		for j := 0; j < linesInBuffer; j++ {
+			logCh <- logEntry{time: time.Now(), source: fmt.Sprintf("source%d", i), msg: "hello TestPerSourceDump"}
+		}
+	}
+	for _, mode := range []logMode{logDump, logDumpFollow} {
+		a, b := loopback()
+		queryMsgChan <- queryMessage{conn: a, mode: mode}
+		r := bufio.NewReader(b)
+		for i := 0; i < sources*linesInBuffer; i++ {
+			if err := b.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Mode %d: read %d lines but expected %d: %v", mode, i, sources*linesInBuffer, err)
+			}
+			if !strings.HasSuffix(line, ";hello TestPerSourceDump\n") {
+				t.Fatalf("Mode %d: unexpected line %q", mode, line)
+			}
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestFilter(t *testing.T) {
+	// Test that a filtered dump only returns the newest matching messages
+	linesInBuffer := 10
+
+	logCh := make(chan logEntry)
+	queryMsgChan := make(chan queryMessage)
+
+	go ringBufferHandler(newLogBuffer(linesInBuffer, 0, nil), linesInBuffer, logCh, queryMsgChan, nil)
+
+	for i := 0; i < 3; i++ {
+		logCh <- logEntry{time: time.Now(), source: "onboot.000-dhcpcd", msg: fmt.Sprintf("hello TestFilter %d", i)}
+		logCh <- logEntry{time: time.Now(), source: "kubelet", msg: "spam"}
+	}
+
+	a, b := loopback()
+	defer a.Close()
+	defer b.Close()
+	if _, err := b.Write([]byte(`{"mode":0,"source":"onboot.*","max":2}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	filter, err := readFilter(a.(*net.UnixConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryMsgChan <- queryMessage{conn: a, mode: filter.Mode, filter: filter}
+
+	r := bufio.NewReader(b)
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Unexpected error reading from socket: %s", err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("Read %d lines but expected 2: %v", len(lines), lines)
+	}
+	if !strings.HasSuffix(lines[0], "hello TestFilter 1\n") || !strings.HasSuffix(lines[1], "hello TestFilter 2\n") {
+		t.Errorf("Unexpected lines %v", lines)
+	}
+}
+
+func TestResume(t *testing.T) {
+	// Test that FromSeq is only used if it continues our sequence numbers
+	defer func(id string) { instanceID = id }(instanceID)
+	instanceID = "TestResume"
+
+	logCh := make(chan logEntry)
+	queryMsgChan := make(chan queryMessage)
+	go ringBufferHandler(newLogBuffer(10, 0, nil), 10, logCh, queryMsgChan, nil)
+	for i := 0; i < 3; i++ {
+		logCh <- logEntry{time: time.Now(), source: "TestResume", msg: fmt.Sprintf("hello TestResume %d", i)}
+	}
+
+	for _, test := range []struct {
+		filter   string
+		expected int
+	}{
+		{`{"mode":0,"from_seq":3,"instance":"TestResume"}`, 1},
+		{`{"mode":0,"from_seq":4,"instance":"TestResume"}`, 0},
+		// from before a restart
+		{`{"mode":0,"from_seq":3,"instance":"other"}`, 3},
+		{`{"mode":0,"from_seq":3}`, 3},
+		// from after the newest message
+		{`{"mode":0,"from_seq":5,"instance":"TestResume"}`, 3},
+	} {
+		a, b := loopback()
+		if _, err := b.Write([]byte(test.filter + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		filter, err := readFilter(a.(*net.UnixConn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		queryMsgChan <- queryMessage{conn: a, mode: filter.Mode, filter: filter}
+		out, err := ioutil.ReadAll(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := bytes.Count(out, []byte("\n")); n != test.expected {
+			t.Errorf("%s returned %d messages, expected %d: %q", test.filter, n, test.expected, out)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	// Test that metadata sent with a registration appears in JSON records
+	name, meta, err := parseRegistration([]byte("sshd.out\n" + `{"service":"sshd","stream":"stdout"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "sshd.out" || meta == nil || meta.Service != "sshd" || meta.Stream != "stdout" {
+		t.Fatalf("Unexpected registration %q %+v", name, meta)
+	}
+	sourceMetadata.update(name, meta)
+	sourceMetadata.update(name, &sourceMeta{Pid: 42})
+
+	linesInBuffer := 10
+	logCh := make(chan logEntry)
+	queryMsgChan := make(chan queryMessage)
+
+	go ringBufferHandler(newLogBuffer(linesInBuffer, 0, nil), linesInBuffer, logCh, queryMsgChan, nil)
+
+	logCh <- logEntry{time: time.Now(), source: name, msg: "hello TestJSONFormat", meta: sourceMetadata.get(name)}
+
+	a, b := loopback()
+	defer a.Close()
+	defer b.Close()
+	queryMsgChan <- queryMessage{conn: a, mode: logDump, filter: &logFilter{Mode: logDump, Format: formatJSON}}
+
+	r := bufio.NewReader(b)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record logRecord
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		t.Fatalf("Failed to parse %q: %v", line, err)
+	}
+	if record.Source != name || record.Service != "sshd" || record.Stream != "stdout" || record.Pid != 42 || record.Message != "hello TestJSONFormat" || record.Seq != 1 {
+		t.Errorf("Unexpected record %+v", record)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	// Test that a snapshot writes the buffer to a file
+	linesInBuffer := 10
+	logCh := make(chan logEntry)
+	queryMsgChan := make(chan queryMessage)
+
+	go ringBufferHandler(newLogBuffer(linesInBuffer, 0, nil), linesInBuffer, logCh, queryMsgChan, nil)
+
+	for i := 0; i < 3; i++ {
+		logCh <- logEntry{time: time.Now(), source: "memlogd", msg: fmt.Sprintf("hello TestSnapshot %d", i)}
+	}
+
+	dir, err := ioutil.TempDir("", "memlogd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { snapshotDir = d }(snapshotDir)
+	snapshotDir = dir
+	path := filepath.Join(dir, "snapshot.log")
+
+	a, b := loopback()
+	defer b.Close()
+	queryMsgChan <- queryMessage{conn: a, mode: logSnapshot, snapshot: path}
+
+	reply, err := bufio.NewReader(b).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "OK\n" {
+		t.Fatalf("Unexpected reply %q", reply)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[2], "hello TestSnapshot 2") {
+		t.Errorf("Unexpected snapshot %q", contents)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected only the snapshot in %s, found %d files", dir, len(files))
+	}
+}
+
+func TestSnapshotPath(t *testing.T) {
+	// Test that snapshots are only written in snapshotDir
+	dir, err := ioutil.TempDir("", "memlogd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { snapshotDir = d }(snapshotDir)
+	snapshotDir = filepath.Join(dir, "snapshots")
+	if err := os.Mkdir(snapshotDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, filepath.Join(snapshotDir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	for path, ok := range map[string]bool{
+		filepath.Join(snapshotDir, "logs.txt"):           true,
+		filepath.Join(dir, "logs.txt"):                   false,
+		filepath.Join(snapshotDir, "..", "logs.txt"):     false,
+		filepath.Join(snapshotDir, "escape", "logs.txt"): false,
+		"logs.txt":    false,
+		"/etc/shadow": false,
+		filepath.Join(snapshotDir+"-other", "logs.txt"): false,
+	} {
+		if err := checkSnapshotPath(path); (err == nil) != ok {
+			t.Errorf("checkSnapshotPath(%q) returned %v", path, err)
+		}
+	}
+	snapshotDir = ""
+	if err := checkSnapshotPath(filepath.Join(dir, "logs.txt")); err == nil {
+		t.Errorf("Snapshot allowed while disabled")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	// Test that received and evicted messages are counted
+	m := newLogMetrics()
+	buffer := newLogBuffer(2, 0, nil)
+	for i := 0; i < 3; i++ {
+		msg := logEntry{time: time.Now(), source: "sshd", msg: "hello"}
+		m.receive(&msg, buffer.add(msg))
+	}
+	var b strings.Builder
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`memlogd_messages_received_total{source="sshd"} 3`,
+		"memlogd_messages_evicted_total 1",
+		"memlogd_buffered_bytes 10",
+	} {
+		if !strings.Contains(b.String(), expected+"\n") {
+			t.Errorf("Expected %q in metrics:\n%s", expected, b.String())
+		}
+	}
+}
+
+func TestReadACL(t *testing.T) {
+	// Test that restricted users only see their own logs
+	acl := make(readACL)
+	for _, rule := range []string{"1000=sshd*", "1000=getty"} {
+		if err := acl.Set(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if acl.allowed(0) != nil {
+		t.Errorf("root should be unrestricted")
+	}
+	filter := &logFilter{allowed: acl.allowed(1000)}
+	for source, expected := range map[string]bool{"sshd": true, "sshd.out": true, "getty": true, "kubelet": false} {
+		if filter.match(&logEntry{source: source}) != expected {
+			t.Errorf("uid 1000 reading %s: expected %v", source, expected)
+		}
+	}
+	filter = &logFilter{allowed: acl.allowed(1001)}
+	if filter.match(&logEntry{source: "sshd"}) {
+		t.Errorf("uid 1001 should not be able to read any logs")
+	}
+}
+
+func TestFollowerDrops(t *testing.T) {
+	// Test that a client which falls behind is told how much it missed
+	a, b := loopback()
+	defer a.Close()
+	defer b.Close()
+	l := newConnListener(a, 1, nil)
+
+	for i := 0; i < 3; i++ {
+		msg := &logEntry{time: time.Now(), source: "memlogd", msg: fmt.Sprintf("hello TestFollowerDrops %d", i)}
+		if sent := l.send(msg); sent != (i == 0) {
+			t.Errorf("message %d: sent = %v", i, sent)
+		}
+	}
+	if l.dropped != 2 {
+		t.Errorf("Expected 2 dropped messages, got %d", l.dropped)
+	}
+	<-l.output
+	// the notice fills the buffer, so this is dropped too
+	if l.send(&logEntry{time: time.Now(), source: "memlogd", msg: "hello again"}) {
+		t.Errorf("Expected message to be dropped after the notice")
+	}
+	notice := <-l.output
+	if !strings.Contains(notice.msg, "2 messages dropped") {
+		t.Errorf("Unexpected notice %q", notice.msg)
+	}
+}
+
+func TestConsoleMirror(t *testing.T) {
+	// Test that the last matching rule decides whether a log is mirrored
+	c := consoleMirror{enable: true}
+	a, b := loopback()
+	defer a.Close()
+	defer b.Close()
+	if err := c.apply(&consoleRequest{Enable: false, Source: "kube*"}, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.apply(&consoleRequest{Enable: true, Source: "kubelet"}, b); err != nil {
+		t.Fatal(err)
+	}
+	for source, expected := range map[string]bool{"sshd": true, "kube-proxy": false, "kubelet": true} {
+		if c.enabled(&logEntry{source: source}) != expected {
+			t.Errorf("%s: expected %v", source, expected)
+		}
+	}
+	// the rule of a client is removed when it disconnects
+	c.remove(b)
+	if c.enabled(&logEntry{source: "kubelet"}) {
+		t.Errorf("Expected kubelet to be disabled once its rule was removed")
+	}
+	if err := c.apply(&consoleRequest{Enable: false}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c.enabled(&logEntry{source: "kubelet"}) {
+		t.Errorf("Expected all logs to be disabled")
+	}
+}
+
+func TestPartialLines(t *testing.T) {
+	// Test that output written in pieces is recorded as whole lines, and
+	// that a partial line is recorded after a timeout
+	defer func(d time.Duration) { partialLineTimeout = d }(partialLineTimeout)
+	partialLineTimeout = 100 * time.Millisecond
+
+	logCh := make(chan logEntry)
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := os.NewFile(uintptr(fds[1]), "")
+	defer w.Close()
+	go readLogFromFd(80, fds[0], "TestPartialLines", logCh)
+
+	for _, chunk := range []string{"hel", "lo\nwor", "ld\r\n", "10%"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, expected := range []string{"hello", "world", "10%"} {
+		select {
+		case msg := <-logCh:
+			if msg.msg != expected {
+				t.Errorf("Expected %q, got %q", expected, msg.msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %q", expected)
+		}
+	}
+}
+
+func TestSourceTimestamps(t *testing.T) {
+	// Test that trusted sources keep their own timestamps, separately
+	defer func(t timestampSources) { trustedTimestamps = t }(trustedTimestamps)
+	trustedTimestamps = timestampSources{"trusted*"}
+
+	for _, source := range []string{"trusted", "untrusted"} {
+		logCh := make(chan logEntry)
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := os.NewFile(uintptr(fds[1]), "")
+		go readLogFromFd(80, fds[0], source, logCh)
+		if _, err := w.Write([]byte("2018-07-08T09:16:53.5Z hello\n")); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		msg := <-logCh
+		if source == "untrusted" {
+			if !msg.origTime.IsZero() || msg.msg != "2018-07-08T09:16:53.5Z hello" {
+				t.Errorf("Untrusted timestamp was parsed: %s", msg.String())
+			}
+			continue
+		}
+		if msg.msg != "hello" || msg.origTime.Format(time.RFC3339Nano) != "2018-07-08T09:16:53.5Z" {
+			t.Errorf("Timestamp was not preserved: %s", msg.String())
+		}
+		if time.Since(msg.time) > time.Minute {
+			t.Errorf("Message was not stamped on receipt: %s", msg.time)
+		}
+		parsed, err := parseLogEntry(msg.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !parsed.origTime.Equal(msg.origTime) || parsed.msg != msg.msg {
+			t.Errorf("Expected %s, got %s", msg.String(), parsed.String())
+		}
+	}
+}
+
+func TestOriginalTime(t *testing.T) {
+	// Test that dumps are ordered and filtered by the original time of
+	// messages from trusted sources
+	logCh := make(chan logEntry)
+	queryMsgChan := make(chan queryMessage)
+	go ringBufferHandler(newLogBuffer(10, 0, nil), 10, logCh, queryMsgChan, nil)
+
+	now := time.Now()
+	logCh <- logEntry{time: now, source: "local", msg: "second"}
+	logCh <- logEntry{time: now, source: "relayed", msg: "first", origTime: now.Add(-time.Hour)}
+	logCh <- logEntry{time: now, source: "relayed", msg: "third", origTime: now.Add(time.Second)}
+
+	for _, test := range []struct {
+		filter   string
+		expected []string
+	}{
+		{`{"mode":0}`, []string{"first", "second", "third"}},
+		{fmt.Sprintf(`{"mode":0,"since":%q}`, now.Add(-time.Minute).Format(time.RFC3339)), []string{"second", "third"}},
+		{fmt.Sprintf(`{"mode":0,"until":%q}`, now.Add(-time.Minute).Format(time.RFC3339)), []string{"first"}},
+	} {
+		a, b := loopback()
+		if _, err := b.Write([]byte(test.filter + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		filter, err := readFilter(a.(*net.UnixConn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		queryMsgChan <- queryMessage{conn: a, mode: filter.Mode, filter: filter}
+		out, err := ioutil.ReadAll(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msgs []string
+		for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+			if line != "" {
+				msgs = append(msgs, line[strings.Index(line, ";")+1:])
+			}
+		}
+		if strings.Join(msgs, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s returned %v, expected %v", test.filter, msgs, test.expected)
+		}
+		a.Close()
+		b.Close()
+	}
+
+	// clients without a hello see the original time in place of ours
+	msg := &logEntry{time: now, source: "relayed", msg: "first", origTime: time.Date(2018, 7, 8, 9, 16, 53, 0, time.UTC)}
+	if s := msg.legacyString(); s != "2018-07-08T09:16:53Z,relayed;first" {
+		t.Errorf("Unexpected legacy format %q", s)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	// Test that priorities from the registration and kernel-style prefixes
+	// are recorded
+	info := 30 // daemon.info
+	sourceMetadata.update("TestPriority", &sourceMeta{Priority: &info, LevelPrefix: true})
+	logCh := make(chan logEntry)
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := os.NewFile(uintptr(fds[1]), "")
+	go readLogFromFd(80, fds[0], "TestPriority", logCh)
+	if _, err := w.Write([]byte("<3>failed\nstarted\n<999>not a priority\n")); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	for _, expected := range []struct {
+		msg      string
+		priority priority
+		severity string
+	}{
+		{"failed", 27, "err"}, // the facility comes from the registration
+		{"started", 30, "info"},
+		{"<999>not a priority", 30, "info"},
+	} {
+		msg := <-logCh
+		if msg.msg != expected.msg || msg.pri == nil || *msg.pri != expected.priority {
+			t.Errorf("Expected %q with priority %d, got %s", expected.msg, expected.priority, msg.String())
+			continue
+		}
+		var r logRecord
+		if err := json.Unmarshal([]byte(msg.JSON()), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Severity != expected.severity || r.Facility != "daemon" {
+			t.Errorf("Expected daemon.%s, got %s.%s", expected.severity, r.Facility, r.Severity)
+		}
+		parsed, err := parseLogEntry(msg.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.pri == nil || *parsed.pri != *msg.pri || parsed.msg != msg.msg {
+			t.Errorf("Expected %s, got %s", msg.String(), parsed.String())
+		}
+	}
+}
+
+func TestSampling(t *testing.T) {
+	// Test that 1 in N messages are kept, and all severe ones
+	var rules samplingRules
+	if err := rules.Set("chatty*=3:warning"); err != nil {
+		t.Fatal(err)
+	}
+	s := newSampler(rules)
+	warning := priority(4)
+	debug := priority(7)
+	kept := 0
+	for i := 0; i < 9; i++ {
+		if s.keep(&logEntry{source: "chatty", msg: "debug", pri: &debug}) {
+			kept++
+		}
+	}
+	if kept != 3 {
+		t.Errorf("Expected 3 of 9 messages to be kept, got %d", kept)
+	}
+	for i := 0; i < 3; i++ {
+		if !s.keep(&logEntry{source: "chatty", msg: "warning", pri: &warning}) {
+			t.Errorf("Warning was discarded")
+		}
+		if !s.keep(&logEntry{source: "quiet", msg: "info"}) {
+			t.Errorf("Message from an unsampled log was discarded")
+		}
+	}
+	if rules.String() != "chatty*=3:warning" {
+		t.Errorf("Unexpected rules %s", rules.String())
+	}
+}
+
+func TestEscapeBinary(t *testing.T) {
+	for input, expected := range map[string]string{
+		"plain\ttext":        "plain\ttext",
+		"caf\xc3\xa9":        "caf\xc3\xa9",
+		"bad \xff\xfe bytes": `bad \xff\xfe bytes`,
+		"bell\a and \x1b[0m": `bell\x07 and \x1b[0m`,
+		"cr\rin the middle":  `cr\x0din the middle`,
+	} {
+		if actual := escapeBinary([]byte(input)); actual != expected {
+			t.Errorf("Expected %q, got %q", expected, actual)
+		}
+	}
+}
+
+func TestFdStore(t *testing.T) {
+	// Test that the supervisor keeps the log fds and sends them back
+	seqpacket := func() (*net.UnixConn, *net.UnixConn) {
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := fdToConn(fds[0]).(*net.UnixConn)
+		b := fdToConn(fds[1]).(*net.UnixConn)
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return a, b
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	worker, supervisor := seqpacket()
+	store := newFdStore()
+	done := make(chan struct{})
+	go func() {
+		store.receive(supervisor)
+		close(done)
+	}()
+	if err := storeAdd(worker, "1.1", "TestFdStore", &sourceMeta{Service: "test"}, int(r.Fd())); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeAdd(worker, "1.2", "TestFdStore.out", nil, int(r.Fd())); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeRemove(worker, "1.2"); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	// the worker exits
+	worker.Close()
+	<-done
+	supervisor.Close()
+	if len(store.fds) != 1 || store.fds["1.1"] == nil {
+		t.Fatalf("Expected only fd 1.1 to be stored, got %v", store.fds)
+	}
+
+	worker, supervisor = seqpacket()
+	defer worker.Close()
+	defer supervisor.Close()
+	if err := store.replay(supervisor); err != nil {
+		t.Fatal(err)
+	}
+	logCh := make(chan logEntry, 10)
+	fdMsgChan := make(chan fdMessage)
+	go receiveStoredFds(worker, logCh, fdMsgChan)
+	msg := <-fdMsgChan
+	if msg.id != "1.1" || msg.name != "TestFdStore" {
+		t.Fatalf("Unexpected fd %s %s", msg.id, msg.name)
+	}
+	if meta := sourceMetadata.get("TestFdStore"); meta == nil || meta.Service != "test" {
+		t.Errorf("Metadata was not restored: %v", meta)
+	}
+	f := os.NewFile(uintptr(msg.fd), "")
+	defer f.Close()
+	if _, err := w.Write([]byte("still there\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil || line != "still there\n" {
+		t.Errorf("Expected to read from the restored fd, got %q: %v", line, err)
+	}
+}
+
+func TestBootSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memlogd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "memlogd.conf")
+	cmdline := filepath.Join(dir, "cmdline")
+	if err := ioutil.WriteFile(config, []byte("# buffers\nmax-lines = 100\nsource-lines=kubelet=200\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cmdline, []byte("console=ttyS0 memlogd.max-lines=300 quiet\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	settings, err := bootSettings(config, cmdline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []setting{
+		{name: "max-lines", value: "100", origin: config},
+		{name: "source-lines", value: "kubelet=200", origin: config},
+		{name: "max-lines", value: "300", origin: "the kernel command line"},
+	}
+	if fmt.Sprint(settings) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, settings)
+	}
+
+	// invalid settings are skipped without losing the others
+	if err := ioutil.WriteFile(cmdline, []byte("memlogd.persist-file=/etc/passwd memlogd.max-lines memlogd.max-lines=400\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	settings, err = bootSettings(filepath.Join(dir, "missing"), cmdline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []setting{{name: "max-lines", value: "400", origin: "the kernel command line"}}
+	if fmt.Sprint(settings) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, settings)
+	}
+}
+
+func TestNamespaceFilter(t *testing.T) {
+	// Test that messages can be selected by containerd namespace
+	filter := &logFilter{Namespace: "services.linuxkit"}
+	for _, c := range []struct {
+		meta     *sourceMeta
+		expected bool
+	}{
+		{nil, false},
+		{&sourceMeta{Service: "sshd"}, false},
+		{&sourceMeta{Service: "sshd", Namespace: "services.linuxkit"}, true},
+		{&sourceMeta{Service: "app", Namespace: "default"}, false},
+	} {
+		if filter.match(&logEntry{source: "sshd", meta: c.meta}) != c.expected {
+			t.Errorf("%+v: expected %v", c.meta, c.expected)
+		}
+	}
+}
+
+func TestReliable(t *testing.T) {
+	// Test that a reliable client has a larger buffer, but is never waited
+	// for once it is full
+	defer func(n int) { reliableFollowerLines = n }(reliableFollowerLines)
+	reliableFollowerLines = 100
+
+	a, b := loopback()
+	defer a.Close()
+	defer b.Close()
+	l := newConnListener(a, 1, &logFilter{Reliable: true})
+	for i := 0; i < reliableFollowerLines; i++ {
+		if !l.send(&logEntry{source: "memlogd", msg: "hello TestReliable"}) {
+			t.Fatalf("Message %d dropped from a reliable buffer", i)
+		}
+	}
+	start := time.Now()
+	if l.send(&logEntry{source: "memlogd", msg: "hello TestReliable"}) {
+		t.Errorf("Message queued in a full buffer")
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("Waited %s for a reliable client", time.Since(start))
+	}
+}
+
+func TestHello(t *testing.T) {
+	// Test that hellos are answered before the command on the query socket
+	a, b := loopback()
+	defer a.Close()
+	defer b.Close()
+	if _, err := b.Write(append([]byte{byte(logHello)}, "{\"version\":1}\n"+string([]byte{byte(logFollow)})...)); err != nil {
+		t.Fatal(err)
+	}
+	mode, clientHello, err := readCommand(a.(*net.UnixConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientHello == nil || clientHello.Version != 1 {
+		t.Errorf("Expected the client's hello, got %+v", clientHello)
+	}
+	if mode != logFollow {
+		t.Errorf("Expected command %d after the hello, got %d", logFollow, mode)
+	}
+	line, err := bufio.NewReader(b).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := parseHello(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != protocolVersion {
+		t.Errorf("Expected version %d, got %d", protocolVersion, h.Version)
+	}
+
+	// and on the log socket, to clients with an address
+	dir, err := ioutil.TempDir("", "memlogd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "log.sock"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "client.sock"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.WriteToUnix([]byte(helloName+"\n{\"version\":1}"), server.LocalAddr().(*net.UnixAddr)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n, addr, err := server.ReadFromUnix(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isHello(buf[:n]) {
+		t.Fatalf("%q is not a hello", buf[:n])
+	}
+	if err := answerHello(server, buf[:n], addr); err != nil {
+		t.Fatal(err)
+	}
+	n, err = client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, err = parseHello(buf[:n]); err != nil || h.Version != protocolVersion {
+		t.Errorf("Unexpected reply %q: %v", buf[:n], err)
+	}
+}
+
+func TestLegacyFormat(t *testing.T) {
+	// Test that clients which don't say hello get the original format
+	dir, err := ioutil.TempDir("", "memlogd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "query.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	logCh := make(chan logEntry)
+	queryMsgChan := make(chan queryMessage)
+	go ringBufferHandler(newLogBuffer(10, 0, nil), 10, logCh, queryMsgChan, nil)
+	go receiveQueryHandler(l, nil, logCh, queryMsgChan)
+	now := time.Now()
+	logCh <- logEntry{time: now, source: "sshd", msg: "hello TestLegacyFormat"}
+
+	for _, test := range []struct {
+		request  string
+		expected string
+	}{
+		{string([]byte{byte(logDump)}), now.Format(time.RFC3339) + ",sshd;hello TestLegacyFormat\n"},
+		{string([]byte{byte(logHello)}) + "{\"version\":1}\n" + string([]byte{byte(logDump)}), now.Format(time.RFC3339) + ",sshd,1;hello TestLegacyFormat\n"},
+	} {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte(test.request)); err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(conn)
+		if test.request[0] == byte(logHello) {
+			if _, err := r.ReadString('\n'); err != nil {
+				t.Fatal(err)
+			}
+		}
+		line, err := r.ReadString('\n')
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, line)
+		}
 	}
 }
 
@@ -120,7 +1012,7 @@ func TestGoodName(t *testing.T) {
 	fdMsgChan := make(chan fdMessage)
 	queryMsgChan := make(chan queryMessage)
 
-	go ringBufferHandler(linesInBuffer, linesInBuffer, logCh, queryMsgChan)
+	go ringBufferHandler(newLogBuffer(linesInBuffer, 0, nil), linesInBuffer, logCh, queryMsgChan, nil)
 	go loggingRequestHandler(80, logCh, fdMsgChan)
 
 	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
@@ -133,9 +1025,16 @@ func TestGoodName(t *testing.T) {
 	defer b.Close()
 	// defer close fds
 
+	// memlogd closes the fd it is sent, so send a copy: fds[0] belongs to
+	// the *os.File made by fdToConn, which closes it again when finalised,
+	// by which time the number may have been reused by another test.
+	rejected, err := syscall.Dup(fds[0])
+	if err != nil {
+		log.Fatal("Unable to dup socketpair fd: ", err)
+	}
 	fdMsgChan <- fdMessage{
 		name: "semi-colons are banned;",
-		fd:   fds[0],
+		fd:   rejected,
 	}
 	// although the fd should be rejected my memlogd the Write should be buffered
 	// by the kernel and not block.
@@ -170,6 +1069,67 @@ func TestGoodName(t *testing.T) {
 	t.Fatal("Failed to read error message when registering a log with a ;")
 }
 
+func TestPersist(t *testing.T) {
+	// Test that the persistent buffer keeps the newest entries across a reopen
+	dir, err := ioutil.TempDir("", "memlogd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "persist")
+
+	r, err := openPersistentRing(path, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.setInstance("TestPersist")
+	// Overflow the buffer a few times
+	for i := 0; i < 60; i++ {
+		r.write(&logEntry{time: time.Now(), source: "memlogd", msg: fmt.Sprintf("hello TestPersist %d", i)})
+	}
+	// the metadata and original time of the newest entry must be kept
+	n := 30
+	orig := time.Date(2018, 7, 8, 9, 16, 53, 123, time.UTC)
+	r.write(&logEntry{time: time.Now(), source: "sshd", msg: "hello TestPersist 60", origTime: orig, pri: validPriority(&n),
+		meta: &sourceMeta{Service: "sshd", Stream: "stdout", Namespace: "services.linuxkit"}})
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = openPersistentRing(path, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if id := r.instance(); id != "TestPersist" {
+		t.Errorf("Instance is %q, expected %q", id, "TestPersist")
+	}
+	entries := r.entries()
+	if len(entries) == 0 {
+		t.Fatal("No entries recovered")
+	}
+	last := entries[len(entries)-1]
+	if last.msg != "hello TestPersist 60" {
+		t.Errorf("Newest entry is %q, expected %q", last.msg, "hello TestPersist 60")
+	}
+	if last.meta == nil || last.meta.Service != "sshd" || last.meta.Stream != "stdout" || !last.origTime.Equal(orig) || last.pri == nil || *last.pri != 30 {
+		t.Errorf("Newest entry lost its metadata: %+v", last)
+	}
+	if !(&logFilter{Namespace: "services.linuxkit"}).match(&last) {
+		t.Errorf("Restored entry does not match its namespace")
+	}
+	// the recovered entries should be consecutive
+	var first int
+	if _, err := fmt.Sscanf(entries[0].msg, "hello TestPersist %d", &first); err != nil {
+		t.Fatalf("Unexpected entry %q", entries[0].msg)
+	}
+	for i, e := range entries {
+		if expected := fmt.Sprintf("hello TestPersist %d", first+i); e.msg != expected {
+			t.Errorf("Entry %d is %q, expected %q", i, e.msg, expected)
+		}
+	}
+}
+
 // caller must close fd themselves: closing the net.Conn will not close fd.
 func fdToConn(fd int) net.Conn {
 	f := os.NewFile(uintptr(fd), "")
@@ -196,3 +1156,46 @@ func loopback() (net.Conn, net.Conn) {
 	}
 	return a, b
 }
+
+// BenchmarkReadLog measures reading a busy service's output into messages.
+func BenchmarkReadLog(b *testing.B) {
+	logCh := make(chan logEntry, 1000)
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := os.NewFile(uintptr(fds[1]), "")
+	go readLogFromFd(1024, fds[0], "BenchmarkReadLog", logCh)
+	line := []byte(strings.Repeat("x", 99) + "\n")
+	chunk := bytes.Repeat(line, 100)
+	b.SetBytes(int64(len(line)))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i += 100 {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+		w.Close()
+	}()
+	for i := 0; i < b.N; i++ {
+		<-logCh
+	}
+}
+
+// BenchmarkFollower measures sending messages to a client.
+func BenchmarkFollower(b *testing.B) {
+	a, c := loopback()
+	defer c.Close()
+	go io.Copy(ioutil.Discard, c)
+	l := newConnListener(a, 1000, nil)
+	go l.run()
+	msg := &logEntry{time: time.Now(), source: "BenchmarkFollower", msg: strings.Repeat("x", 99)}
+	b.SetBytes(int64(len(msg.String()) + 1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.output <- msg
+	}
+	close(l.output)
+	<-l.done
+}
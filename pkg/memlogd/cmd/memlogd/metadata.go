@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sourceMeta describes the process writing to a log source. It is sent by
+// the client after the name in the registration datagram, separated by a
+// newline, for example "sshd.out\n{"service":"sshd","stream":"stdout"}".
+// A datagram with metadata but no fd updates the metadata of a source, for
+// example to add the pid once the process has been created.
+type sourceMeta struct {
+	Service   string `json:"service,omitempty"`
+	Stream    string `json:"stream,omitempty"`
+	Pid       int    `json:"pid,omitempty"`
+	Namespace string `json:"namespace,omitempty"` // containerd namespace
+	Priority  *int   `json:"priority,omitempty"`  // syslog priority of every line
+	// LevelPrefix is set if lines may start with a kernel-style "<N>"
+	// priority, which overrides Priority.
+	LevelPrefix bool `json:"level_prefix,omitempty"`
+}
+
+// sourceRegistry holds the metadata of each source. Entries are replaced
+// rather than modified, so a *sourceMeta may be kept by log entries.
+type sourceRegistry struct {
+	mu      sync.Mutex
+	sources map[string]*sourceMeta
+}
+
+var sourceMetadata = &sourceRegistry{sources: make(map[string]*sourceMeta)}
+
+// update merges the non-empty fields of meta into the source's metadata.
+func (r *sourceRegistry) update(source string, meta *sourceMeta) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	merged := &sourceMeta{}
+	if old, ok := r.sources[source]; ok {
+		*merged = *old
+	}
+	if meta.Service != "" {
+		merged.Service = meta.Service
+	}
+	if meta.Stream != "" {
+		merged.Stream = meta.Stream
+	}
+	if meta.Pid != 0 {
+		merged.Pid = meta.Pid
+	}
+	if meta.Namespace != "" {
+		merged.Namespace = meta.Namespace
+	}
+	if meta.Priority != nil {
+		merged.Priority = meta.Priority
+	}
+	if meta.LevelPrefix {
+		merged.LevelPrefix = true
+	}
+	r.sources[source] = merged
+}
+
+// get returns the source's metadata, or nil if there is none.
+func (r *sourceRegistry) get(source string) *sourceMeta {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sources[source]
+}
+
+// parseRegistration splits a registration datagram into the source name
+// and optional metadata.
+func parseRegistration(b []byte) (string, *sourceMeta, error) {
+	bits := strings.SplitN(string(b), "\n", 2)
+	if len(bits) == 1 || bits[1] == "" {
+		return bits[0], nil, nil
+	}
+	var meta sourceMeta
+	if err := json.Unmarshal([]byte(bits[1]), &meta); err != nil {
+		return bits[0], nil, err
+	}
+	return bits[0], &meta, nil
+}
+
+// logRecord is a log entry in the "json" output format.
+type logRecord struct {
+	Time         time.Time  `json:"time"`
+	OriginalTime *time.Time `json:"original_time,omitempty"`
+	Source       string     `json:"source"`
+	Seq          uint64     `json:"seq"`
+	Service      string     `json:"service,omitempty"`
+	Stream       string     `json:"stream,omitempty"`
+	Pid          int        `json:"pid,omitempty"`
+	Namespace    string     `json:"namespace,omitempty"`
+	Priority     *int       `json:"priority,omitempty"`
+	Severity     string     `json:"severity,omitempty"`
+	Facility     string     `json:"facility,omitempty"`
+	Message      string     `json:"message"`
+}
+
+// JSON encodes the entry as a logRecord.
+func (msg *logEntry) JSON() string {
+	r := logRecord{
+		Time:    msg.time,
+		Source:  msg.source,
+		Seq:     msg.seq,
+		Message: msg.msg,
+	}
+	if !msg.origTime.IsZero() {
+		r.OriginalTime = &msg.origTime
+	}
+	if msg.pri != nil {
+		p := int(*msg.pri)
+		r.Priority = &p
+		r.Severity = msg.pri.severity()
+		r.Facility = msg.pri.facility()
+	}
+	if msg.meta != nil {
+		r.Service = msg.meta.Service
+		r.Stream = msg.meta.Stream
+		r.Pid = msg.meta.Pid
+		r.Namespace = msg.meta.Namespace
+	}
+	b, err := json.Marshal(&r)
+	if err != nil {
+		// cannot happen: all the fields can be encoded
+		return msg.String()
+	}
+	return string(b)
+}
+
+// parseLogRecord is the inverse of logEntry.JSON()
+func parseLogRecord(line string) (*logEntry, error) {
+	var r logRecord
+	if err := json.Unmarshal([]byte(line), &r); err != nil {
+		return nil, err
+	}
+	e := &logEntry{time: r.Time, source: r.Source, seq: r.Seq, msg: r.Message}
+	if r.OriginalTime != nil {
+		e.origTime = *r.OriginalTime
+	}
+	if r.Priority != nil {
+		if e.pri = validPriority(r.Priority); e.pri == nil {
+			return nil, fmt.Errorf("invalid priority %d", *r.Priority)
+		}
+	}
+	if r.Service != "" || r.Stream != "" || r.Pid != 0 || r.Namespace != "" {
+		e.meta = &sourceMeta{Service: r.Service, Stream: r.Stream, Pid: r.Pid, Namespace: r.Namespace}
+	}
+	return e, nil
+}
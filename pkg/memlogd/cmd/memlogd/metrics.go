@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// logMetrics counts what happens to log messages, so that log loss can
+// be detected by monitoring.
+type logMetrics struct {
+	mu            sync.Mutex
+	received      map[string]uint64 // messages received, by source
+	bytesBuffered int64             // bytes of message bodies in the buffer
+	evicted       uint64            // messages overwritten in the buffer
+	dropped       map[string]uint64 // messages not sent to a slow client, by source
+	sampled       map[string]uint64 // messages discarded by sampling, by source
+	followers     int               // connected clients following the log
+}
+
+var memlogdMetrics = newLogMetrics()
+
+func newLogMetrics() *logMetrics {
+	return &logMetrics{
+		received: make(map[string]uint64),
+		dropped:  make(map[string]uint64),
+		sampled:  make(map[string]uint64),
+	}
+}
+
+// receive counts a message added to the buffer, and the message it
+// evicted if any.
+func (m *logMetrics) receive(msg *logEntry, evicted *logEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.received[msg.source]++
+	m.bytesBuffered += int64(len(msg.msg))
+	if evicted != nil {
+		m.evicted++
+		m.bytesBuffered -= int64(len(evicted.msg))
+	}
+}
+
+// sample counts a message received but discarded by sampling.
+func (m *logMetrics) sample(msg *logEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.received[msg.source]++
+	m.sampled[msg.source]++
+}
+
+// restore accounts for a message restored into the buffer from the
+// persistent copy, which was received by a previous memlogd.
+func (m *logMetrics) restore(msg *logEntry, evicted *logEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytesBuffered += int64(len(msg.msg))
+	if evicted != nil {
+		m.bytesBuffered -= int64(len(evicted.msg))
+	}
+}
+
+// drop counts a message which was not sent to a client.
+func (m *logMetrics) drop(msg *logEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropped[msg.source]++
+}
+
+// setFollowers records the number of connected followers.
+func (m *logMetrics) setFollowers(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.followers = n
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *logMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP memlogd_messages_received_total Log messages received, by source.\n")
+	fmt.Fprintf(&b, "# TYPE memlogd_messages_received_total counter\n")
+	writeBySource(&b, "memlogd_messages_received_total", m.received)
+	fmt.Fprintf(&b, "# HELP memlogd_buffered_bytes Bytes of log messages held in the buffer.\n")
+	fmt.Fprintf(&b, "# TYPE memlogd_buffered_bytes gauge\n")
+	fmt.Fprintf(&b, "memlogd_buffered_bytes %d\n", m.bytesBuffered)
+	fmt.Fprintf(&b, "# HELP memlogd_messages_evicted_total Log messages overwritten in the buffer by newer messages.\n")
+	fmt.Fprintf(&b, "# TYPE memlogd_messages_evicted_total counter\n")
+	fmt.Fprintf(&b, "memlogd_messages_evicted_total %d\n", m.evicted)
+	fmt.Fprintf(&b, "# HELP memlogd_messages_dropped_total Log messages not sent to a client which was not reading fast enough, by source.\n")
+	fmt.Fprintf(&b, "# TYPE memlogd_messages_dropped_total counter\n")
+	writeBySource(&b, "memlogd_messages_dropped_total", m.dropped)
+	fmt.Fprintf(&b, "# HELP memlogd_messages_sampled_total Log messages discarded by sampling, by source.\n")
+	fmt.Fprintf(&b, "# TYPE memlogd_messages_sampled_total counter\n")
+	writeBySource(&b, "memlogd_messages_sampled_total", m.sampled)
+	fmt.Fprintf(&b, "# HELP memlogd_followers Connected clients following the log.\n")
+	fmt.Fprintf(&b, "# TYPE memlogd_followers gauge\n")
+	fmt.Fprintf(&b, "memlogd_followers %d\n", m.followers)
+	m.mu.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// writeBySource writes a metric labelled by source, sorted by source.
+func writeBySource(b *strings.Builder, name string, values map[string]uint64) {
+	var sources []string
+	for source := range values {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		fmt.Fprintf(b, "%s{source=%q} %d\n", name, source, values[source])
+	}
+}
+
+// serveMetrics serves the metrics over HTTP at /metrics. addr is either
+// the path of a unix domain socket or a TCP host:port.
+func serveMetrics(addr string, m *logMetrics) error {
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+		_ = os.Remove(addr)
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = m.WriteTo(w)
+	})
+	go func() {
+		_ = http.Serve(l, mux)
+	}()
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"syscall"
+)
+
+// A persistentRing keeps a copy of the log buffer in a memory-mapped file
+// so that recent logs survive a restart of memlogd and can be recovered
+// from a disk image after a crash.
+//
+// The file starts with a small header followed by a circular data area
+// holding log entries as JSON logRecords, one per line, so that their
+// metadata and original times are kept:
+//
+//	magic    [8]byte   "MEMLOGD\x01"
+//	head     uint64    offset in the data area of the next write
+//	wrapped  uint64    1 once the data area has been filled at least once
+//	instance [16]byte  the instanceID of the sequence numbers in the data
+//
+// Integers are little-endian.
+type persistentRing struct {
+	file *os.File
+	mem  []byte // the whole mapping
+	data []byte // the circular data area following the header
+}
+
+const (
+	persistMagic        = "MEMLOGD\x01"
+	persistHeaderSize   = 24 + persistInstanceSize
+	persistInstanceSize = 16
+)
+
+// openPersistentRing maps the file at path, creating it if necessary, with
+// a data area of size bytes. Existing contents are kept unless the file was
+// written with a different size.
+func openPersistentRing(path string, size int) (*persistentRing, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	total := persistHeaderSize + size
+	resized := fi.Size() != int64(total)
+	if resized {
+		if err := f.Truncate(int64(total)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	mem, err := syscall.Mmap(int(f.Fd()), 0, total, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := &persistentRing{
+		file: f,
+		mem:  mem,
+		data: mem[persistHeaderSize:],
+	}
+	if resized || string(mem[:8]) != persistMagic || r.head() >= uint64(len(r.data)) {
+		r.reset()
+	}
+	return r, nil
+}
+
+func (r *persistentRing) head() uint64 {
+	return binary.LittleEndian.Uint64(r.mem[8:16])
+}
+
+func (r *persistentRing) wrapped() bool {
+	return binary.LittleEndian.Uint64(r.mem[16:24]) != 0
+}
+
+// instance returns the instanceID of the entries, or "" if there are none.
+func (r *persistentRing) instance() string {
+	return string(bytes.TrimRight(r.mem[24:persistHeaderSize], "\x00"))
+}
+
+// setInstance records the instanceID of the entries which follow.
+func (r *persistentRing) setInstance(id string) {
+	copy(r.mem[24:persistHeaderSize], make([]byte, persistInstanceSize))
+	copy(r.mem[24:persistHeaderSize], id)
+}
+
+func (r *persistentRing) reset() {
+	copy(r.mem, persistMagic)
+	binary.LittleEndian.PutUint64(r.mem[8:16], 0)
+	binary.LittleEndian.PutUint64(r.mem[16:24], 0)
+	r.setInstance("")
+}
+
+// write appends an entry, overwriting the oldest entries if necessary.
+func (r *persistentRing) write(e *logEntry) {
+	b := []byte(e.JSON() + "\n")
+	if len(b) > len(r.data) {
+		// can never fit: drop it rather than overwriting everything
+		return
+	}
+	head := r.head()
+	n := copy(r.data[head:], b)
+	if n < len(b) {
+		copy(r.data, b[n:])
+	}
+	head += uint64(len(b))
+	if head >= uint64(len(r.data)) {
+		head -= uint64(len(r.data))
+		binary.LittleEndian.PutUint64(r.mem[16:24], 1)
+	}
+	binary.LittleEndian.PutUint64(r.mem[8:16], head)
+}
+
+// entries returns the entries in the file, oldest first.
+func (r *persistentRing) entries() []logEntry {
+	var buf []byte
+	head := r.head()
+	if r.wrapped() {
+		buf = append(buf, r.data[head:]...)
+	}
+	buf = append(buf, r.data[:head]...)
+	if r.wrapped() {
+		// the oldest line has probably been partially overwritten
+		if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+			buf = buf[i+1:]
+		}
+	}
+
+	var entries []logEntry
+	s := bufio.NewScanner(bytes.NewReader(buf))
+	s.Buffer(make([]byte, 0, 4096), len(r.data))
+	for s.Scan() {
+		e, err := parseLogRecord(s.Text())
+		if err != nil {
+			continue
+		}
+		entries = append(entries, *e)
+	}
+	return entries
+}
+
+func (r *persistentRing) Close() error {
+	if err := syscall.Munmap(r.mem); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// priority is a syslog priority: the facility times 8 plus the severity.
+type priority uint8
+
+// maxPriority is the highest valid priority, local7.debug.
+const maxPriority = 191
+
+var severityNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+var facilityNames = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+func (p priority) severity() string {
+	return severityNames[p&7]
+}
+
+func (p priority) facility() string {
+	return facilityNames[p>>3]
+}
+
+// withDefault returns the priority, using the facility of def if the
+// priority is only a severity, as applications often don't say.
+func (p *priority) withDefault(def *priority) *priority {
+	if *p > 7 || def == nil {
+		return p
+	}
+	combined := *def&^7 | *p
+	return &combined
+}
+
+// validPriority returns the priority sent by a client, if it is valid.
+func validPriority(n *int) *priority {
+	if n == nil || *n < 0 || *n > maxPriority {
+		return nil
+	}
+	p := priority(*n)
+	return &p
+}
+
+// splitPriority removes a kernel-style "<N>" priority prefix from a line.
+func splitPriority(line string) (*priority, string, bool) {
+	if !strings.HasPrefix(line, "<") {
+		return nil, line, false
+	}
+	end := strings.IndexByte(line, '>')
+	if end < 2 || end > 4 {
+		return nil, line, false
+	}
+	n, err := strconv.Atoi(line[1:end])
+	if err != nil {
+		return nil, line, false
+	}
+	p := validPriority(&n)
+	if p == nil {
+		return nil, line, false
+	}
+	return p, line[end+1:], true
+}
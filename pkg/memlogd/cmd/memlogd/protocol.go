@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// protocolVersion is the version of the memlogd protocols. Clients which
+// never say hello are treated as version 0, and are sent messages in the
+// original "<time>,<source>;<body>" format, so binaries in older images
+// keep working.
+const protocolVersion = 1
+
+// protocolFeatures lists the optional parts of the protocols this memlogd
+// supports, so that clients can check for what they need.
+var protocolFeatures = []string{"filter", "seq", "snapshot", "console", "metadata", "json", "namespace", "reliable"}
+
+// hello is exchanged as a line of JSON after the logHello command byte on
+// the query socket, and in a helloName datagram on the log socket.
+type hello struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features,omitempty"`
+	Instance string   `json:"instance,omitempty"` // set by memlogd
+}
+
+// instanceID identifies the sequence numbers given by this memlogd. It
+// changes whenever they start again from 1, after a reboot or a restart
+// without -persist-file, so that a client can't resume from a sequence
+// number which was given to a different message.
+var instanceID string
+
+// newInstanceID returns a random instance ID.
+func newInstanceID() string {
+	b := make([]byte, persistInstanceSize/2)
+	if _, err := rand.Read(b); err != nil {
+		// cannot happen on Linux: getrandom blocks until it has entropy
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// helloName is sent in place of a log name to say hello on the log socket.
+// Log names may not contain ";" so it can't clash with a log, and memlogds
+// which predate the handshake ignore it.
+const helloName = ";hello"
+
+// serverHello returns our hello as a line of JSON.
+func serverHello() []byte {
+	b, err := json.Marshal(&hello{Version: protocolVersion, Features: protocolFeatures, Instance: instanceID})
+	if err != nil {
+		// cannot happen: all the fields can be encoded
+		panic(err)
+	}
+	return append(b, '\n')
+}
+
+// parseHello decodes the hello of a client.
+func parseHello(b []byte) (*hello, error) {
+	var h hello
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, fmt.Errorf("invalid hello: %v", err)
+	}
+	return &h, nil
+}
+
+// readCommand reads the command byte of a query, answering any hellos
+// which come first. The client's hello is returned, or nil if it didn't
+// say hello.
+func readCommand(conn *net.UnixConn) (logMode, *hello, error) {
+	mode := make([]byte, 1)
+	var h *hello
+	for {
+		if _, err := io.ReadFull(conn, mode); err != nil {
+			return 0, nil, err
+		}
+		if logMode(mode[0]) != logHello {
+			return logMode(mode[0]), h, nil
+		}
+		line, err := readLine(conn)
+		if err != nil {
+			return 0, nil, err
+		}
+		if h, err = parseHello(line); err != nil {
+			return 0, nil, err
+		}
+		if _, err := conn.Write(serverHello()); err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// isHello returns true if a datagram received on the log socket is a hello
+// rather than the registration of a log.
+func isHello(b []byte) bool {
+	return strings.SplitN(string(b), "\n", 2)[0] == helloName
+}
+
+// answerHello replies to a hello datagram on the log socket. Only clients
+// which bound their socket to an address can receive the reply.
+func answerHello(conn *net.UnixConn, b []byte, addr *net.UnixAddr) error {
+	bits := strings.SplitN(string(b), "\n", 2)
+	if len(bits) == 2 && bits[1] != "" {
+		if _, err := parseHello([]byte(bits[1])); err != nil {
+			return err
+		}
+	}
+	if addr == nil || addr.Name == "" {
+		return nil
+	}
+	_, err := conn.WriteToUnix(serverHello(), addr)
+	return err
+}
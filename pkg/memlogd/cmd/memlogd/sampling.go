@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// samplingRule keeps one in every messages from the logs matching source,
+// and all those at least as severe as severity, if it is not -1.
+type samplingRule struct {
+	source   string
+	every    int
+	severity int
+}
+
+// samplingRules is a flag.Value set with repeated glob=N[:severity]
+// arguments, for example "kube-apiserver*=100:warning". If several rules
+// match a log the last one wins.
+type samplingRules []samplingRule
+
+var sampling samplingRules
+
+func (s *samplingRules) String() string {
+	var rules []string
+	for _, r := range *s {
+		rule := fmt.Sprintf("%s=%d", r.source, r.every)
+		if r.severity >= 0 {
+			rule += ":" + severityNames[r.severity]
+		}
+		rules = append(rules, rule)
+	}
+	return strings.Join(rules, ",")
+}
+
+func (s *samplingRules) Set(value string) error {
+	bits := strings.SplitN(value, "=", 2)
+	if len(bits) != 2 || bits[0] == "" {
+		return fmt.Errorf("expected glob=N[:severity], got %q", value)
+	}
+	if _, err := path.Match(bits[0], ""); err != nil {
+		return fmt.Errorf("invalid glob %q: %v", bits[0], err)
+	}
+	rule := samplingRule{source: bits[0], severity: -1}
+	bits = strings.SplitN(bits[1], ":", 2)
+	every, err := strconv.Atoi(bits[0])
+	if err != nil || every < 1 {
+		return fmt.Errorf("invalid sampling rate %q", bits[0])
+	}
+	rule.every = every
+	if len(bits) == 2 {
+		for i, name := range severityNames {
+			if name == bits[1] {
+				rule.severity = i
+			}
+		}
+		if rule.severity < 0 {
+			return fmt.Errorf("unknown severity %q, expected one of %s", bits[1], strings.Join(severityNames, ", "))
+		}
+	}
+	*s = append(*s, rule)
+	return nil
+}
+
+// sampler decides which messages from chatty logs are kept, so that they
+// don't push everything else out of the buffer. It is owned by
+// ringBufferHandler.
+type sampler struct {
+	rules  samplingRules
+	counts map[string]int // messages seen from each sampled log
+}
+
+func newSampler(rules samplingRules) *sampler {
+	return &sampler{rules: rules, counts: make(map[string]int)}
+}
+
+// keep returns true if the message should be kept.
+func (s *sampler) keep(msg *logEntry) bool {
+	var rule *samplingRule
+	for i := range s.rules {
+		if ok, _ := path.Match(s.rules[i].source, msg.source); ok {
+			rule = &s.rules[i]
+		}
+	}
+	if rule == nil {
+		return true
+	}
+	if rule.severity >= 0 && msg.pri != nil && int(*msg.pri&7) <= rule.severity {
+		return true
+	}
+	n := s.counts[msg.source]
+	s.counts[msg.source] = (n + 1) % rule.every
+	return n == 0
+}
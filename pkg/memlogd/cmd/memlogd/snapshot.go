@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// snapshotDir is the directory snapshots may be written in, or "" if
+// snapshots are disabled. As memlogd runs as root, snapshots anywhere else
+// could replace any file.
+var snapshotDir = "/var/log"
+
+// checkSnapshotPath returns an error unless path is in snapshotDir, after
+// following any symlinks to its directory.
+func checkSnapshotPath(path string) error {
+	if snapshotDir == "" {
+		return errors.New("snapshots are disabled")
+	}
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("snapshot path %q is not absolute", path)
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(filepath.Clean(path)))
+	if err != nil {
+		return err
+	}
+	root, err := filepath.EvalSymlinks(snapshotDir)
+	if err != nil {
+		return err
+	}
+	if dir != root && !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		return fmt.Errorf("snapshot path %q is not in %s", path, snapshotDir)
+	}
+	return nil
+}
+
+// writeSnapshot atomically writes entries to path, then replies to the
+// client with "OK" or "ERROR: <reason>" and closes the connection.
+func writeSnapshot(conn net.Conn, path string, entries []logEntry) {
+	sendReply(conn, snapshotToFile(path, entries))
+}
+
+// snapshotToFile writes entries to a temporary file in the same directory
+// as path and renames it, so that readers never see a partial snapshot.
+func snapshotToFile(path string, entries []logEntry) error {
+	if err := checkSnapshotPath(path); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly after the rename
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, msg := range entries {
+		if _, err := fmt.Fprintf(w, "%s\n", msg.String()); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// timestampSources is a flag.Value listing globs of the logs which are
+// trusted to start each line with the time it was originally written, as
+// an RFC3339 timestamp followed by a space. The timestamp is removed from
+// the message and kept alongside the time memlogd received it, and is used
+// in place of it to order dumps and to filter by time.
+type timestampSources []string
+
+var trustedTimestamps timestampSources
+
+func (t *timestampSources) String() string {
+	return strings.Join(*t, ",")
+}
+
+func (t *timestampSources) Set(value string) error {
+	if _, err := path.Match(value, ""); err != nil {
+		return fmt.Errorf("invalid glob %q: %v", value, err)
+	}
+	*t = append(*t, value)
+	return nil
+}
+
+// trusted returns true if the source's own timestamps are preserved.
+func (t timestampSources) trusted(source string) bool {
+	for _, glob := range t {
+		if ok, _ := path.Match(glob, source); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// splitTimestamp removes a leading timestamp and space from a line.
+func splitTimestamp(line string) (time.Time, string, bool) {
+	bits := strings.SplitN(line, " ", 2)
+	if len(bits) != 2 {
+		return time.Time{}, line, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, bits[0])
+	if err != nil {
+		return time.Time{}, line, false
+	}
+	return t, bits[1], true
+}
@@ -0,0 +1,504 @@
+// Package memlogdtest implements the memlogd protocols in memory, so that
+// the clients of memlogd can be tested without root, a VM or sockets in
+// /var/run.
+//
+// Queries are served over net.Pipe connections from Dial. Clients which
+// pass fds to register a log need a real unix domain socket, which
+// ListenWrite creates in a directory of the test's choosing; likewise
+// ListenQuery for clients which dial a path. Hellos are answered on both,
+// and registrations are recorded with their metadata. Setting Version and
+// Features simulates older versions of memlogd.
+//
+// It is only a simulator: it keeps every message, and a follower which
+// falls more than FollowerLines behind is disconnected.
+package memlogdtest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The command bytes of the query protocol.
+const (
+	Dump       = 0
+	Follow     = 1
+	DumpFollow = 2
+	Filter     = 3 // followed by a JSON filter
+	Hello      = 6 // followed by a JSON hello
+)
+
+// ProtocolVersion is the version sent in reply to a hello.
+const ProtocolVersion = 1
+
+// Features are the optional parts of the memlogd protocols which are
+// simulated, sent in reply to a hello unless a Server has its own.
+var Features = []string{"filter", "seq", "metadata", "namespace"}
+
+// NoHello is the Version of a memlogd which predates the handshake. It
+// never answers a hello on the log socket, and closes a query connection
+// which starts with one.
+const NoHello = -1
+
+// FollowerLines is how many messages a follower may fall behind by.
+const FollowerLines = 1000
+
+// Entry is a message in the buffer.
+type Entry struct {
+	Time   time.Time
+	Source string
+	Seq    uint64
+	Msg    string
+	Meta   *Metadata // of the source when the message was logged, or nil
+}
+
+// Metadata describes the writer of a log, as sent after its name when it
+// is registered.
+type Metadata struct {
+	Service     string `json:"service,omitempty"`
+	Stream      string `json:"stream,omitempty"`
+	Pid         int    `json:"pid,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Priority    *int   `json:"priority,omitempty"`
+	LevelPrefix bool   `json:"level_prefix,omitempty"`
+}
+
+// Registration is a datagram received on the log socket.
+type Registration struct {
+	Name string
+	Meta *Metadata // nil if none was sent
+	Fd   bool      // false for an update of the metadata of a log
+}
+
+// String returns the entry in the memlogd message format.
+func (e *Entry) String() string {
+	return fmt.Sprintf("%s,%s,%d;%s", e.Time.Format(time.RFC3339), e.Source, e.Seq, e.Msg)
+}
+
+// legacyString returns the entry in the format sent to clients which don't
+// say hello, which has no sequence number.
+func (e *Entry) legacyString() string {
+	return fmt.Sprintf("%s,%s;%s", e.Time.Format(time.RFC3339), e.Source, e.Msg)
+}
+
+// filter is the subset of the memlogd filter which is simulated.
+type filter struct {
+	Mode      byte      `json:"mode"`
+	Source    string    `json:"source,omitempty"`
+	Since     time.Time `json:"since,omitempty"`
+	Until     time.Time `json:"until,omitempty"`
+	Max       int       `json:"max,omitempty"`
+	FromSeq   uint64    `json:"from_seq,omitempty"`
+	Instance  string    `json:"instance,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+}
+
+func (f *filter) match(e *Entry) bool {
+	if f.Namespace != "" && (e.Meta == nil || e.Meta.Namespace != f.Namespace) {
+		return false
+	}
+	if f.Source != "" {
+		if ok, err := path.Match(f.Source, e.Source); err != nil || !ok {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return e.Seq >= f.FromSeq
+}
+
+type follower struct {
+	filter *filter
+	output chan *Entry
+}
+
+// Server is an in-memory memlogd.
+type Server struct {
+	// Now returns the time messages are stamped with, time.Now if nil.
+	Now func() time.Time
+
+	// Instance is sent in reply to a hello. As with memlogd, FromSeq is
+	// ignored unless it comes with the same instance, and is no more than
+	// one after the newest message.
+	Instance string
+
+	// Version and Features are sent in reply to a hello, ProtocolVersion
+	// and the package Features if they are unset. A Version of NoHello
+	// simulates a memlogd which predates the handshake. Without the
+	// "metadata" feature a whole registration datagram is taken as the
+	// name of the log, as older versions of memlogd do.
+	Version  int
+	Features []string
+
+	mu            sync.Mutex
+	entries       []*Entry
+	followers     []*follower
+	closers       []io.Closer
+	sources       map[string]*Metadata
+	registrations []Registration
+}
+
+// NewServer returns an empty Server.
+func NewServer() *Server {
+	return &Server{}
+}
+
+// Log adds a message to the named log.
+func (s *Server) Log(source, msg string) {
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := &Entry{Time: now(), Source: source, Seq: uint64(len(s.entries)) + 1, Msg: msg, Meta: s.sources[source]}
+	s.entries = append(s.entries, e)
+	followers := s.followers[:0]
+	for _, f := range s.followers {
+		if !f.filter.match(e) {
+			followers = append(followers, f)
+			continue
+		}
+		select {
+		case f.output <- e:
+			followers = append(followers, f)
+		default:
+			// too far behind
+			close(f.output)
+		}
+	}
+	s.followers = followers
+}
+
+// Entries returns the messages logged so far.
+func (s *Server) Entries() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []Entry
+	for _, e := range s.entries {
+		entries = append(entries, *e)
+	}
+	return entries
+}
+
+// SetMetadata merges the non-empty fields of meta into the metadata of a
+// log, as memlogd does when a log is registered with metadata.
+func (s *Server) SetMetadata(source string, meta *Metadata) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	merged := &Metadata{}
+	if old, ok := s.sources[source]; ok {
+		*merged = *old
+	}
+	if meta.Service != "" {
+		merged.Service = meta.Service
+	}
+	if meta.Stream != "" {
+		merged.Stream = meta.Stream
+	}
+	if meta.Pid != 0 {
+		merged.Pid = meta.Pid
+	}
+	if meta.Namespace != "" {
+		merged.Namespace = meta.Namespace
+	}
+	if meta.Priority != nil {
+		merged.Priority = meta.Priority
+	}
+	if meta.LevelPrefix {
+		merged.LevelPrefix = true
+	}
+	if s.sources == nil {
+		s.sources = map[string]*Metadata{}
+	}
+	s.sources[source] = merged
+}
+
+// Metadata returns the metadata of a log, or nil if it has none.
+func (s *Server) Metadata(source string) *Metadata {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sources[source]
+}
+
+// Registrations returns the datagrams received on the log socket so far,
+// other than hellos, in the order they arrived.
+func (s *Server) Registrations() []Registration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Registration(nil), s.registrations...)
+}
+
+// Register logs each line read from r as the named log, as memlogd does
+// with a registered fd, until r returns an error.
+func (s *Server) Register(name string, r io.Reader) {
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			s.Log(name, scanner.Text())
+		}
+		if c, ok := r.(io.Closer); ok {
+			c.Close()
+		}
+	}()
+}
+
+// Dial returns a connection to the query protocol.
+func (s *Server) Dial() net.Conn {
+	client, server := net.Pipe()
+	go s.serve(server)
+	return client
+}
+
+// ListenQuery serves the query protocol on a unix domain socket.
+func (s *Server) ListenQuery(socket string) error {
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	s.addCloser(l)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// ListenWrite accepts the registration of logs on a unix domain datagram
+// socket: the name of the log, optionally followed by a newline and JSON
+// Metadata, with the fd to read attached unless only the metadata is
+// updated. Hellos sent in place of a name are answered.
+func (s *Server) ListenWrite(socket string) error {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	s.addCloser(conn)
+	go func() {
+		b := make([]byte, 4096)
+		oob := make([]byte, 512)
+		for {
+			n, oobn, _, addr, err := conn.ReadMsgUnix(b, oob)
+			if err != nil {
+				return
+			}
+			bits := strings.SplitN(string(b[:n]), "\n", 2)
+			if bits[0] == helloName {
+				if s.version() != NoHello && addr != nil {
+					conn.WriteToUnix(s.hello(), addr)
+				}
+				continue
+			}
+			reg := Registration{Name: string(b[:n])}
+			if s.supports("metadata") {
+				reg.Name = bits[0]
+				if len(bits) == 2 && bits[1] != "" {
+					var meta Metadata
+					if err := json.Unmarshal([]byte(bits[1]), &meta); err == nil {
+						reg.Meta = &meta
+					}
+				}
+			}
+			var fds []int
+			if msgs, err := syscall.ParseSocketControlMessage(oob[:oobn]); err == nil {
+				for _, msg := range msgs {
+					if rights, err := syscall.ParseUnixRights(&msg); err == nil {
+						fds = append(fds, rights...)
+					}
+				}
+			}
+			reg.Fd = len(fds) > 0
+			if reg.Meta != nil && !strings.Contains(reg.Name, ";") {
+				s.SetMetadata(reg.Name, reg.Meta)
+			}
+			s.mu.Lock()
+			s.registrations = append(s.registrations, reg)
+			s.mu.Unlock()
+			for _, fd := range fds {
+				if strings.Contains(reg.Name, ";") {
+					syscall.Close(fd)
+					continue
+				}
+				s.Register(reg.Name, os.NewFile(uintptr(fd), reg.Name))
+			}
+		}
+	}()
+	return nil
+}
+
+// helloName is sent in place of the name of a log to say hello on the log
+// socket.
+const helloName = ";hello"
+
+func (s *Server) version() int {
+	if s.Version == 0 {
+		return ProtocolVersion
+	}
+	return s.Version
+}
+
+func (s *Server) features() []string {
+	if s.Features == nil {
+		return Features
+	}
+	return s.Features
+}
+
+func (s *Server) supports(feature string) bool {
+	for _, f := range s.features() {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// hello returns the reply to a hello, as JSON without a newline.
+func (s *Server) hello() []byte {
+	reply := map[string]interface{}{"version": s.version(), "features": s.features()}
+	if s.Instance != "" {
+		reply["instance"] = s.Instance
+	}
+	b, _ := json.Marshal(reply)
+	return b
+}
+
+func (s *Server) addCloser(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closers = append(s.closers, c)
+}
+
+// Close stops listening and disconnects the followers.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.closers {
+		c.Close()
+	}
+	s.closers = nil
+	for _, f := range s.followers {
+		close(f.output)
+	}
+	s.followers = nil
+	return nil
+}
+
+// serve answers a query.
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var mode byte
+	f := &filter{}
+	hello := false
+	for {
+		var err error
+		if mode, err = r.ReadByte(); err != nil {
+			return
+		}
+		if mode != Hello {
+			break
+		}
+		if s.version() == NoHello {
+			// an unknown command
+			return
+		}
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+		if _, err := conn.Write(append(s.hello(), '\n')); err != nil {
+			return
+		}
+		hello = true
+	}
+	format := (*Entry).String
+	if !hello && mode != Filter {
+		format = (*Entry).legacyString
+	}
+	if mode == Filter {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if err := json.Unmarshal([]byte(line), f); err != nil {
+			fmt.Fprintf(conn, "ERROR: %v\n", err)
+			return
+		}
+		mode = f.Mode
+	}
+	if mode > DumpFollow {
+		fmt.Fprintf(conn, "ERROR: unknown command %d\n", mode)
+		return
+	}
+
+	s.mu.Lock()
+	if f.Instance != s.Instance || f.FromSeq > uint64(len(s.entries))+1 {
+		f.FromSeq = 0
+	}
+	var buffered []*Entry
+	if mode == Dump || mode == DumpFollow {
+		for _, e := range s.entries {
+			if f.match(e) {
+				buffered = append(buffered, e)
+			}
+		}
+		if f.Max > 0 && len(buffered) > f.Max {
+			buffered = buffered[len(buffered)-f.Max:]
+		}
+	}
+	var fl *follower
+	if mode == Follow || mode == DumpFollow {
+		fl = &follower{filter: f, output: make(chan *Entry, FollowerLines)}
+		s.followers = append(s.followers, fl)
+	}
+	s.mu.Unlock()
+
+	for _, e := range buffered {
+		if _, err := io.WriteString(conn, format(e)+"\n"); err != nil {
+			s.unfollow(fl)
+			return
+		}
+	}
+	if fl == nil {
+		return
+	}
+	for e := range fl.output {
+		if _, err := io.WriteString(conn, format(e)+"\n"); err != nil {
+			s.unfollow(fl)
+			return
+		}
+	}
+}
+
+// unfollow stops sending messages to a follower.
+func (s *Server) unfollow(fl *follower) {
+	if fl == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.followers {
+		if f == fl {
+			s.followers = append(s.followers[:i], s.followers[i+1:]...)
+			close(fl.output)
+			return
+		}
+	}
+}
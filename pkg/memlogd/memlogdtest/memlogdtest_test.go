@@ -0,0 +1,257 @@
+package memlogdtest
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memlogdtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewServer()
+	s.Now = func() time.Time { return time.Date(2018, 7, 8, 9, 16, 53, 0, time.UTC) }
+	defer s.Close()
+	writeSocket := filepath.Join(dir, "write.sock")
+	if err := s.ListenWrite(writeSocket); err != nil {
+		t.Fatal(err)
+	}
+
+	// register a log as init does, by passing an fd
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "client.sock"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	raddr := &net.UnixAddr{Name: writeSocket, Net: "unixgram"}
+	if _, _, err := conn.WriteMsgUnix([]byte("sshd\n{}"), syscall.UnixRights(int(r.Fd())), raddr); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	query := s.Dial()
+	defer query.Close()
+	if _, err := query.Write([]byte{Filter}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query.Write([]byte("{\"mode\":1,\"source\":\"ssh*\"}\n")); err != nil {
+		t.Fatal(err)
+	}
+	// wait for the follower, so the message isn't missed
+	for {
+		s.mu.Lock()
+		n := len(s.followers)
+		s.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.Log("other", "not matched")
+	if _, err := w.Write([]byte("Server listening on :: port 22.\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(query).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "2018-07-08T09:16:53Z,sshd,2;Server listening on :: port 22.\n"
+	if line != expected {
+		t.Errorf("Expected %q, got %q", expected, line)
+	}
+	if entries := s.Entries(); len(entries) != 2 || !strings.HasPrefix(entries[1].Msg, "Server") {
+		t.Errorf("Unexpected entries %v", entries)
+	}
+}
+
+func TestHello(t *testing.T) {
+	s := NewServer()
+	s.Now = func() time.Time { return time.Date(2018, 7, 8, 9, 16, 53, 0, time.UTC) }
+	defer s.Close()
+	s.Log("sshd", "hello TestHello")
+
+	// clients which don't say hello get the original format
+	for _, test := range []struct {
+		request  string
+		expected []string
+	}{
+		{string([]byte{Dump}), []string{"2018-07-08T09:16:53Z,sshd;hello TestHello\n"}},
+		{string([]byte{Hello}) + "{\"version\":1}\n" + string([]byte{Dump}), []string{
+			"{\"features\":[\"filter\",\"seq\",\"metadata\",\"namespace\"],\"version\":1}\n",
+			"2018-07-08T09:16:53Z,sshd,1;hello TestHello\n",
+		}},
+	} {
+		query := s.Dial()
+		if _, err := query.Write([]byte(test.request)); err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(query)
+		for _, expected := range test.expected {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line != expected {
+				t.Errorf("Expected %q, got %q", expected, line)
+			}
+		}
+		query.Close()
+	}
+}
+
+func TestWriteHello(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memlogdtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, test := range []struct {
+		version  int
+		features []string
+		expected string // empty for no answer
+	}{
+		{0, nil, "{\"features\":[\"filter\",\"seq\",\"metadata\",\"namespace\"],\"version\":1}"},
+		{1, []string{}, "{\"features\":[],\"version\":1}"},
+		{NoHello, nil, ""},
+	} {
+		s := NewServer()
+		s.Version = test.version
+		s.Features = test.features
+		writeSocket := filepath.Join(dir, fmt.Sprintf("%d.sock", i))
+		if err := s.ListenWrite(writeSocket); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, fmt.Sprintf("%d.client.sock", i)), Net: "unixgram"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.WriteToUnix([]byte(";hello\n{\"version\":1}"), &net.UnixAddr{Name: writeSocket, Net: "unixgram"}); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		b := make([]byte, 4096)
+		n, err := conn.Read(b)
+		switch {
+		case test.expected == "" && err == nil:
+			t.Errorf("%d: expected no answer, got %q", test.version, b[:n])
+		case test.expected != "" && string(b[:n]) != test.expected:
+			t.Errorf("%d: expected %q, got %q: %v", test.version, test.expected, b[:n], err)
+		}
+		if regs := s.Registrations(); len(regs) != 0 {
+			t.Errorf("%d: expected the hello not to be a registration, got %v", test.version, regs)
+		}
+		conn.Close()
+		s.Close()
+	}
+}
+
+func TestRegistrationMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memlogdtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, features := range [][]string{nil, {"filter", "seq"}} {
+		s := NewServer()
+		s.Features = features
+		writeSocket := filepath.Join(dir, fmt.Sprintf("%d.sock", i))
+		if err := s.ListenWrite(writeSocket); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, fmt.Sprintf("%d.client.sock", i)), Net: "unixgram"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		raddr := &net.UnixAddr{Name: writeSocket, Net: "unixgram"}
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// register with an fd, then add the pid and namespace
+		if _, _, err := conn.WriteMsgUnix([]byte("sshd\n{\"service\":\"sshd\",\"stream\":\"stderr\"}"), syscall.UnixRights(int(r.Fd())), raddr); err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		if _, err := conn.WriteToUnix([]byte("sshd\n{\"pid\":42,\"namespace\":\"services.linuxkit\"}"), raddr); err != nil {
+			t.Fatal(err)
+		}
+		var regs []Registration
+		for start := time.Now(); len(regs) < 2 && time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+			regs = s.Registrations()
+		}
+		if features != nil {
+			// older versions take the whole datagram as the name
+			if len(regs) != 2 || regs[0].Name != "sshd\n{\"service\":\"sshd\",\"stream\":\"stderr\"}" || regs[0].Meta != nil || s.Metadata("sshd") != nil {
+				t.Errorf("expected registrations without metadata, got %+v", regs)
+			}
+			w.Close()
+			conn.Close()
+			s.Close()
+			continue
+		}
+		expected := []Registration{
+			{Name: "sshd", Meta: &Metadata{Service: "sshd", Stream: "stderr"}, Fd: true},
+			{Name: "sshd", Meta: &Metadata{Pid: 42, Namespace: "services.linuxkit"}},
+		}
+		if !reflect.DeepEqual(regs, expected) {
+			t.Errorf("expected registrations %+v, got %+v", expected, regs)
+		}
+		merged := &Metadata{Service: "sshd", Stream: "stderr", Pid: 42, Namespace: "services.linuxkit"}
+		if meta := s.Metadata("sshd"); !reflect.DeepEqual(meta, merged) {
+			t.Errorf("expected metadata %+v, got %+v", merged, meta)
+		}
+
+		// messages are selected by the namespace of their source
+		if _, err := w.Write([]byte("Server listening on :: port 22.\n")); err != nil {
+			t.Fatal(err)
+		}
+		for start := time.Now(); len(s.Entries()) < 1 && time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		}
+		s.Log("dhcpcd", "not in a namespace")
+		for _, test := range []struct {
+			namespace string
+			expected  string
+		}{
+			{"services.linuxkit", "sshd"},
+			{"other", ""},
+		} {
+			query := s.Dial()
+			fmt.Fprintf(query, "%c{\"mode\":0,\"namespace\":%q}\n", Filter, test.namespace)
+			b, err := ioutil.ReadAll(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sources []string
+			for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+				if line != "" {
+					sources = append(sources, strings.SplitN(line, ",", 3)[1])
+				}
+			}
+			if strings.Join(sources, ",") != test.expected {
+				t.Errorf("%s: expected messages from %q, got %q", test.namespace, test.expected, b)
+			}
+			query.Close()
+		}
+		w.Close()
+		conn.Close()
+		s.Close()
+	}
+}